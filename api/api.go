@@ -0,0 +1,73 @@
+// Package api holds the types and names of the contact tracing HTTP API shared by
+// the server, the backend and clients, and the encryption of reports.  It only
+// depends on the standard library.
+package api
+
+const (
+	// EndpointCTReport is the name of the HTTP endpoint for POST of CTReport
+	EndpointCTReport = "report"
+
+	// EndpointCTQuery is the name of the HTTP endpoint for POST of query to get reports
+	EndpointCTQuery = "query"
+
+	EndpointCTSync = "sync"
+
+	// EndpointCTPIR is the name of the HTTP endpoint for POST of an experimental PIR query
+	EndpointCTPIR = "pir"
+
+	// EndpointCTPSI is the name of the HTTP endpoint for POST of a private set intersection query
+	EndpointCTPSI = "psi"
+
+	// EndpointCTSubscribe is the name of the HTTP endpoint pushing new reports, as
+	// Server-Sent Events or over a WebSocket
+	EndpointCTSubscribe = "subscribe"
+
+	// NextCursorHeader carries the cursor of the next page of a paged sync, empty on the last page
+	NextCursorHeader = "X-Next-Cursor"
+
+	// IdempotencyKeyHeader names a report submission; a submission repeated with the same
+	// key and body within the idempotency window gets the original results
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is set on the response to a repeated submission
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// LastEventIDHeader is sent by an EventSource reconnecting, with the id (receipt
+	// time in milliseconds) of the last report it received
+	LastEventIDHeader = "Last-Event-ID"
+
+	// PrefixSize is the size of the HashedPK prefixes reports are queried by
+	PrefixSize = 3
+)
+
+// CTReport payload is sent by client to /fmreport when user reports symptoms
+type CTReport struct {
+	HashedPK   []byte `json:"hashedPK"`
+	EncodedMsg []byte `json:"encodedMsg"`
+
+	// ID is the report ID the server stores the report under, set in query and sync
+	// results so clients can drop reports they already have; ignored on submission
+	ID string `json:"id,omitempty"`
+
+	// Timestamp is when the server received the report (unix milliseconds), set in
+	// query and sync results; ignored on submission
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// Outcomes of a submitted report
+const (
+	// ReportAccepted reports are stored (or durably queued)
+	ReportAccepted = "accepted"
+
+	// ReportRejected reports are invalid or failed permanently; resubmitting them will not help
+	ReportRejected = "rejected"
+
+	// ReportRetryable reports failed transiently and may be resubmitted
+	ReportRetryable = "retryable"
+)
+
+// ReportResult is the outcome of one report of a submission
+type ReportResult struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
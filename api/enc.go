@@ -1,4 +1,4 @@
-package backend
+package api
 
 import (
 	"crypto/aes"
@@ -10,14 +10,10 @@ import (
 	"encoding/asn1"
 	"fmt"
 	"io"
-	"log"
 	"math/big"
-
-	"github.com/gogo/protobuf/proto"
 )
 
 const (
-	PrefixSize      = 3
 	PublicKeyPrefix = 0
 	RawSigPrefix    = 1
 	MPrefix         = 2
@@ -69,7 +65,6 @@ func Sign(priv *ecdsa.PrivateKey, m []byte) ([]byte, error) {
 	prefix[MPrefix] = byte(len(m))                           // prefix[len(pkey),len(sig),len(m)]
 	sigWithPkandM := append(append(pubkey, signed...), m...) // [PK, sig, m]
 	fullsig := append(prefix, sigWithPkandM...)              // [prefix,PK, sig, m]
-	fmt.Printf("\n[pk=%d,sig=%d,m=%d]\npk=%x\nsig=%x\nm=%x\n", len(pubkey), len(signed), len(m), pubkey, signed, m)
 	return fullsig, nil
 }
 
@@ -174,20 +169,14 @@ func DecryptCTReport(report CTReport, ss []byte) (memoByte []byte, err error) {
 	return memoByte, err
 }
 
-func (m *ContactTracingMemo) Bytes() (mbyte []byte) {
-	mByte, err := proto.Marshal(m)
-	if err != nil {
-		log.Fatal("marshaling error: ", err)
-		return nil
-	}
-	return mByte
-}
-
-func ByteToContactTracingMemo(mbyte []byte) (m *ContactTracingMemo) {
-	m = &ContactTracingMemo{}
-	err := proto.Unmarshal(mbyte, m)
-	if err != nil {
-		log.Fatal("unmarshaling error: ", err)
+// Computehash returns the hash of its inputs
+func Computehash(data ...[]byte) []byte {
+	hasher := sha256.New()
+	for _, b := range data {
+		_, err := hasher.Write(b)
+		if err != nil {
+			panic(1)
+		}
 	}
-	return m
+	return hasher.Sum(nil)
 }
@@ -1,4 +1,4 @@
-package backend
+package api
 
 import (
 	"bytes"
@@ -14,6 +14,7 @@ import (
 	"crypto/rand"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/wolkdb/contact-tracing-server/memopb"
 )
 
 func TestEncryption(t *testing.T) {
@@ -107,7 +108,7 @@ func TestCTReport(t *testing.T) {
 	fmt.Printf("\nA Verified msgB: DecryptedCiphertextB=[%x](%d)\n", DecryptedCiphertextB, int64(binary.LittleEndian.Uint64(DecryptedCiphertextB)))
 
 	//Step2 - Encryption. A is sick and computes EncodedMsg following a protobuf serialization scheme within a CTReport R using (1b)'s PK_B(t)
-	memoS := &ContactTracingMemo{ReportType: 1, DiseaseID: 2, SymptomID: []int32{5, 7, 123}}
+	memoS := &memopb.ContactTracingMemo{ReportType: 1, DiseaseID: 2, SymptomID: []int32{5, 7, 123}}
 	memoByteS, err := proto.Marshal(memoS)
 	if err != nil {
 		log.Fatal("marshaling error: ", err)
@@ -139,7 +140,7 @@ func TestCTReport(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	vMemoS := &ContactTracingMemo{}
+	vMemoS := &memopb.ContactTracingMemo{}
 	err = proto.Unmarshal(dmemoByteS, vMemoS)
 	if err != nil {
 		log.Fatal("unmarshaling error: ", err)
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ShardBits is the number of leading HashedPK bits a shard can select on: the bits of
+// a prefix
+const ShardBits = 8 * PrefixSize
+
+// Shard selects the reports whose HashedPK starts with a bit prefix, so that a client
+// can sync only the part of the key space that covers its own prefixes.  The zero
+// Shard selects every report.
+type Shard struct {
+	// Prefix holds the leading Bits bits of the HashedPK, right aligned
+	Prefix uint32
+	Bits   int
+}
+
+// ParseShard parses a shard written as hex digits ("a", 4 bits per digit) or as hex
+// digits and a bit length ("a8/5", the leading 5 bits of 0xa8); "" is every report
+func ParseShard(str string) (shard Shard, err error) {
+	if str == "" {
+		return shard, nil
+	}
+	digits, bits := str, 4*len(str)
+	if i := strings.IndexByte(str, '/'); i >= 0 {
+		digits = str[:i]
+		if bits, err = strconv.Atoi(str[i+1:]); err != nil || bits < 0 || bits > 4*len(digits) {
+			return shard, fmt.Errorf("invalid shard %q", str)
+		}
+	}
+	if len(digits) == 0 || len(digits) > ShardBits/4 {
+		return shard, fmt.Errorf("invalid shard %q", str)
+	}
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil {
+		return shard, fmt.Errorf("invalid shard %q", str)
+	}
+	shard = Shard{Prefix: uint32(value) >> uint(4*len(digits)-bits), Bits: bits}
+	if shard.Prefix<<uint(4*len(digits)-bits) != uint32(value) {
+		return shard, fmt.Errorf("invalid shard %q: bits set after the prefix", str)
+	}
+	return shard, nil
+}
+
+// String returns the shard as parsed by ParseShard
+func (shard Shard) String() string {
+	if shard.Bits == 0 {
+		return ""
+	}
+	digits := (shard.Bits + 3) / 4
+	str := fmt.Sprintf("%0*x", digits, shard.Prefix<<uint(4*digits-shard.Bits))
+	if shard.Bits%4 != 0 {
+		str += "/" + strconv.Itoa(shard.Bits)
+	}
+	return str
+}
+
+// Valid reports whether the shard can be read
+func (shard Shard) Valid() bool {
+	return shard.Bits >= 0 && shard.Bits <= ShardBits && shard.Prefix>>uint(shard.Bits) == 0
+}
+
+// Contains reports whether hashedPK is in the shard
+func (shard Shard) Contains(hashedPK []byte) bool {
+	if shard.Bits == 0 {
+		return true
+	}
+	if len(hashedPK) < PrefixSize {
+		return false
+	}
+	var key uint32
+	for _, b := range hashedPK[:PrefixSize] {
+		key = key<<8 | uint32(b)
+	}
+	return key>>uint(ShardBits-shard.Bits) == shard.Prefix
+}
+
+// KeyRange returns the hex prefixes of the shard, [start, limit) with limit "" at the
+// end of the key space
+func (shard Shard) KeyRange() (start string, limit string) {
+	shift := uint(ShardBits - shard.Bits)
+	start = fmt.Sprintf("%0*x", ShardBits/4, shard.Prefix<<shift)
+	if next := (shard.Prefix + 1) << shift; next < 1<<ShardBits {
+		limit = fmt.Sprintf("%0*x", ShardBits/4, next)
+	}
+	return start, limit
+}
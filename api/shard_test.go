@@ -0,0 +1,48 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	for _, c := range []struct {
+		str    string
+		shard  Shard
+		keys   [2]string
+		canon  string
+		hashed []byte
+	}{
+		{"", Shard{}, [2]string{"000000", ""}, "", []byte{0xff, 0, 0}},
+		{"a", Shard{Prefix: 0xa, Bits: 4}, [2]string{"a00000", "b00000"}, "a", []byte{0xa5, 0, 0}},
+		{"F", Shard{Prefix: 0xf, Bits: 4}, [2]string{"f00000", ""}, "f", []byte{0xff, 0xff, 0xff}},
+		{"8/1", Shard{Prefix: 1, Bits: 1}, [2]string{"800000", ""}, "8/1", []byte{0x80, 0, 0}},
+		{"a8/5", Shard{Prefix: 0x15, Bits: 5}, [2]string{"a80000", "b00000"}, "a8/5", []byte{0xaf, 0, 0}},
+		{"08/6", Shard{Prefix: 0x2, Bits: 6}, [2]string{"080000", "0c0000"}, "08/6", []byte{0x0b, 0, 0}},
+		{"abcdef", Shard{Prefix: 0xabcdef, Bits: 24}, [2]string{"abcdef", "abcdf0"}, "abcdef", []byte{0xab, 0xcd, 0xef, 1}},
+	} {
+		shard, err := ParseShard(c.str)
+		if err != nil {
+			t.Fatalf("%q: %v", c.str, err)
+		}
+		if shard != c.shard {
+			t.Fatalf("%q: expected %+v, got %+v", c.str, c.shard, shard)
+		}
+		if start, limit := shard.KeyRange(); start != c.keys[0] || limit != c.keys[1] {
+			t.Fatalf("%q: rows [%s, %s)", c.str, start, limit)
+		}
+		if shard.String() != c.canon {
+			t.Fatalf("%q: String() %q", c.str, shard.String())
+		}
+		if !shard.Contains(c.hashed) {
+			t.Fatalf("%q: does not contain %x", c.str, c.hashed)
+		}
+	}
+	for _, str := range []string{"g", "abcdef0", "a/5", "8/x", "8/-1", "/", "c/1", "ab/9", "0a/6"} {
+		if _, err := ParseShard(str); err == nil {
+			t.Fatalf("%q: expected an error", str)
+		}
+	}
+	if (Shard{Prefix: 0xa, Bits: 4}).Contains([]byte{0xb0, 0, 0}) {
+		t.Fatalf("shard a contains b0")
+	}
+}
@@ -2,129 +2,440 @@ package backend
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/bigtable"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/logging"
+	"github.com/wolkdb/contact-tracing-server/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-const threadsPerRequest = 10
+const (
+	// DefaultTableName is the Bigtable table holding reports
+	DefaultTableName = "report"
+
+	// DefaultColumnFamily is the column family holding reports
+	DefaultColumnFamily = "report"
+
+	// DefaultThreadsPerRequest is the default number of concurrent Bigtable reads of a query
+	DefaultThreadsPerRequest = 10
+
+	// queryBatchSize is the number of prefixes read by one ReadRows call of a query
+	queryBatchSize = 1000
+
+	// maxWriteAttempts bounds the writes of a report failing transiently, and
+	// writeRetryBackoff is the wait before the first retry; it doubles on every retry
+	maxWriteAttempts  = 3
+	writeRetryBackoff = 50 * time.Millisecond
+)
 
 type Backend struct {
 	client           *bigtable.Client
 	table            *bigtable.Table
 	tableName        string
 	columnFamilyName string
+
+	threadsPerRequest int
+	retention         time.Duration
+
+	index        *prefixIndex
+	indexRefresh time.Duration
+
+	queue *ingestQueue
+
+	idempotencyWindow time.Duration
+
+	pubsub PubSub
+
+	pirCache epochCache
+	psiCache epochCache
 }
 
-func NewBackend(conf *Config) (backend *Backend, err error) {
+// NewBackend connects to Bigtable; opts are passed to the Bigtable client (e.g. to use an emulator)
+func NewBackend(conf *Config, opts ...option.ClientOption) (backend *Backend, err error) {
 	ctx := context.Background()
 	backend = new(Backend)
 
-	client, err := bigtable.NewClient(ctx, conf.BigtableProject, conf.BigtableInstance)
+	client, err := bigtable.NewClient(ctx, conf.BigtableProject, conf.BigtableInstance, opts...)
 	if err != nil {
-		log.Printf("bigtable err %v\n", err)
+		logging.FromContext(ctx).Error("bigtable client", "err", err)
+		return backend, err
+	}
+	backend.tableName, backend.columnFamilyName = conf.tableNames()
+	backend.threadsPerRequest = conf.ThreadsPerRequest
+	if backend.threadsPerRequest <= 0 {
+		backend.threadsPerRequest = DefaultThreadsPerRequest
+	}
+	backend.retention = time.Duration(conf.RetentionDays) * 24 * time.Hour
+	backend.idempotencyWindow = conf.idempotencyWindow()
+	if backend.pubsub, err = newPubSub(conf, backend); err != nil {
 		return backend, err
 	}
-	backend.columnFamilyName = "report"
-	backend.tableName = "report"
 	backend.client = client
 	backend.table = backend.client.Open(backend.tableName)
+
+	if conf.IndexMemoryBytes > 0 {
+		window := defaultIndexWindow
+		if conf.IndexWindowSeconds > 0 {
+			window = time.Duration(conf.IndexWindowSeconds) * time.Second
+		}
+		backend.indexRefresh = defaultIndexRefresh
+		if conf.IndexRefreshSeconds > 0 {
+			backend.indexRefresh = time.Duration(conf.IndexRefreshSeconds) * time.Second
+		}
+		backend.index = newPrefixIndex(conf.IndexMemoryBytes, window)
+	}
+	if conf.WALDir != "" {
+		if backend.queue, err = openIngestQueue(conf); err != nil {
+			logging.FromContext(ctx).Error("write-ahead log", "dir", conf.WALDir, "err", err)
+			return backend, err
+		}
+		backend.queue.write = backend.writeReports
+	}
 	return backend, nil
 }
 
-func (backend *Backend) ProcessReport(reports []CTReport) (err error) {
-	timestamp := bigtable.Now()
+// Start kicks off the background loops of the backend
+func (backend *Backend) Start() {
+	if backend.index != nil {
+		go backend.indexLoop(backend.indexRefresh)
+	}
+	if backend.queue != nil {
+		go backend.queue.loop(context.Background())
+	}
+	if pubsub, ok := backend.pubsub.(*tablePubSub); ok {
+		go pubsub.loop(context.Background())
+	}
+}
+
+// Ping checks that the report table is reachable
+func (backend *Backend) Ping(ctx context.Context) error {
+	if backend == nil || backend.table == nil {
+		return fmt.Errorf("backend not initialized")
+	}
+	start := time.Now()
+	_, err := backend.table.ReadRow(ctx, "ping", bigtable.RowFilter(bigtable.StripValueFilter()))
+	observeBigtable("ReadRow", start, err)
+	return err
+}
+
+// reportID identifies a report by its content.  Each report is stored in the
+// columns EncodedMsg/<id> and HashedPK/<id> of its row, so reports sharing a
+// prefix never overwrite each other.
+func reportID(report CTReport) string {
+	return fmt.Sprintf("%x", api.Computehash([]byte{byte(len(report.HashedPK))}, report.HashedPK, report.EncodedMsg)[:16])
+}
+
+// assembleReports makes the result of a query or sync: every report once, at its
+// latest receipt time, ordered by receipt time then report ID so that the same reports
+// always come back in the same order, and tagged with its report ID and receipt time
+func assembleReports(timed []timedReport) (reports []CTReport) {
+	latest := make(map[string]int, len(timed))
+	var unique []timedReport
+	for _, report := range timed {
+		if i, ok := latest[report.id]; ok {
+			if report.timestamp > unique[i].timestamp {
+				unique[i].timestamp = report.timestamp
+			}
+			continue
+		}
+		latest[report.id] = len(unique)
+		unique = append(unique, report)
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		if unique[i].timestamp != unique[j].timestamp {
+			return unique[i].timestamp < unique[j].timestamp
+		}
+		return unique[i].id < unique[j].id
+	})
+	reports = make([]CTReport, len(unique))
+	for i, report := range unique {
+		reports[i] = report.response()
+	}
+	return reports
+}
+
+// ProcessReport stores the valid reports, failing if any of them is not accepted;
+// see ProcessReportResults for the outcome of every report
+func (backend *Backend) ProcessReport(ctx context.Context, reports []CTReport) (err error) {
+	results, err := backend.ProcessReportResults(ctx, reports)
+	for i, result := range results {
+		if result.Status == ReportRejected {
+			return fmt.Errorf("report %d %s: %s", i, result.Status, result.Reason)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for i, result := range results {
+		if result.Status != ReportAccepted {
+			return fmt.Errorf("report %d %s: %s", i, result.Status, result.Reason)
+		}
+	}
+	return nil
+}
+
+// ProcessReportResults stores the valid reports and returns the outcome of each.
+// With the ingestion queue (WALDir) a report is accepted once it is in the
+// write-ahead log; otherwise once it is written, after retrying transient row
+// failures up to maxWriteAttempts times.  err is set (ErrQueueFull, or the error
+// of the last write) when no valid report could be stored.  Reports are stored
+// under their report IDs, so resubmitting the ones not accepted is safe.
+func (backend *Backend) ProcessReportResults(ctx context.Context, reports []CTReport) (results []ReportResult, err error) {
+	results = make([]ReportResult, len(reports))
+	var valid []CTReport
+	var positions []int
+	for i, report := range reports {
+		if rejected := validateReport(report); rejected != nil {
+			results[i] = ReportResult{Status: ReportRejected, Reason: rejected.Error()}
+			continue
+		}
+		valid = append(valid, report)
+		positions = append(positions, i)
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	if backend.queue != nil {
+		if err = backend.queue.enqueue(valid); err != nil {
+			logging.FromContext(ctx).Error("ProcessReport: enqueue", "reports", len(valid), "err", err)
+			for _, i := range positions {
+				results[i] = ReportResult{Status: ReportRetryable, Reason: err.Error()}
+			}
+			return results, err
+		}
+		for _, i := range positions {
+			results[i] = ReportResult{Status: ReportAccepted}
+		}
+		return results, nil
+	}
+
+	rowErrs, err := backend.writeWithRetries(ctx, valid)
+	for j, i := range positions {
+		switch rowErr := rowErrs[j]; {
+		case rowErr == nil:
+			results[i] = ReportResult{Status: ReportAccepted}
+		case isTransient(rowErr):
+			results[i] = ReportResult{Status: ReportRetryable, Reason: rowErr.Error()}
+		default:
+			results[i] = ReportResult{Status: ReportRejected, Reason: rowErr.Error()}
+		}
+	}
+	return results, err
+}
+
+// validateReport returns why a report cannot be stored, nil if it can
+func validateReport(report CTReport) error {
+	if len(report.HashedPK) < PrefixSize {
+		return fmt.Errorf("hashedPK too short")
+	}
+	return nil
+}
+
+// writeWithRetries writes reports, rewriting those that failed transiently with
+// backoff.  It returns the error of every report after the last attempt, and err
+// if the last attempt failed as a whole.
+func (backend *Backend) writeWithRetries(ctx context.Context, reports []CTReport) (rowErrs []error, err error) {
+	rowErrs = make([]error, len(reports))
+	remaining := make([]int, len(reports))
+	for i := range remaining {
+		remaining[i] = i
+	}
+	backoff := writeRetryBackoff
+	for attempt := 1; ; attempt++ {
+		batch := make([]CTReport, len(remaining))
+		for j, i := range remaining {
+			batch[j] = reports[i]
+		}
+		var errs []error
+		errs, err = backend.writeReports(ctx, batch)
+		var retry []int
+		for j, i := range remaining {
+			rowErrs[i] = err
+			if err == nil && errs != nil {
+				rowErrs[i] = errs[j]
+			}
+			if rowErrs[i] != nil && isTransient(rowErrs[i]) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 || attempt == maxWriteAttempts {
+			return rowErrs, err
+		}
+		logging.FromContext(ctx).Warn("ProcessReport: retrying transient failures", "reports", len(retry), "attempt", attempt, "err", err)
+		writeRetries.Add(float64(len(retry)))
+		select {
+		case <-ctx.Done():
+			return rowErrs, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		remaining = retry
+	}
+}
+
+// isTransient reports whether a failed write may succeed if repeated
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// writeReports writes reports with one ApplyBulk (up to 100,000 mutations), returning
+// the per-report errors if it was applied
+func (backend *Backend) writeReports(ctx context.Context, reports []CTReport) (errs []error, err error) {
+	// Bigtable only keeps millisecond granularity
+	timestamp := bigtable.Now().TruncateToMilliseconds()
 	var keys []string
 	var muts []*bigtable.Mutation
+	var timed []timedReport
 	for _, report := range reports {
 		prefixHashedKey := fmt.Sprintf("%x", report.HashedPK[:3])
 		keys = append(keys, prefixHashedKey)
+		id := reportID(report)
 		mut := bigtable.NewMutation()
-		mut.Set(backend.columnFamilyName, "EncodedMsg", timestamp, report.EncodedMsg)
-		mut.Set(backend.columnFamilyName, "HashedPK", timestamp, report.HashedPK)
+		mut.Set(backend.columnFamilyName, "EncodedMsg/"+id, timestamp, report.EncodedMsg)
+		mut.Set(backend.columnFamilyName, "HashedPK/"+id, timestamp, report.HashedPK)
 		muts = append(muts, mut)
+		timed = append(timed, timedReport{CTReport: report, id: id, timestamp: timestamp})
+	}
+	start := time.Now()
+	bulkCtx, span := tracing.Start(ctx, "bigtable.ApplyBulk", attribute.Int("rows", len(keys)))
+	errs, err = backend.applyWithChangelog(bulkCtx, keys, muts, timed)
+	span.SetAttributes(attribute.Int("rowErrors", countErrors(errs)))
+	tracing.End(span, err)
+	observeBigtable("ApplyBulk", start, err)
+	if err == nil {
+		ingested := len(keys)
+		for _, rowErr := range errs {
+			if rowErr != nil {
+				bigtableErrors.WithLabelValues("ApplyBulk").Inc()
+				ingested--
+			}
+		}
+		reportsIngested.Add(float64(ingested))
 	}
-	//up to a max of 100,000
-	// will move this process to Loop
-	errs, err := backend.table.ApplyBulk(context.Background(), keys, muts)
 	if err != nil {
-		log.Printf("backend.table.ApplyBulk err %v %v\n", errs, err)
+		logging.FromContext(ctx).Error("ApplyBulk", "reports", len(keys), "err", err)
 	} else {
-		log.Printf("backend.table.ApplyBulk uploaded %d\n", len(keys))
+		logging.FromContext(ctx).Info("ApplyBulk", "reports", len(keys), "rowErrors", countErrors(errs))
 	}
-	return err
+	if err == nil {
+		var stored []timedReport
+		for i := range timed {
+			if errs != nil && errs[i] != nil {
+				continue
+			}
+			stored = append(stored, timed[i])
+			if backend.index != nil {
+				backend.index.add(keys[i], timed[i])
+			}
+		}
+		backend.publish(ctx, stored)
+	}
+	return errs, err
 }
 
 type reportResult struct {
-	results []CTReport
+	results []timedReport
 	err     error
 }
 
-func (backend *Backend) ProcessQuery(query []byte, timestamp int64) (reports []CTReport, err error) {
-	fmt.Println("******** ProcessQuery ***********", len(query))
+// ProcessQuery returns the reports under the query prefixes received since timestamp (unix seconds)
+func (backend *Backend) ProcessQuery(ctx context.Context, query []byte, timestamp int64) (reports []CTReport, err error) {
+	return backend.ProcessQueryRange(ctx, query, time.Unix(timestamp, 0), time.Time{})
+}
+
+// ProcessQueryRange returns the reports under the query prefixes received in
+// [since, until), see readWindow; a zero until is now
+func (backend *Backend) ProcessQueryRange(ctx context.Context, query []byte, since time.Time, until time.Time) (reports []CTReport, err error) {
+	ctx, span := tracing.Start(ctx, "ProcessQuery", attribute.Int("queryBytes", len(query)))
+	defer func() { tracing.End(span, err) }()
+	logger := logging.FromContext(ctx)
+	if len(query)%3 != 0 {
+		return nil, fmt.Errorf("query length %d is not a multiple of 3", len(query))
+	}
+	// split query into H(PK) prefixes, queryBatchSize rows per ReadRows
 	var prefixKeyList []bigtable.RowList
 	prefixkeys := make(bigtable.RowList, 0)
-	// TODO: split query into H(PK) prefixes
 	keyLength := len(query) / 3
-	threadNum := keyLength/1000 + 1
-	for q := 0; q < len(query); q += 3 {
+	for q := 0; q+3 <= len(query); q += 3 {
 		prefixkey := fmt.Sprintf("%x", query[q:(q+3)])
 		prefixkeys = append(prefixkeys, prefixkey)
-		if len(prefixkeys)%1000 == 1 && q != 0 {
+		if len(prefixkeys) == queryBatchSize {
 			prefixKeyList = append(prefixKeyList, prefixkeys)
 			prefixkeys = make(bigtable.RowList, 0)
 		}
-		fmt.Println("len list", len(prefixkeys))
 	}
-	fmt.Println("len list b", len(prefixkeys))
 	if len(prefixkeys) > 0 {
 		prefixKeyList = append(prefixKeyList, prefixkeys)
 	}
+	threadNum := len(prefixKeyList)
 
-	ctx := context.Background()
-	startTime := time.Unix(timestamp, 0)
-	fmt.Println(startTime)
-	endTime := time.Now()
-	fmt.Println(endTime)
+	startTime, endTime := backend.readWindow(since, until)
+	logger.Debug("ProcessQuery", "prefixes", keyLength, "batches", threadNum, "startTime", startTime, "endTime", endTime)
+	if !endTime.After(startTime) {
+		return nil, nil
+	}
+
+	var timed []timedReport
+	if backend.index != nil {
+		var allkeys []string
+		for _, list := range prefixKeyList {
+			allkeys = append(allkeys, list...)
+		}
+		if indexed, tailStart, ok := backend.index.lookup(allkeys, startTime, endTime); ok {
+			// only the reports stored since the last tail of the index are read
+			timed, startTime = indexed, tailStart
+			span.SetAttributes(attribute.Bool("indexHit", true))
+			if !endTime.After(startTime) {
+				reports = assembleReports(timed)
+				logger.Debug("ProcessQuery from prefix index", "reports", len(reports))
+				span.SetAttributes(attribute.Int("reports", len(reports)))
+				return reports, nil
+			}
+			logger.Debug("ProcessQuery from prefix index", "reports", len(timed), "tailStart", startTime)
+		}
+	}
 
 	filter := bigtable.ChainFilters(bigtable.FamilyFilter(backend.columnFamilyName), bigtable.TimestampRangeFilter(startTime, endTime))
 
-	resCh := make(chan *reportResult)
-	threadLimit := make(chan struct{}, threadsPerRequest)
+	// buffered: batches must not wait for the results to be collected while more
+	// than threadsPerRequest batches are still to be started
+	resCh := make(chan *reportResult, threadNum)
+	threadLimit := make(chan struct{}, backend.threadsPerRequest)
 	for i := 0; i < threadNum; i++ {
-		fmt.Println("creating thread", i)
 		threadLimit <- struct{}{}
-		go func(prefixkeys bigtable.RowList) {
+		go func(batch int, prefixkeys bigtable.RowList) {
 			threadResult := new(reportResult)
-			threadResult.err = backend.table.ReadRows(ctx, prefixkeys,
+			start := time.Now()
+			batchCtx, batchSpan := tracing.Start(ctx, "ProcessQuery.batch", attribute.Int("batch", batch), attribute.Int("prefixes", len(prefixkeys)))
+			threadResult.err = backend.table.ReadRows(batchCtx, prefixkeys,
 				func(row bigtable.Row) bool {
-					//for columnFamily, cols := range row {
-					for _, cols := range row {
-						var report CTReport
-						for _, col := range cols {
-							dt := strings.Split(col.Column, ":")
-							fmt.Println("dt", dt)
-							fmt.Println("col", col.Value)
-							switch dt[1] {
-							case "EncodedMsg":
-								report.EncodedMsg = []byte(col.Value)
-							case "HashedPK":
-								report.HashedPK = col.Value
-							case "timestamp":
-							default:
-							}
-						}
-						threadResult.results = append(threadResult.results, report)
-					}
+					threadResult.results = append(threadResult.results, parseRow(row, backend.columnFamilyName)...)
 					return true
-					//		}, bigtable.RowFilter(bigtable.TimestampRangeFilter(startTime, endTime)))
 				}, bigtable.RowFilter(filter))
+			batchSpan.SetAttributes(attribute.Int("reports", len(threadResult.results)))
+			tracing.End(batchSpan, threadResult.err)
+			observeBigtable("ReadRows", start, threadResult.err)
 			resCh <- threadResult
 			<-threadLimit
-		}(prefixKeyList[i])
+		}(i, prefixKeyList[i])
 	}
 
 	for i := 0; i < threadNum; i++ {
@@ -133,64 +444,230 @@ func (backend *Backend) ProcessQuery(query []byte, timestamp int64) (reports []C
 			// TODO: how to handle errors
 			err = r.err
 		}
-		if r.results != nil {
-			reports = append(reports, r.results...)
+		timed = append(timed, r.results...)
+	}
+
+	if err != nil {
+		logger.Error("ProcessQuery", "err", err)
+	}
+	// batches may repeat prefixes
+	return assembleReports(timed), err
+}
+
+// ProcessSync returns every report received since timestamp (unix seconds)
+func (backend *Backend) ProcessSync(ctx context.Context, timestamp int64) (reports []CTReport, err error) {
+	return backend.ProcessSyncRange(ctx, Shard{}, time.Unix(timestamp, 0), time.Time{})
+}
+
+// ProcessSyncRange returns every report of shard received in [since, until), see
+// readWindow; a zero until is now
+func (backend *Backend) ProcessSyncRange(ctx context.Context, shard Shard, since time.Time, until time.Time) (reports []CTReport, err error) {
+	if !shard.Valid() {
+		return nil, fmt.Errorf("invalid shard %+v", shard)
+	}
+	startTime, endTime := backend.readWindow(since, until)
+	if !endTime.After(startTime) {
+		return nil, nil
+	}
+	return backend.syncRange(ctx, shard, startTime, endTime)
+}
+
+// ProcessSyncPage returns up to about limit reports received since timestamp (unix
+// seconds), resuming after cursor, see ProcessSyncRangePage
+func (backend *Backend) ProcessSyncPage(ctx context.Context, timestamp int64, cursor string, limit int) (reports []CTReport, next string, err error) {
+	return backend.ProcessSyncRangePage(ctx, Shard{}, time.Unix(timestamp, 0), time.Time{}, cursor, limit)
+}
+
+// ProcessSyncRangePage returns up to about limit reports of shard received in
+// [since, until), resuming after cursor.  Pages follow the row key order; within a page reports are
+// ordered as by assembleReports.  Whole rows are returned, so a page may exceed limit by
+// the size of its last row.  next is the cursor of the following page, or "" at the end.
+// The time window is fixed by the first page and carried in the cursor, so reports
+// received while paging are left for the next sync and the retention period moving on
+// does not drop reports from later pages.
+func (backend *Backend) ProcessSyncRangePage(ctx context.Context, shard Shard, since time.Time, until time.Time, cursor string, limit int) (reports []CTReport, next string, err error) {
+	ctx, span := tracing.Start(ctx, "ProcessSyncPage", attribute.Int("limit", limit))
+	defer func() {
+		span.SetAttributes(attribute.Int("reports", len(reports)))
+		tracing.End(span, err)
+	}()
+	if !shard.Valid() {
+		return nil, "", fmt.Errorf("invalid shard %+v", shard)
+	}
+	startTime, endTime := backend.readWindow(since, until)
+	if cursor == "" && !endTime.After(startTime) {
+		return nil, "", nil
+	}
+	timed, next, _, err := backend.readPage(ctx, shard, startTime, endTime, cursor, limit)
+	if err != nil {
+		logging.FromContext(ctx).Error("ProcessSyncPage", "err", err)
+		return nil, "", err
+	}
+	return assembleReports(timed), next, nil
+}
+
+// readPage reads the reports of shard received in [startTime, endTime) in row key
+// order, up to about limit, resuming after cursor.  A cursor carries the window of the first page,
+// which overrides startTime and endTime; the window end is returned with the page.
+func (backend *Backend) readPage(ctx context.Context, shard Shard, startTime time.Time, endTime time.Time, cursor string, limit int) (reports []timedReport, next string, windowEnd time.Time, err error) {
+	if limit <= 0 {
+		return nil, "", endTime, fmt.Errorf("invalid limit %d", limit)
+	}
+	rangeStart, rangeLimit := shard.KeyRange()
+	if cursor != "" {
+		var afterKey string
+		var cursorStart time.Time
+		if cursorStart, endTime, afterKey, err = parseSyncCursor(cursor); err != nil {
+			return nil, "", endTime, err
 		}
+		if !cursorStart.IsZero() {
+			startTime = cursorStart
+		}
+		// the smallest row key after afterKey
+		if afterKey+"\x00" > rangeStart {
+			rangeStart = afterKey + "\x00"
+		}
+		if rangeLimit != "" && rangeStart >= rangeLimit {
+			return nil, "", endTime, nil
+		}
+	}
+	rowRange := bigtable.NewRange(rangeStart, rangeLimit)
+	filter := bigtable.ChainFilters(bigtable.FamilyFilter(backend.columnFamilyName), bigtable.TimestampRangeFilter(startTime, endTime))
+
+	start := time.Now()
+	err = backend.table.ReadRows(ctx, rowRange, func(row bigtable.Row) bool {
+		reports = append(reports, parseRow(row, backend.columnFamilyName)...)
+		if len(reports) >= limit {
+			next = fmt.Sprintf("%d.%d.%s", unixMillis(startTime), unixMillis(endTime), row.Key())
+			return false
+		}
+		return true
+	}, bigtable.RowFilter(filter))
+	observeBigtable("ReadRows", start, err)
+	if err != nil {
+		return nil, "", endTime, err
+	}
+	return reports, next, endTime, nil
+}
+
+// ErrInvalidCursor is returned by ProcessSyncPage for a cursor it did not make
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// parseSyncCursor splits a cursor made by ProcessSyncPage into the window (milliseconds)
+// and the last row key.  Cursors made before they carried the window start have a
+// zero startTime.
+func parseSyncCursor(cursor string) (startTime time.Time, endTime time.Time, afterKey string, err error) {
+	parts := strings.Split(cursor, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return startTime, endTime, "", ErrInvalidCursor
+	}
+	afterKey = parts[len(parts)-1]
+	var ms []int64
+	for _, part := range parts[:len(parts)-1] {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 {
+			return startTime, endTime, "", ErrInvalidCursor
+		}
+		ms = append(ms, n)
 	}
+	if len(ms) == 2 {
+		startTime = fromUnixMillis(ms[0])
+	}
+	return startTime, fromUnixMillis(ms[len(ms)-1]), afterKey, nil
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
 
-	return reports, err
+func fromUnixMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
-func (backend *Backend) ProcessSync(timestamp int64) (reports []CTReport, err error) {
+// readUntilNow returns the end of a read window that includes the reports written
+// in the current millisecond (cell timestamps are truncated to milliseconds)
+func readUntilNow() time.Time {
+	return time.Now().Truncate(time.Millisecond).Add(time.Millisecond)
+}
+
+// readWindow returns the read window [startTime, endTime) for the reports received in
+// [since, until), in milliseconds: since is moved forward to the start of the retention
+// period and until, if zero or later, back to now.  The window is empty if endTime is
+// not after startTime.
+func (backend *Backend) readWindow(since time.Time, until time.Time) (startTime time.Time, endTime time.Time) {
+	if epoch := time.Unix(0, 0); since.Before(epoch) {
+		since = epoch
+	}
+	startTime = backend.retentionStart(since.Truncate(time.Millisecond))
+	endTime = readUntilNow()
+	if !until.IsZero() && until.Before(endTime) {
+		endTime = until.Truncate(time.Millisecond)
+	}
+	return startTime, endTime
+}
+
+// retentionStart moves startTime forward to the start of the retention period
+func (backend *Backend) retentionStart(startTime time.Time) time.Time {
+	if backend.retention > 0 {
+		if oldest := time.Now().Add(-backend.retention).Truncate(time.Millisecond); startTime.Before(oldest) {
+			return oldest
+		}
+	}
+	return startTime
+}
+
+// syncRange returns every report of shard received in [startTime, endTime)
+func (backend *Backend) syncRange(ctx context.Context, shard Shard, startTime time.Time, endTime time.Time) (reports []CTReport, err error) {
+	ctx, span := tracing.Start(ctx, "syncRange")
+	defer func() {
+		span.SetAttributes(attribute.Int("reports", len(reports)))
+		tracing.End(span, err)
+	}()
 	// is there any limitation of the size of data?
-	startTime := time.Unix(timestamp, 0)
-	fmt.Println(startTime)
-	endTime := time.Now()
-	fmt.Println(endTime)
+	startTime = backend.retentionStart(startTime)
+	logging.FromContext(ctx).Debug("syncRange", "startTime", startTime, "endTime", endTime)
 	filter := bigtable.ChainFilters(bigtable.FamilyFilter(backend.columnFamilyName), bigtable.TimestampRangeFilter(startTime, endTime))
 
+	// one reader per leading hex digit of the row keys
+	ranges := shardRowRanges(shard)
 	resCh := make(chan *reportResult)
-	ctx := context.Background()
-	for i := 0; i < 16; i++ {
-		fmt.Println("creating thread", i)
-		go func(pos int) {
+	for i, rowRange := range ranges {
+		go func(pos int, rowRange bigtable.RowRange) {
 			threadResult := new(reportResult)
-			threadResult.err = backend.table.ReadRows(ctx, bigtable.PrefixRange(fmt.Sprintf("%x", pos)),
+			start := time.Now()
+			shardCtx, shardSpan := tracing.Start(ctx, "syncRange.shard", attribute.Int("shard", pos), attribute.String("rows", rowRange.String()))
+			threadResult.err = backend.table.ReadRows(shardCtx, rowRange,
 				func(row bigtable.Row) bool {
-					//for columnFamily, cols := range row {
-					for _, cols := range row {
-						var report CTReport
-						for _, col := range cols {
-							dt := strings.Split(col.Column, ":")
-							fmt.Println("dt", dt)
-							fmt.Println("col", col.Value)
-							switch dt[1] {
-							case "EncodedMsg":
-								report.EncodedMsg = []byte(col.Value)
-							case "HashedPK":
-								report.HashedPK = col.Value
-							case "timestamp":
-							default:
-							}
-						}
-						threadResult.results = append(threadResult.results, report)
-					}
+					threadResult.results = append(threadResult.results, parseRow(row, backend.columnFamilyName)...)
 					return true
 				}, bigtable.RowFilter(filter))
+			shardSpan.SetAttributes(attribute.Int("reports", len(threadResult.results)))
+			tracing.End(shardSpan, threadResult.err)
+			observeBigtable("ReadRows", start, threadResult.err)
 			resCh <- threadResult
-		}(i)
+		}(i, rowRange)
 	}
 
-	for i := 0; i < 16; i++ {
+	var timed []timedReport
+	for range ranges {
 		r := <-resCh
 		if r.err != nil {
 			// TODO: how to handle errors
 			err = r.err
 		}
-		if r.results != nil {
-			reports = append(reports, r.results...)
-		}
+		timed = append(timed, r.results...)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("syncRange", "err", err)
 	}
+	return assembleReports(timed), err
+}
 
-	return
+func countErrors(errs []error) (n int) {
+	for _, err := range errs {
+		if err != nil {
+			n++
+		}
+	}
+	return n
 }
@@ -1,139 +1,376 @@
 package backend
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 	"time"
-)
 
-func TestBackendReportQuery(t *testing.T) {
-	config := new(Config)
-	config.BigtableProject = "us-west1-wlk"
-	config.BigtableInstance = "findmypk"
+	"cloud.google.com/go/bigtable"
+	"github.com/wolkdb/contact-tracing-server/api"
+)
 
-	backend, err := NewBackend(config)
+func newTestBackend(t *testing.T) *Backend {
+	backend, close, err := newInMemoryBackend(nil)
 	if err != nil {
-		fmt.Println(err)
 		t.Fatal(err)
 	}
+	t.Cleanup(close)
+	return backend
+}
 
-	var reports []CTReport
-	var hashKeys [][]byte
-	for i := 0; i < 10; i++ {
+// randomReports returns n reports with random HashedPKs
+func randomReports(n int, symptom string) (reports []CTReport) {
+	for i := 0; i < n; i++ {
 		key := make([]byte, 16)
 		rand.Read(key)
-		hashKey := Computehash(key)
-		hashKeys = append(hashKeys, hashKey)
-		symptom := "sample symptom"
+		reports = append(reports, CTReport{HashedPK: api.Computehash(key), EncodedMsg: []byte(symptom)})
+	}
+	return reports
+}
+
+func prefixes(reports ...CTReport) (query []byte) {
+	for _, report := range reports {
+		query = append(query, report.HashedPK[:3]...)
+	}
+	return query
+}
 
-		report := CTReport{HashedPK: hashKey, EncodedMsg: []byte(symptom)}
-		reports = append(reports, report)
+// checkReports compares reports with expected, ignoring order
+func checkReports(t *testing.T, what string, reports []CTReport, expected []CTReport) {
+	t.Helper()
+	str := func(list []CTReport) (out []string) {
+		for _, r := range list {
+			out = append(out, fmt.Sprintf("%x/%x", r.HashedPK, r.EncodedMsg))
+		}
+		sort.Strings(out)
+		return out
+	}
+	got, want := str(reports), str(expected)
+	if len(got) != len(want) {
+		t.Fatalf("%s: expected %d reports, got %d", what, len(want), len(got))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: expected %s, got %s", what, want[i], got[i])
+		}
 	}
-	err = backend.ProcessReport(reports)
+}
+
+// waitNextSecond sleeps until the next whole second and returns it; query and sync
+// windows have a granularity of one second
+func waitNextSecond() int64 {
+	next := time.Now().Truncate(time.Second).Add(time.Second)
+	time.Sleep(time.Until(next))
+	return next.Unix()
+}
+
+func TestBackendReportQuery(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	before := randomReports(10, "sample symptom")
+	if err := backend.ProcessReport(ctx, before); err != nil {
+		t.Fatal(err)
+	}
+	scantime := waitNextSecond()
+	after := randomReports(10, "later symptom")
+	if err := backend.ProcessReport(ctx, after); err != nil {
+		t.Fatal(err)
+	}
+
+	query := prefixes(before[3], before[6], after[3], after[6])
+	res, err := backend.ProcessQuery(ctx, query, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(time.Second * 3)
-	scantime := time.Now()
-	time.Sleep(time.Second * 3)
-	fmt.Println("scantime", scantime.UnixNano())
-	for i := 0; i < 10; i++ {
-		key := make([]byte, 16)
-		rand.Read(key)
-		hashKey := Computehash(key)
-		hashKeys = append(hashKeys, hashKey)
-		symptom := "sample symptom"
+	checkReports(t, "ProcessQuery(0)", res, []CTReport{before[3], before[6], after[3], after[6]})
+
+	res, err = backend.ProcessQuery(ctx, query, scantime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessQuery(scantime)", res, []CTReport{after[3], after[6]})
+
+	res, err = backend.ProcessQuery(ctx, query, time.Now().Unix()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessQuery(future)", res, nil)
 
-		report := CTReport{HashedPK: hashKey, EncodedMsg: []byte(symptom)}
-		reports = append(reports, report)
+	res, err = backend.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
 	}
-	err = backend.ProcessReport(reports)
+	checkReports(t, "ProcessSync(0)", res, append(append([]CTReport{}, before...), after...))
+
+	res, err = backend.ProcessSync(ctx, scantime)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var prefixHashedKey []byte
-	sampleKey := hashKeys[3][:3]
-	sampleKey2 := hashKeys[6][:3]
-	sampleKey3 := hashKeys[13][:3]
-	sampleKey4 := hashKeys[16][:3]
-	prefixHashedKey = append(prefixHashedKey, sampleKey...)
-	prefixHashedKey = append(prefixHashedKey, sampleKey2...)
-	prefixHashedKey = append(prefixHashedKey, sampleKey3...)
-	prefixHashedKey = append(prefixHashedKey, sampleKey4...)
-	time.Sleep(time.Second * 3)
+	checkReports(t, "ProcessSync(scantime)", res, after)
 
-	res, err := backend.ProcessQuery(prefixHashedKey, scantime.Unix())
-	for _, r := range res {
-		fmt.Printf("key = %x report = %s\n", r.HashedPK, r.EncodedMsg)
+	// an invalid report fails the submission with its reason
+	invalid := append(randomReports(1, "valid"), CTReport{HashedPK: []byte{1}})
+	if err := backend.ProcessReport(ctx, invalid); err == nil || !strings.Contains(err.Error(), "report 1 rejected: hashedPK too short") {
+		t.Fatalf("expected the rejection, got %v", err)
 	}
 }
 
-/*
-func TestBackendSimple(t *testing.T) {
-	fmReport, fmReportKeys := GetSampleCTReportAndFMKeys(2)
-	fmReportJSON, err := json.Marshal(fmReport)
+func TestBackendWindow(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	// three groups of reports, a few milliseconds apart
+	var groups [3][]CTReport
+	var starts [4]time.Time
+	for i := range groups {
+		starts[i] = time.Now()
+		groups[i] = randomReports(6, fmt.Sprintf("group %d", i))
+		if err := backend.ProcessReport(ctx, groups[i]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	starts[3] = time.Now()
+	var all []CTReport
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+
+	res, err := backend.ProcessSyncRange(ctx, Shard{}, starts[1], starts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessSyncRange", res, groups[1])
+	res, err = backend.ProcessQueryRange(ctx, prefixes(all...), starts[1], starts[2])
 	if err != nil {
-		t.Fatalf("err: %s", err)
+		t.Fatal(err)
 	}
-	fmt.Printf("CTReportJSON Sample: %s\n", fmReportJSON)
+	checkReports(t, "ProcessQueryRange", res, groups[1])
+	res, err = backend.ProcessSyncRange(ctx, Shard{}, starts[1], time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessSyncRange(future until)", res, append(append([]CTReport{}, groups[1]...), groups[2]...))
+	res, err = backend.ProcessSyncRange(ctx, Shard{}, starts[2], starts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessSyncRange(empty)", res, nil)
 
-	for i, fmReportKey := range fmReportKeys {
-		fmt.Printf("FMKey %d: %s\n", i, fmReportKey)
+	// the window is fixed by the first page: later pages ignore since and until
+	res, next, err := backend.ProcessSyncRangePage(ctx, Shard{}, starts[1], starts[2], "", 1)
+	if err != nil {
+		t.Fatal(err)
 	}
+	for next != "" {
+		var page []CTReport
+		page, next, err = backend.ProcessSyncRangePage(ctx, Shard{}, starts[3], time.Time{}, next, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, page...)
+	}
+	checkReports(t, "ProcessSyncRangePage", res, groups[1])
 
-	backend, err := NewBackend(DefaultConnString)
+	// cursors made before they carried the window start
+	first, next, err := backend.ProcessSyncRangePage(ctx, Shard{}, starts[2], time.Time{}, "", 1)
+	if err != nil || next == "" {
+		t.Fatalf("first page: %v %q", err, next)
+	}
+	legacy := next[strings.IndexByte(next, '.')+1:]
+	rest, _, err := backend.ProcessSyncRangePage(ctx, Shard{}, starts[2], time.Time{}, legacy, len(all))
 	if err != nil {
-		t.Fatalf("%s", err)
+		t.Fatal(err)
 	}
+	checkReports(t, "legacy cursor", append(first, rest...), groups[2])
 
-	// submit FM Report
-	err = backend.ProcessCTReport(fmReport)
+	// since is clamped to the retention period
+	backend.retention = time.Since(starts[2]) + 2*time.Millisecond
+	res, err = backend.ProcessSyncRange(ctx, Shard{}, time.Unix(0, 0), time.Time{})
 	if err != nil {
-		t.Fatalf("ProcessCTReport: %s", err)
+		t.Fatal(err)
 	}
+	checkReports(t, "ProcessSyncRange(retention)", res, groups[2])
+}
+
+func TestBackendPrefixCollision(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
 
-	// get recent FMKeys (last 10 seconds)
-	curTS := uint64(time.Now().Unix())
-	fmKeys, err := backend.ProcessGetFMKeys(curTS - 10)
+	// reports sharing a row, in the same and in separate writes
+	reports := randomReports(4, "symptom")
+	for _, report := range reports[1:] {
+		copy(report.HashedPK[:3], reports[0].HashedPK[:3])
+	}
+	sameKey := CTReport{HashedPK: reports[0].HashedPK, EncodedMsg: []byte("other symptom")}
+	if err := backend.ProcessReport(ctx, []CTReport{reports[0], reports[1], sameKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.ProcessReport(ctx, reports[2:]); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]CTReport{sameKey}, reports...)
+
+	res, err := backend.ProcessQuery(ctx, prefixes(reports[0]), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessQuery", res, expected)
+
+	res, err = backend.ProcessSync(ctx, 0)
 	if err != nil {
-		t.Fatalf("ProcessGetFMKeys(check1): %s", err)
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessSync", res, expected)
+}
+
+func TestBackendEmptyQuery(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	res, err := backend.ProcessQuery(ctx, nil, 0)
+	if err != nil || len(res) != 0 {
+		t.Fatalf("empty store: %d reports, err %v", len(res), err)
 	}
-	fmt.Printf("ProcessGetFMKeys %d records\n", len(fmKeys))
-	if len(fmKeys) < 1 {
-		t.Fatalf("ProcessGetFMKeys: %d records found", len(fmKeys))
+	res, err = backend.ProcessSync(ctx, 0)
+	if err != nil || len(res) != 0 {
+		t.Fatalf("empty store sync: %d reports, err %v", len(res), err)
 	}
-	// check if the first 2 are are in the report
-	found := make([]bool, len(fmKeys))
-	for _, fmKey := range fmKeys {
-		fmt.Printf("Recent Keys: [%s]\n", fmKey)
-		for j, reportKey := range fmReportKeys {
-			if fmKey == reportKey {
-				found[j] = true
-			}
+
+	reports := randomReports(5, "symptom")
+	if err := backend.ProcessReport(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+	res, err = backend.ProcessQuery(ctx, []byte{}, 0)
+	if err != nil || len(res) != 0 {
+		t.Fatalf("empty query: %d reports, err %v", len(res), err)
+	}
+	unknown := randomReports(3, "symptom")
+	res, err = backend.ProcessQuery(ctx, prefixes(unknown...), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "unknown prefixes", res, nil)
+}
+
+func TestBackendManyPrefixes(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	// distinct prefixes so every queried prefix matches exactly one report
+	reports := randomReports(2500, "symptom")
+	for i, report := range reports {
+		binary.BigEndian.PutUint32(report.HashedPK[:4], uint32(i)<<8)
+	}
+	if err := backend.ProcessReport(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+
+	// around the queryBatchSize boundary and over several batches
+	for _, n := range []int{1, 999, 1000, 1001, 2000, 2500} {
+		res, err := backend.ProcessQuery(ctx, prefixes(reports[:n]...), 0)
+		if err != nil {
+			t.Fatal(err)
 		}
+		checkReports(t, fmt.Sprintf("%d prefixes", n), res, reports[:n])
+	}
+}
+
+func TestBackendDedup(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	before := time.Now().Add(-time.Millisecond).UnixNano() / int64(time.Millisecond)
+	first := randomReports(5, "first")
+	if err := backend.ProcessReport(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	// a resubmitted report is returned once, at its latest receipt
+	second := append(randomReports(5, "second"), first[0])
+	if err := backend.ProcessReport(ctx, second); err != nil {
+		t.Fatal(err)
 	}
 
-	// get the report data from the first two keys
-	for i := 0; i < 2; i++ {
-		if !found[i] {
-			t.Fatalf("ProcessGetFMKeys key 0 in report [%s] not found", fmReportKeys[0])
+	// ordered by receipt, then by ID
+	var expected []string
+	for _, group := range [][]CTReport{first[1:], second} {
+		var ids []string
+		for _, report := range group {
+			ids = append(ids, reportID(report))
 		}
-		fmKey := fmKeys[i]
-		reports, err := backend.ProcessGetCTReport(fmKey)
-		if err != nil {
-			t.Fatalf("ProcessGetCTReport: %s", err)
+		sort.Strings(ids)
+		expected = append(expected, ids...)
+	}
+
+	// repeated prefixes, in separate batches
+	var query []byte
+	for i := 0; i < queryBatchSize+1; i++ {
+		query = append(query, prefixes(second...)...)
+		query = append(query, prefixes(first[1:]...)...)
+	}
+	queried, err := backend.ProcessQuery(ctx, query, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := backend.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, res := range map[string][]CTReport{"query": queried, "sync": synced} {
+		if len(res) != len(expected) {
+			t.Fatalf("%s: expected %d reports, got %d", name, len(expected), len(res))
 		}
-		if len(reports) > 0 {
-			report := reports[0]
-			if !bytes.Equal(report.Report, fmReport.Report) {
-				t.Fatalf("ProcessGetCTReport Report Mismatch: expected %s, got [%s]", report.Report, fmReport.Report)
+		after := time.Now().UnixNano() / int64(time.Millisecond)
+		for i, report := range res {
+			if report.ID != expected[i] || reportID(report) != report.ID {
+				t.Fatalf("%s: report %d has ID %s, expected %s", name, i, report.ID, expected[i])
+			}
+			if report.Timestamp < before || report.Timestamp > after {
+				t.Fatalf("%s: report %d received at %d, not in [%d, %d]", name, i, report.Timestamp, before, after)
+			}
+			if i > 0 && report.Timestamp < res[i-1].Timestamp {
+				t.Fatalf("%s: report %d received at %d, before report %d at %d", name, i, report.Timestamp, i-1, res[i-1].Timestamp)
 			}
-			fmt.Printf("ProcessGetCTReport SUCCESS (%s): [%s]\n", fmKey, report.Report)
-		} else {
-			t.Fatalf("ProcessGetCTReport: Report not found for fmKey %s\n", fmKey)
+		}
+		if first, last := res[0], res[len(res)-1]; last.Timestamp <= first.Timestamp {
+			t.Fatalf("%s: second batch received at %d, first at %d", name, last.Timestamp, first.Timestamp)
 		}
 	}
+}
 
+func TestBackendLegacyRows(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	// rows written before report IDs: one EncodedMsg/HashedPK pair per cell timestamp
+	legacy := randomReports(2, "legacy symptom")
+	copy(legacy[1].HashedPK[:3], legacy[0].HashedPK[:3])
+	now := bigtable.Now().TruncateToMilliseconds()
+	for i, report := range legacy {
+		ts := now - bigtable.Timestamp(i*1000)
+		mut := bigtable.NewMutation()
+		mut.Set(backend.columnFamilyName, "EncodedMsg", ts, report.EncodedMsg)
+		mut.Set(backend.columnFamilyName, "HashedPK", ts, report.HashedPK)
+		if err := backend.table.Apply(ctx, fmt.Sprintf("%x", report.HashedPK[:3]), mut); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := CTReport{HashedPK: append([]byte{}, legacy[0].HashedPK...), EncodedMsg: []byte("symptom")}
+	current.HashedPK[31] ^= 1
+	if err := backend.ProcessReport(ctx, []CTReport{current}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := backend.ProcessQuery(ctx, prefixes(legacy[0]), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessQuery", res, append(legacy, current))
 }
-*/
@@ -0,0 +1,52 @@
+// Package backendtest runs the backend on an in-process Bigtable emulator, for tests
+// and local simulations; it is not linked into the server.
+package backendtest
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// New returns a Backend on an in-process Bigtable emulator (bttest) with the schema
+// provisioned.  Data is lost on close.
+func New(conf *backend.Config) (b *backend.Backend, close func(), err error) {
+	if conf == nil {
+		conf = new(backend.Config)
+	}
+	c := *conf
+	if c.BigtableProject == "" {
+		c.BigtableProject = "inmemory"
+	}
+	if c.BigtableInstance == "" {
+		c.BigtableInstance = "inmemory"
+	}
+
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		srv.Close()
+		return nil, nil, err
+	}
+	close = func() {
+		conn.Close()
+		srv.Close()
+	}
+	if err = backend.Provision(context.Background(), &c, option.WithGRPCConn(conn)); err != nil {
+		close()
+		return nil, nil, err
+	}
+	b, err = backend.NewBackend(&c, option.WithGRPCConn(conn))
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	return b, close, nil
+}
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	// ChangelogColumnFamily holds a copy of the reports stored lately, in rows ordered
+	// by time, so that the replicas can tail the reports without reading the table
+	ChangelogColumnFamily = "changelog"
+
+	changelogRowPrefix = "~changelog/"
+
+	// changelogRetention is how long the changelog keeps a report; a tail falling
+	// further behind starts over
+	changelogRetention = time.Hour
+)
+
+// changelogGCPolicy drops the changelog once it is out of changelogRetention
+func changelogGCPolicy() bigtable.GCPolicy {
+	return bigtable.MaxAgePolicy(changelogRetention)
+}
+
+// changelogRow returns the changelog row of the reports stored at timestamp under
+// the row keys starting with the hex digit of key; the digit spreads the writes of a
+// millisecond over 16 rows
+func changelogRow(key string, timestamp bigtable.Timestamp) string {
+	return fmt.Sprintf("%s%s/%013d", changelogRowPrefix, key[:1], int64(timestamp.TruncateToMilliseconds())/1000)
+}
+
+// changelogMutations returns the changelog rows recording the reports stored under
+// keys, and for each row the positions of its reports.  Reports already out of the
+// changelog retention are left out.
+func (backend *Backend) changelogMutations(keys []string, reports []timedReport) (rows []string, muts []*bigtable.Mutation, members [][]int) {
+	oldest := bigtable.Time(time.Now().Add(-changelogRetention))
+	pos := make(map[string]int)
+	for i, report := range reports {
+		if report.timestamp < oldest {
+			continue
+		}
+		row := changelogRow(keys[i], report.timestamp)
+		j, ok := pos[row]
+		if !ok {
+			j = len(rows)
+			pos[row] = j
+			rows = append(rows, row)
+			muts = append(muts, bigtable.NewMutation())
+			members = append(members, nil)
+		}
+		muts[j].Set(ChangelogColumnFamily, "EncodedMsg/"+report.id, report.timestamp, report.EncodedMsg)
+		muts[j].Set(ChangelogColumnFamily, "HashedPK/"+report.id, report.timestamp, report.HashedPK)
+		if report.origin != "" {
+			muts[j].Set(ChangelogColumnFamily, "Origin/"+report.id, report.timestamp, []byte(report.origin))
+		}
+		members[j] = append(members[j], i)
+	}
+	return rows, muts, members
+}
+
+// applyWithChangelog writes the report mutations under keys with one ApplyBulk,
+// together with the changelog rows of reports.  A report whose changelog row fails
+// is failed too, so that it is written again.
+func (backend *Backend) applyWithChangelog(ctx context.Context, keys []string, muts []*bigtable.Mutation, reports []timedReport) (errs []error, err error) {
+	rows, logMuts, members := backend.changelogMutations(keys, reports)
+	errs, err = backend.table.ApplyBulk(ctx, append(keys[:len(keys):len(keys)], rows...), append(muts[:len(muts):len(muts)], logMuts...))
+	if err != nil || errs == nil {
+		return errs, err
+	}
+	for j, rowErr := range errs[len(keys):] {
+		if rowErr == nil {
+			continue
+		}
+		for _, i := range members[j] {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("changelog: %v", rowErr)
+			}
+		}
+	}
+	errs = errs[:len(keys)]
+	if countErrors(errs) == 0 {
+		return nil, nil
+	}
+	return errs, nil
+}
+
+// readChangelog calls fn with every report the changelog recorded in
+// [startTime, endTime), and the row key it is stored under
+func (backend *Backend) readChangelog(ctx context.Context, startTime time.Time, endTime time.Time, fn func(key string, report timedReport)) error {
+	start, end := bigtable.Time(startTime), bigtable.Time(endTime)
+	var ranges bigtable.RowRangeList
+	for digit := 0; digit < 16; digit++ {
+		key := fmt.Sprintf("%x", digit)
+		ranges = append(ranges, bigtable.NewRange(changelogRow(key, start), changelogRow(key, end)))
+	}
+	filter := bigtable.ChainFilters(bigtable.FamilyFilter(ChangelogColumnFamily), bigtable.TimestampRangeFilter(startTime, endTime))
+	began := time.Now()
+	err := backend.table.ReadRows(ctx, ranges, func(row bigtable.Row) bool {
+		for _, report := range parseRow(row, ChangelogColumnFamily) {
+			if len(report.HashedPK) >= PrefixSize {
+				fn(fmt.Sprintf("%x", report.HashedPK[:PrefixSize]), report)
+			}
+		}
+		return true
+	}, bigtable.RowFilter(filter))
+	observeBigtable("ReadRows", began, err)
+	return err
+}
@@ -0,0 +1,523 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gogo/protobuf/proto"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+// An export file starts with exportMagic, the format version and a flags byte, then
+// (if encrypted) the nonce prefix.  The rest is the stream of length-delimited
+// records, gzipped if flagCompressed is set, and if flagEncrypted is set cut into
+// AES-256-GCM sealed chunks of at most exportChunkSize bytes, each preceded by its
+// sealed length as a big-endian uint32.  Chunk nonces are the nonce prefix followed
+// by the chunk counter; the file header and a last-chunk flag are authenticated
+// with every chunk, so reordered or truncated files do not decrypt.
+const (
+	exportMagic     = "CTEXPORT"
+	exportVersion   = 1
+	flagCompressed  = 1
+	flagEncrypted   = 2
+	exportChunkSize = 64 << 10
+	noncePrefixSize = 8
+
+	// maxRecordSize bounds a single record when reading
+	maxRecordSize = 16 << 20
+
+	// importBatchSize is the number of reports written by one ApplyBulk of an import
+	importBatchSize = 1000
+
+	// ExportKeySize is the size of export encryption keys (AES-256)
+	ExportKeySize = 32
+)
+
+// ErrExportKey is returned when an encrypted export file cannot be opened with the given key
+var ErrExportKey = errors.New("export file is encrypted: missing or wrong key, or corrupted")
+
+// ReportStore is a store reports can be exported from and imported into
+type ReportStore interface {
+	// ExportReports calls fn for every report received since
+	ExportReports(ctx context.Context, since time.Time, fn func(*ExportedReport) error) error
+
+	// ImportReports stores reports with their original timestamps; importing a
+	// report twice stores it once
+	ImportReports(ctx context.Context, reports []*ExportedReport) error
+}
+
+// ExportOptions select the encoding of an export file
+type ExportOptions struct {
+	Compress bool
+
+	// Key encrypts the file with AES-256-GCM if set; see ReadExportKey
+	Key []byte
+
+	// Source is recorded in the file header, e.g. the table exported
+	Source string
+}
+
+// ReadExportKey reads an export key file holding 32 bytes, raw or hex encoded
+// (e.g. made with `openssl rand -hex 32`)
+func ReadExportKey(path string) (key []byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == ExportKeySize {
+		return data, nil
+	}
+	key, err = hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != ExportKeySize {
+		return nil, fmt.Errorf("%s: expected %d bytes, raw or hex encoded", path, ExportKeySize)
+	}
+	return key, nil
+}
+
+// ExportWriter writes an export file
+type ExportWriter struct {
+	w      io.Writer
+	gz     *gzip.Writer
+	sealer *chunkWriter
+	buf    []byte
+}
+
+// NewExportWriter writes the file header and header record to w
+func NewExportWriter(w io.Writer, opts ExportOptions, header *ExportHeader) (ew *ExportWriter, err error) {
+	fileHeader := []byte(exportMagic)
+	fileHeader = append(fileHeader, exportVersion, 0)
+	if opts.Compress {
+		fileHeader[len(exportMagic)+1] |= flagCompressed
+	}
+	ew = &ExportWriter{w: w}
+	if opts.Key != nil {
+		fileHeader[len(exportMagic)+1] |= flagEncrypted
+		noncePrefix := make([]byte, noncePrefixSize)
+		if _, err = rand.Read(noncePrefix); err != nil {
+			return nil, err
+		}
+		fileHeader = append(fileHeader, noncePrefix...)
+		aead, err := newExportAEAD(opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		ew.sealer = &chunkWriter{w: w, aead: aead, fileHeader: fileHeader}
+		ew.w = ew.sealer
+	}
+	if _, err = w.Write(fileHeader); err != nil {
+		return nil, err
+	}
+	if opts.Compress {
+		ew.gz = gzip.NewWriter(ew.w)
+		ew.w = ew.gz
+	}
+	if err = ew.writeRecord(header); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (ew *ExportWriter) writeRecord(m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	ew.buf = binary.AppendUvarint(ew.buf[:0], uint64(len(data)))
+	ew.buf = append(ew.buf, data...)
+	_, err = ew.w.Write(ew.buf)
+	return err
+}
+
+// Write appends a report
+func (ew *ExportWriter) Write(report *ExportedReport) error {
+	return ew.writeRecord(report)
+}
+
+// Close flushes the compressor and seals the last chunk; it does not close the
+// underlying writer
+func (ew *ExportWriter) Close() error {
+	if ew.gz != nil {
+		if err := ew.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if ew.sealer != nil {
+		return ew.sealer.Close()
+	}
+	return nil
+}
+
+// ExportReader reads an export file
+type ExportReader struct {
+	r      *bufio.Reader
+	header *ExportHeader
+	buf    []byte
+}
+
+// NewExportReader reads the file header and header record from r; key is needed
+// for encrypted files and ignored otherwise
+func NewExportReader(r io.Reader, key []byte) (er *ExportReader, err error) {
+	fileHeader := make([]byte, len(exportMagic)+2)
+	if _, err = io.ReadFull(r, fileHeader); err != nil || string(fileHeader[:len(exportMagic)]) != exportMagic {
+		return nil, fmt.Errorf("not an export file")
+	}
+	if version := fileHeader[len(exportMagic)]; version != exportVersion {
+		return nil, fmt.Errorf("unsupported export file version %d", version)
+	}
+	flags := fileHeader[len(exportMagic)+1]
+	if flags&flagEncrypted != 0 {
+		if key == nil {
+			return nil, ErrExportKey
+		}
+		noncePrefix := make([]byte, noncePrefixSize)
+		if _, err = io.ReadFull(r, noncePrefix); err != nil {
+			return nil, fmt.Errorf("export file truncated")
+		}
+		aead, err := newExportAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		r = &chunkReader{r: r, aead: aead, fileHeader: append(fileHeader, noncePrefix...)}
+	}
+	if flags&flagCompressed != 0 {
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, unwrapChunkError(err)
+		}
+	}
+	er = &ExportReader{r: bufio.NewReader(r), header: new(ExportHeader)}
+	if err = er.readRecord(er.header); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("export file truncated")
+		}
+		return nil, err
+	}
+	return er, nil
+}
+
+// Header returns the header record of the file
+func (er *ExportReader) Header() *ExportHeader {
+	return er.header
+}
+
+func (er *ExportReader) readRecord(m proto.Message) error {
+	size, err := binary.ReadUvarint(er.r)
+	if err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return unwrapChunkError(err)
+	}
+	if size > maxRecordSize {
+		return fmt.Errorf("export record of %d bytes is too large", size)
+	}
+	if uint64(cap(er.buf)) < size {
+		er.buf = make([]byte, size)
+	}
+	er.buf = er.buf[:size]
+	if _, err = io.ReadFull(er.r, er.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return unwrapChunkError(err)
+	}
+	return proto.Unmarshal(er.buf, m)
+}
+
+// Next returns the next report, or io.EOF after the last one
+func (er *ExportReader) Next() (report *ExportedReport, err error) {
+	report = new(ExportedReport)
+	if err = er.readRecord(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func newExportAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != ExportKeySize {
+		return nil, fmt.Errorf("export key must be %d bytes", ExportKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of chunk n
+func chunkNonce(fileHeader []byte, n uint32) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, fileHeader[len(fileHeader)-noncePrefixSize:]...)
+	return binary.BigEndian.AppendUint32(nonce, n)
+}
+
+// chunkAD returns the additional data authenticated with a chunk
+func chunkAD(fileHeader []byte, last bool) []byte {
+	ad := append([]byte(nil), fileHeader...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// chunkWriter seals what is written to it in chunks
+type chunkWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	fileHeader []byte
+	buf        []byte
+	n          uint32
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data follows, as Close seals the last one
+		if len(cw.buf) == exportChunkSize {
+			if err := cw.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		k := exportChunkSize - len(cw.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		cw.buf = append(cw.buf, p[:k]...)
+		p = p[k:]
+	}
+	return written, nil
+}
+
+func (cw *chunkWriter) seal(last bool) error {
+	sealed := cw.aead.Seal(nil, chunkNonce(cw.fileHeader, cw.n), cw.buf, chunkAD(cw.fileHeader, last))
+	cw.n++
+	cw.buf = cw.buf[:0]
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	if _, err := cw.w.Write(append(frame, sealed...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close seals the last chunk
+func (cw *chunkWriter) Close() error {
+	return cw.seal(true)
+}
+
+// chunkError wraps decryption errors so they survive the gzip and bufio readers
+type chunkError struct{ err error }
+
+func (e chunkError) Error() string { return e.err.Error() }
+
+func unwrapChunkError(err error) error {
+	var ce chunkError
+	if errors.As(err, &ce) {
+		return ce.err
+	}
+	return err
+}
+
+// chunkReader opens the chunks written by chunkWriter
+type chunkReader struct {
+	r          io.Reader
+	aead       cipher.AEAD
+	fileHeader []byte
+	buf        []byte
+	n          uint32
+	last       bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.last {
+			return 0, io.EOF
+		}
+		if err := cr.open(); err != nil {
+			return 0, chunkError{err}
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) open() error {
+	var frame [4]byte
+	if _, err := io.ReadFull(cr.r, frame[:]); err != nil {
+		return fmt.Errorf("export file truncated")
+	}
+	size := binary.BigEndian.Uint32(frame[:])
+	if size > exportChunkSize+uint32(cr.aead.Overhead()) {
+		return ErrExportKey
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, sealed); err != nil {
+		return fmt.Errorf("export file truncated")
+	}
+	nonce := chunkNonce(cr.fileHeader, cr.n)
+	plain, err := cr.aead.Open(nil, nonce, sealed, chunkAD(cr.fileHeader, false))
+	if err != nil {
+		if plain, err = cr.aead.Open(nil, nonce, sealed, chunkAD(cr.fileHeader, true)); err != nil {
+			return ErrExportKey
+		}
+		cr.last = true
+		// nothing may follow the last chunk
+		if n, _ := cr.r.Read(frame[:1]); n > 0 {
+			return fmt.Errorf("unexpected data after the last chunk of the export file")
+		}
+	}
+	cr.n++
+	cr.buf = plain
+	return nil
+}
+
+// Export writes every report of store received since to w and returns the number written
+func Export(ctx context.Context, store ReportStore, w io.Writer, since time.Time, opts ExportOptions) (n int, err error) {
+	var sinceMicros int64
+	if !since.IsZero() {
+		sinceMicros = since.UnixNano() / int64(time.Microsecond)
+	}
+	ew, err := NewExportWriter(w, opts, &ExportHeader{
+		Version:       exportVersion,
+		CreatedMicros: time.Now().UnixNano() / int64(time.Microsecond),
+		Source:        opts.Source,
+		SinceMicros:   sinceMicros,
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = store.ExportReports(ctx, since, func(report *ExportedReport) error {
+		n++
+		return ew.Write(report)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, ew.Close()
+}
+
+// Import reads an export file from r into store and returns the number of reports imported
+func Import(ctx context.Context, store ReportStore, r io.Reader, key []byte) (header *ExportHeader, n int, err error) {
+	er, err := NewExportReader(r, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	var batch []*ExportedReport
+	for {
+		report, err := er.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return er.Header(), n, err
+		}
+		if len(report.HashedPK) < PrefixSize {
+			return er.Header(), n, fmt.Errorf("report %d: hashedPK too short", n+len(batch))
+		}
+		if batch = append(batch, report); len(batch) == importBatchSize {
+			if err = store.ImportReports(ctx, batch); err != nil {
+				return er.Header(), n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err = store.ImportReports(ctx, batch); err != nil {
+			return er.Header(), n, err
+		}
+		n += len(batch)
+	}
+	return er.Header(), n, nil
+}
+
+// ExportReports calls fn for every report received since, in row key order
+func (backend *Backend) ExportReports(ctx context.Context, since time.Time, fn func(*ExportedReport) error) (err error) {
+	filter := bigtable.FamilyFilter(backend.columnFamilyName)
+	if !since.IsZero() {
+		filter = bigtable.ChainFilters(filter, bigtable.TimestampRangeFilter(since.Truncate(time.Millisecond), readUntilNow()))
+	}
+	var fnErr error
+	start := time.Now()
+	err = backend.table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		for _, report := range parseRow(row, backend.columnFamilyName) {
+			fnErr = fn(&ExportedReport{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg, TimestampMicros: int64(report.timestamp), Origin: report.origin})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	}, bigtable.RowFilter(filter))
+	observeBigtable("ReadRows", start, err)
+	if err == nil {
+		err = fnErr
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("ExportReports", "err", err)
+	}
+	return err
+}
+
+// ImportReports writes reports under their report IDs with their original timestamps
+// (truncated to milliseconds) and origins, so importing a report twice stores it once
+// and federated reports are not federated again as local ones.  Reports
+// older than the retention period are written but soon removed by the GC policy.
+func (backend *Backend) ImportReports(ctx context.Context, reports []*ExportedReport) (err error) {
+	now := bigtable.Now().TruncateToMilliseconds()
+	keys := make([]string, 0, len(reports))
+	muts := make([]*bigtable.Mutation, 0, len(reports))
+	timed := make([]timedReport, 0, len(reports))
+	for _, r := range reports {
+		if len(r.HashedPK) < PrefixSize {
+			return fmt.Errorf("hashedPK too short")
+		}
+		report := timedReport{CTReport: CTReport{HashedPK: r.HashedPK, EncodedMsg: r.EncodedMsg}, timestamp: now, origin: r.Origin}
+		if r.TimestampMicros > 0 {
+			report.timestamp = bigtable.Timestamp(r.TimestampMicros).TruncateToMilliseconds()
+		}
+		report.id = reportID(report.CTReport)
+		mut := bigtable.NewMutation()
+		mut.Set(backend.columnFamilyName, "EncodedMsg/"+report.id, report.timestamp, report.EncodedMsg)
+		mut.Set(backend.columnFamilyName, "HashedPK/"+report.id, report.timestamp, report.HashedPK)
+		if report.origin != "" {
+			mut.Set(backend.columnFamilyName, "Origin/"+report.id, report.timestamp, []byte(report.origin))
+		}
+		keys = append(keys, fmt.Sprintf("%x", report.HashedPK[:PrefixSize]))
+		muts = append(muts, mut)
+		timed = append(timed, report)
+	}
+	start := time.Now()
+	errs, err := backend.applyWithChangelog(ctx, keys, muts, timed)
+	observeBigtable("ApplyBulk", start, err)
+	if err == nil {
+		if failed := countErrors(errs); failed > 0 {
+			for _, rowErr := range errs {
+				if rowErr != nil {
+					err = fmt.Errorf("%d of %d rows failed: %v", failed, len(keys), rowErr)
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("ImportReports", "reports", len(keys), "err", err)
+		return err
+	}
+	logging.FromContext(ctx).Debug("ImportReports", "reports", len(keys))
+	if backend.index != nil {
+		for i := range timed {
+			backend.index.add(keys[i], timed[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func exportedReports(n int) (reports []*ExportedReport) {
+	for i, r := range randomReports(n, "exported symptom") {
+		reports = append(reports, &ExportedReport{HashedPK: r.HashedPK, EncodedMsg: r.EncodedMsg, TimestampMicros: int64(1590000000000000 + i*1000)})
+	}
+	return reports
+}
+
+func writeExport(t *testing.T, opts ExportOptions, reports []*ExportedReport) []byte {
+	var buf bytes.Buffer
+	ew, err := NewExportWriter(&buf, opts, &ExportHeader{Version: exportVersion, Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if err = ew.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readExport(data []byte, key []byte) (header *ExportHeader, reports []*ExportedReport, err error) {
+	er, err := NewExportReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		r, err := er.Next()
+		if err == io.EOF {
+			return er.Header(), reports, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		reports = append(reports, r)
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	key := make([]byte, ExportKeySize)
+	rand.Read(key)
+	otherKey := make([]byte, ExportKeySize)
+	rand.Read(otherKey)
+	// enough reports for several encrypted chunks
+	reports := exportedReports(3000)
+
+	for _, opts := range []ExportOptions{{}, {Compress: true}, {Key: key}, {Compress: true, Key: key}} {
+		name := fmt.Sprintf("compress=%v encrypt=%v", opts.Compress, opts.Key != nil)
+		data := writeExport(t, opts, reports)
+		header, got, err := readExport(data, opts.Key)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if header.Source != "test" || len(got) != len(reports) {
+			t.Fatalf("%s: header %v, %d reports", name, header, len(got))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].HashedPK, reports[i].HashedPK) || got[i].TimestampMicros != reports[i].TimestampMicros {
+				t.Fatalf("%s: report %d differs", name, i)
+			}
+		}
+
+		// truncated files must not read as complete
+		if _, _, err = readExport(data[:len(data)-5], opts.Key); err == nil {
+			t.Fatalf("%s: expected error for a truncated file", name)
+		}
+		if opts.Key == nil {
+			continue
+		}
+		if _, _, err = readExport(data, nil); err != ErrExportKey {
+			t.Fatalf("%s: expected ErrExportKey without key, got %v", name, err)
+		}
+		if _, _, err = readExport(data, otherKey); err == nil {
+			t.Fatalf("%s: expected error for the wrong key", name)
+		}
+		tampered := append([]byte(nil), data...)
+		tampered[len(tampered)/2] ^= 1
+		if _, _, err = readExport(tampered, key); err == nil {
+			t.Fatalf("%s: expected error for a tampered file", name)
+		}
+	}
+
+	if _, _, err := readExport([]byte("not an export"), nil); err == nil {
+		t.Fatalf("expected error for garbage")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	source := newTestBackend(t)
+	target := newTestBackend(t)
+
+	old := randomReports(20, "old symptom")
+	if err := source.ProcessReport(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	since := waitNextSecond()
+	recent := randomReports(30, "recent symptom")
+	if err := source.ProcessReport(ctx, recent); err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, ExportKeySize)
+	rand.Read(key)
+	var buf bytes.Buffer
+	n, err := Export(ctx, source, &buf, time.Time{}, ExportOptions{Compress: true, Key: key, Source: "source"})
+	if err != nil || n != 50 {
+		t.Fatalf("Export: %d reports, err %v", n, err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+
+	// importing twice stores every report once, with its original timestamp
+	for i := 0; i < 2; i++ {
+		header, n, err := Import(ctx, target, bytes.NewReader(data), key)
+		if err != nil || n != 50 || header.Source != "source" {
+			t.Fatalf("Import: %d reports, header %v, err %v", n, header, err)
+		}
+	}
+	all, err := target.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "sync after import", all, append(append([]CTReport(nil), old...), recent...))
+	got, err := target.ProcessQuery(ctx, prefixes(recent...), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "query since after import", got, recent)
+
+	buf.Reset()
+	if n, err = Export(ctx, source, &buf, time.Unix(since, 0), ExportOptions{}); err != nil || n != 30 {
+		t.Fatalf("Export since: %d reports, err %v", n, err)
+	}
+	if _, _, err = Import(ctx, target, bytes.NewReader(data), nil); err != ErrExportKey {
+		t.Fatalf("expected ErrExportKey, got %v", err)
+	}
+}
+
+func TestExportImportOrigin(t *testing.T) {
+	ctx := context.Background()
+	source := newTestBackend(t)
+	target := newTestBackend(t)
+
+	local := randomReports(2, "local")
+	if err := source.ProcessReport(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	federated := randomReports(3, "federated")
+	var pulled []FederatedReport
+	for _, report := range federated {
+		pulled = append(pulled, FederatedReport{CTReport: report, Origin: "eu"})
+	}
+	if _, err := source.StoreFederated(ctx, pulled); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Export(ctx, source, &buf, time.Time{}, ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Import(ctx, target, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	// FederationPage reads up to the current millisecond
+	time.Sleep(2 * time.Millisecond)
+	reports, _, _, err := target.FederationPage(ctx, 0, "", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := make(map[string]string)
+	for _, report := range reports {
+		origins[string(report.EncodedMsg)] = report.Origin
+	}
+	for _, report := range local {
+		if origin, ok := origins[string(report.EncodedMsg)]; !ok || origin != "" {
+			t.Fatalf("local report imported with origin %q (found %v)", origin, ok)
+		}
+	}
+	for _, report := range federated {
+		if origin := origins[string(report.EncodedMsg)]; origin != "eu" {
+			t.Fatalf("federated report imported with origin %q", origin)
+		}
+	}
+}
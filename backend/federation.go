@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+const (
+	// FederationColumnFamily holds the watermark of every federation peer, in rows
+	// outside the report key space
+	FederationColumnFamily = "federation"
+
+	federationRowPrefix = "~federation/"
+)
+
+// FederatedReport is a report exchanged between federated servers, with its ID and
+// the time the serving server received it; Origin is the region it was first
+// received in
+type FederatedReport struct {
+	CTReport
+	Origin string `json:"origin"`
+}
+
+// FederationPage returns up to about limit reports received in [since, now-settle)
+// (microseconds), in row key order, resuming after cursor.  The end of the window is
+// fixed by the first page, carried in the cursor and returned as windowEnd: once the
+// last page (next == "") is read, windowEnd is the since of the next pull.  settle
+// leaves time for writes in flight to land before their timestamps are passed.
+// Origin is "" for the reports received by this server.
+func (backend *Backend) FederationPage(ctx context.Context, since int64, cursor string, limit int, settle time.Duration) (reports []FederatedReport, next string, windowEnd int64, err error) {
+	startTime := backend.retentionStart(time.Unix(0, since*int64(time.Microsecond)).Truncate(time.Millisecond))
+	endTime := time.Now().Add(-settle).Truncate(time.Millisecond)
+	if endTime.Before(startTime) {
+		endTime = startTime
+	}
+	timed, next, end, err := backend.readPage(ctx, Shard{}, startTime, endTime, cursor, limit)
+	if err != nil {
+		logging.FromContext(ctx).Error("FederationPage", "err", err)
+		return nil, "", 0, err
+	}
+	for _, report := range timed {
+		reports = append(reports, FederatedReport{CTReport: report.response(), Origin: report.origin})
+	}
+	return reports, next, end.UnixNano() / int64(time.Microsecond), nil
+}
+
+// StoreFederated stores reports pulled from a peer with their origin, as received
+// now so that devices polling since their last poll see them.  Reports already
+// stored (under the same report ID) are skipped, so pulling twice stores once.
+func (backend *Backend) StoreFederated(ctx context.Context, reports []FederatedReport) (stored int, err error) {
+	if len(reports) == 0 {
+		return 0, nil
+	}
+	var rows bigtable.RowList
+	seenRow := make(map[string]bool)
+	for _, report := range reports {
+		if len(report.HashedPK) < PrefixSize {
+			return 0, fmt.Errorf("hashedPK too short")
+		}
+		key := fmt.Sprintf("%x", report.HashedPK[:PrefixSize])
+		if !seenRow[key] {
+			seenRow[key] = true
+			rows = append(rows, key)
+		}
+	}
+
+	// report IDs already stored
+	existing := make(map[string]bool)
+	start := time.Now()
+	err = backend.table.ReadRows(ctx, rows, func(row bigtable.Row) bool {
+		for _, report := range parseRow(row, backend.columnFamilyName) {
+			existing[report.id] = true
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.FamilyFilter(backend.columnFamilyName)))
+	observeBigtable("ReadRows", start, err)
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := bigtable.Now().TruncateToMilliseconds()
+	var keys []string
+	var muts []*bigtable.Mutation
+	var timed []timedReport
+	for _, report := range reports {
+		id := reportID(report.CTReport)
+		if existing[id] {
+			continue
+		}
+		existing[id] = true
+		mut := bigtable.NewMutation()
+		mut.Set(backend.columnFamilyName, "EncodedMsg/"+id, timestamp, report.EncodedMsg)
+		mut.Set(backend.columnFamilyName, "HashedPK/"+id, timestamp, report.HashedPK)
+		mut.Set(backend.columnFamilyName, "Origin/"+id, timestamp, []byte(report.Origin))
+		keys = append(keys, fmt.Sprintf("%x", report.HashedPK[:PrefixSize]))
+		muts = append(muts, mut)
+		timed = append(timed, timedReport{CTReport: report.CTReport, id: id, timestamp: timestamp, origin: report.Origin})
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	start = time.Now()
+	errs, err := backend.applyWithChangelog(ctx, keys, muts, timed)
+	observeBigtable("ApplyBulk", start, err)
+	if err != nil {
+		return 0, err
+	}
+	stored = len(keys) - countErrors(errs)
+	var published []timedReport
+	for i := range timed {
+		if errs == nil || errs[i] == nil {
+			if backend.index != nil {
+				backend.index.add(keys[i], timed[i])
+			}
+			published = append(published, timed[i])
+		}
+	}
+	backend.publish(ctx, published)
+	for _, rowErr := range errs {
+		if rowErr != nil {
+			return stored, fmt.Errorf("%d of %d rows failed: %v", len(keys)-stored, len(keys), rowErr)
+		}
+	}
+	reportsIngested.Add(float64(stored))
+	return stored, nil
+}
+
+// FederationWatermark returns the since (microseconds) of the next pull from peer, 0 if
+// it was never pulled
+func (backend *Backend) FederationWatermark(ctx context.Context, peer string) (watermark int64, err error) {
+	start := time.Now()
+	row, err := backend.table.ReadRow(ctx, federationRowPrefix+peer, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter(FederationColumnFamily), bigtable.ColumnFilter("watermark"), bigtable.LatestNFilter(1))))
+	observeBigtable("ReadRow", start, err)
+	if err != nil {
+		return 0, err
+	}
+	for _, col := range row[FederationColumnFamily] {
+		return strconv.ParseInt(string(col.Value), 10, 64)
+	}
+	return 0, nil
+}
+
+// SetFederationWatermark records the since (microseconds) of the next pull from peer
+func (backend *Backend) SetFederationWatermark(ctx context.Context, peer string, watermark int64) error {
+	mut := bigtable.NewMutation()
+	mut.Set(FederationColumnFamily, "watermark", bigtable.Now().TruncateToMilliseconds(), []byte(strconv.FormatInt(watermark, 10)))
+	start := time.Now()
+	err := backend.table.Apply(ctx, federationRowPrefix+peer, mut)
+	observeBigtable("Apply", start, err)
+	return err
+}
@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	// IdempotencyColumnFamily holds the outcome of report submissions made with an
+	// idempotency key, in rows outside the report key space
+	IdempotencyColumnFamily = "idempotency"
+
+	// DefaultIdempotencyWindow is how long submissions are remembered when
+	// IdempotencyWindowSeconds is not set
+	DefaultIdempotencyWindow = 24 * time.Hour
+
+	// MaxIdempotencyKeyLength bounds client supplied idempotency keys
+	MaxIdempotencyKeyLength = 255
+
+	idempotencyRowPrefix = "~idempotency/"
+)
+
+// Submission is the recorded outcome of a report submission made with an
+// idempotency key: a hash of the request and the result of every report
+type Submission struct {
+	RequestHash []byte         `json:"requestHash"`
+	Results     []ReportResult `json:"results"`
+}
+
+// idempotencyWindow returns how long submissions are remembered
+func (conf *Config) idempotencyWindow() time.Duration {
+	if conf.IdempotencyWindowSeconds > 0 {
+		return time.Duration(conf.IdempotencyWindowSeconds) * time.Second
+	}
+	return DefaultIdempotencyWindow
+}
+
+// idempotencyGCPolicy drops submissions once they are out of the window
+func (conf *Config) idempotencyGCPolicy() bigtable.GCPolicy {
+	return bigtable.UnionPolicy(bigtable.MaxAgePolicy(conf.idempotencyWindow()), bigtable.MaxVersionsPolicy(1))
+}
+
+// idempotencyRow keeps row keys short whatever the key
+func idempotencyRow(key string) string {
+	return fmt.Sprintf("%s%x", idempotencyRowPrefix, sha256.Sum256([]byte(key)))
+}
+
+// LookupSubmission returns the submission recorded under key within the
+// idempotency window, nil if there is none
+func (backend *Backend) LookupSubmission(ctx context.Context, key string) (submission *Submission, err error) {
+	start := time.Now()
+	row, err := backend.table.ReadRow(ctx, idempotencyRow(key), bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter(IdempotencyColumnFamily),
+		bigtable.TimestampRangeFilter(time.Now().Add(-backend.idempotencyWindow), time.Time{}),
+		bigtable.LatestNFilter(1))))
+	observeBigtable("ReadRow", start, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range row[IdempotencyColumnFamily] {
+		submission = new(Submission)
+		if err = json.Unmarshal(col.Value, submission); err != nil {
+			return nil, fmt.Errorf("submission %s: %v", col.Row, err)
+		}
+		return submission, nil
+	}
+	return nil, nil
+}
+
+// RecordSubmission records the outcome of the submission made with key, shared by
+// every server on the table
+func (backend *Backend) RecordSubmission(ctx context.Context, key string, submission *Submission) error {
+	value, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+	mut := bigtable.NewMutation()
+	mut.Set(IdempotencyColumnFamily, "submission", bigtable.Now().TruncateToMilliseconds(), value)
+	start := time.Now()
+	err = backend.table.Apply(ctx, idempotencyRow(key), mut)
+	observeBigtable("Apply", start, err)
+	return err
+}
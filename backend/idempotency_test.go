@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubmissions(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+	if submission, err := backend.LookupSubmission(ctx, "unknown"); err != nil || submission != nil {
+		t.Fatalf("unknown key: %v %v", submission, err)
+	}
+	recorded := &Submission{RequestHash: []byte{1, 2, 3}, Results: []ReportResult{{Status: ReportAccepted}, {Status: ReportRejected, Reason: "hashedPK too short"}}}
+	if err := backend.RecordSubmission(ctx, "key", recorded); err != nil {
+		t.Fatal(err)
+	}
+	submission, err := backend.LookupSubmission(ctx, "key")
+	if err != nil || submission == nil {
+		t.Fatalf("recorded key: %v %v", submission, err)
+	}
+	if string(submission.RequestHash) != string(recorded.RequestHash) || len(submission.Results) != 2 || submission.Results[1] != recorded.Results[1] {
+		t.Fatalf("expected %+v, got %+v", recorded, submission)
+	}
+
+	// forgotten after the window
+	backend.idempotencyWindow = 5 * time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	if submission, err := backend.LookupSubmission(ctx, "key"); err != nil || submission != nil {
+		t.Fatalf("expired key: %v %v", submission, err)
+	}
+}
@@ -0,0 +1,325 @@
+package backend
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+const (
+	// defaultIndexWindow is how far back the prefix index reaches when IndexWindowSeconds is not set
+	defaultIndexWindow = 14 * 24 * time.Hour
+
+	// defaultIndexRefresh is how often the store is tailed when IndexRefreshSeconds is not set
+	defaultIndexRefresh = 10 * time.Second
+
+	// indexTailOverlap is re-read on every tail to pick up writes that landed late
+	indexTailOverlap = 5 * time.Second
+
+	// indexEntryOverhead approximates the per entry bookkeeping cost in bytes
+	indexEntryOverhead = 96
+)
+
+// IndexStats reports the state of the prefix index
+type IndexStats struct {
+	Entries      int
+	Bytes        int64
+	MaxBytes     int64
+	CoveredSince time.Time
+	Hits         uint64
+	Misses       uint64
+}
+
+// HitRate returns the fraction of queries answered from the index
+func (s IndexStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type timedReport struct {
+	CTReport
+	id        string
+	timestamp bigtable.Timestamp
+
+	// origin is the region a federated report was first received in, "" for our own
+	origin string
+}
+
+// response returns the report as served, with its ID and receipt time
+func (report timedReport) response() CTReport {
+	r := report.CTReport
+	r.ID = report.id
+	r.Timestamp = int64(report.timestamp.TruncateToMilliseconds()) / 1000
+	return r
+}
+
+type indexEntry struct {
+	prefix string
+	key    string
+	report timedReport
+
+	// slot is the position of the entry in the list of its prefix
+	slot int
+}
+
+// entryHeap orders entries oldest first for eviction
+type entryHeap []*indexEntry
+
+func (h entryHeap) Len() int { return len(h) }
+func (h entryHeap) Less(i, j int) bool {
+	return h[i].report.timestamp < h[j].report.timestamp
+}
+func (h entryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x interface{}) {
+	*h = append(*h, x.(*indexEntry))
+}
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// prefixIndex keeps recent reports in memory keyed by row key (the hex HashedPK prefix).
+// It is complete for every report received after coveredSince, up to the last tail
+// of the store; reports ingested by this process are visible immediately.
+type prefixIndex struct {
+	mu           sync.RWMutex
+	prefixes     map[string][]*indexEntry
+	entries      map[string]*indexEntry
+	oldest       entryHeap
+	size         int64
+	maxSize      int64
+	window       time.Duration
+	ready        bool
+	coveredSince bigtable.Timestamp
+	watermark    bigtable.Timestamp
+
+	hits   uint64
+	misses uint64
+}
+
+func newPrefixIndex(maxSize int64, window time.Duration) *prefixIndex {
+	return &prefixIndex{
+		prefixes: make(map[string][]*indexEntry),
+		entries:  make(map[string]*indexEntry),
+		maxSize:  maxSize,
+		window:   window,
+	}
+}
+
+func entrySize(prefix string, report CTReport) int64 {
+	return int64(indexEntryOverhead + 2*len(prefix) + 2*len(report.HashedPK) + len(report.EncodedMsg))
+}
+
+// add inserts reports stored under prefix, ignoring ones already indexed
+func (idx *prefixIndex) add(prefix string, reports ...timedReport) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, report := range reports {
+		if report.timestamp < idx.coveredSince {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d/%s", prefix, report.timestamp, report.id)
+		if _, ok := idx.entries[key]; ok {
+			continue
+		}
+		e := &indexEntry{prefix: prefix, key: key, report: report, slot: len(idx.prefixes[prefix])}
+		idx.entries[key] = e
+		idx.prefixes[prefix] = append(idx.prefixes[prefix], e)
+		heap.Push(&idx.oldest, e)
+		idx.size += entrySize(prefix, report.CTReport) + int64(len(key))
+	}
+	for idx.size > idx.maxSize && idx.oldest.Len() > 0 {
+		idx.evictOldest()
+	}
+	indexEntries.Set(float64(len(idx.entries)))
+	indexBytes.Set(float64(idx.size))
+}
+
+// evictOldest drops the oldest entry; the index is no longer complete up to its timestamp
+func (idx *prefixIndex) evictOldest() {
+	e := heap.Pop(&idx.oldest).(*indexEntry)
+	// the last entry of the prefix takes the slot of e
+	list := idx.prefixes[e.prefix]
+	last := len(list) - 1
+	list[e.slot] = list[last]
+	list[e.slot].slot = e.slot
+	list[last] = nil
+	list = list[:last]
+	if len(list) == 0 {
+		delete(idx.prefixes, e.prefix)
+	} else {
+		idx.prefixes[e.prefix] = list
+	}
+	delete(idx.entries, e.key)
+	idx.size -= entrySize(e.prefix, e.report.CTReport) + int64(len(e.key))
+	if e.report.timestamp >= idx.coveredSince {
+		idx.coveredSince = e.report.timestamp + 1
+	}
+}
+
+// expire drops everything older than the index window
+func (idx *prefixIndex) expire(now time.Time) {
+	cutoff := bigtable.Time(now.Add(-idx.window))
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for idx.oldest.Len() > 0 && idx.oldest[0].report.timestamp < cutoff {
+		idx.evictOldest()
+	}
+	if idx.coveredSince < cutoff {
+		idx.coveredSince = cutoff
+	}
+	indexEntries.Set(float64(len(idx.entries)))
+	indexBytes.Set(float64(idx.size))
+}
+
+// lookup returns the indexed reports stored under prefixes in [startTime, endTime).
+// ok is false when the index does not cover startTime and the store must be read.
+// Reports written by other processes are only indexed up to the last tail, so the
+// store must still be read from tailStart on when that is before endTime.
+func (idx *prefixIndex) lookup(prefixes []string, startTime time.Time, endTime time.Time) (reports []timedReport, tailStart time.Time, ok bool) {
+	start := bigtable.Time(startTime)
+	end := bigtable.Time(endTime)
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if !idx.ready || start < idx.coveredSince {
+		atomic.AddUint64(&idx.misses, 1)
+		indexLookups.WithLabelValues("miss").Inc()
+		return nil, tailStart, false
+	}
+	for _, prefix := range prefixes {
+		for _, e := range idx.prefixes[prefix] {
+			if e.report.timestamp >= start && e.report.timestamp < end {
+				reports = append(reports, e.report)
+			}
+		}
+	}
+	// the overlap covers the writes that land late, as for tailIndex
+	tailStart = idx.watermark.Time().Add(-indexTailOverlap)
+	if tailStart.Before(startTime) {
+		tailStart = startTime
+	}
+	atomic.AddUint64(&idx.hits, 1)
+	indexLookups.WithLabelValues("hit").Inc()
+	return reports, tailStart, true
+}
+
+func (idx *prefixIndex) stats() IndexStats {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return IndexStats{
+		Entries:      len(idx.entries),
+		Bytes:        idx.size,
+		MaxBytes:     idx.maxSize,
+		CoveredSince: idx.coveredSince.Time(),
+		Hits:         atomic.LoadUint64(&idx.hits),
+		Misses:       atomic.LoadUint64(&idx.misses),
+	}
+}
+
+// parseRow splits the cells of a report row into reports.  Cells are grouped by the
+// report ID in their column (EncodedMsg/<id>); rows written before report IDs have
+// plain EncodedMsg and HashedPK columns and are grouped by cell timestamp instead.
+func parseRow(row bigtable.Row, columnFamilyName string) (reports []timedReport) {
+	byKey := make(map[string]*timedReport)
+	var order []string
+	for _, col := range row[columnFamilyName] {
+		column := strings.TrimPrefix(col.Column, columnFamilyName+":")
+		key := fmt.Sprintf("@%d", col.Timestamp)
+		if i := strings.IndexByte(column, '/'); i >= 0 {
+			column, key = column[:i], column[i+1:]
+		}
+		report, ok := byKey[key]
+		if !ok {
+			report = &timedReport{timestamp: col.Timestamp}
+			byKey[key] = report
+			order = append(order, key)
+		}
+		if col.Timestamp > report.timestamp {
+			report.timestamp = col.Timestamp
+		}
+		switch column {
+		case "EncodedMsg":
+			report.EncodedMsg = col.Value
+		case "HashedPK":
+			report.HashedPK = col.Value
+		case "Origin":
+			report.origin = string(col.Value)
+		}
+	}
+	for _, key := range order {
+		report := byKey[key]
+		report.id = reportID(report.CTReport)
+		reports = append(reports, *report)
+	}
+	return reports
+}
+
+// tailIndex adds the reports stored since the last tail, by this process or
+// another one, reading them from the changelog.  The first tail, or one fallen
+// behind the changelog, covers the index from the start of the changelog on.
+func (backend *Backend) tailIndex(ctx context.Context) error {
+	idx := backend.index
+	now := time.Now().Truncate(time.Millisecond)
+	idx.expire(now)
+
+	idx.mu.RLock()
+	startTime := idx.watermark.Time().Add(-indexTailOverlap)
+	idx.mu.RUnlock()
+	logStart := now.Add(-changelogRetention)
+	behind := startTime.Before(logStart)
+	if behind {
+		startTime = logStart
+	}
+
+	err := backend.readChangelog(ctx, startTime, now, func(key string, report timedReport) {
+		idx.add(key, report)
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	if cutoff := bigtable.Time(logStart); behind && idx.coveredSince < cutoff {
+		// reports stored before the start of the changelog may be missing
+		idx.coveredSince = cutoff
+	}
+	idx.ready = true
+	idx.watermark = bigtable.Time(now)
+	idx.mu.Unlock()
+	return nil
+}
+
+// indexLoop keeps the prefix index fresh by tailing the changelog
+func (backend *Backend) indexLoop(refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		ctx := context.Background()
+		if err := backend.tailIndex(ctx); err != nil {
+			logging.FromContext(ctx).Error("prefix index tail", "err", err)
+		}
+		stats := backend.index.stats()
+		logging.FromContext(ctx).Debug("prefix index", "entries", stats.Entries, "bytes", stats.Bytes, "maxBytes", stats.MaxBytes,
+			"coveredSince", stats.CoveredSince, "hitRate", stats.HitRate(), "lookups", stats.Hits+stats.Misses)
+		<-ticker.C
+	}
+}
+
+// IndexStats returns the prefix index statistics; ok is false if the index is disabled
+func (backend *Backend) IndexStats() (stats IndexStats, ok bool) {
+	if backend.index == nil {
+		return stats, false
+	}
+	return backend.index.stats(), true
+}
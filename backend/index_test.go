@@ -0,0 +1,154 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestPrefixIndex(t *testing.T) {
+	now := time.Now()
+	idx := newPrefixIndex(1<<20, time.Hour)
+	idx.ready = true
+	idx.watermark = bigtable.Time(now.Add(-time.Minute))
+
+	var reports []timedReport
+	for i := 0; i < 10; i++ {
+		hashKey := api.Computehash([]byte(fmt.Sprintf("key %d", i)))
+		ts := bigtable.Time(now.Add(time.Duration(i-10) * time.Minute))
+		reports = append(reports, timedReport{CTReport: CTReport{HashedPK: hashKey, EncodedMsg: []byte("sample symptom")}, id: fmt.Sprint(i), timestamp: ts})
+		idx.add(fmt.Sprintf("%x", hashKey[:3]), reports[i])
+	}
+	// adding the same report twice (ingestion, then tail) must not duplicate it
+	idx.add(fmt.Sprintf("%x", reports[3].HashedPK[:3]), reports[3])
+	if stats := idx.stats(); stats.Entries != 10 {
+		t.Fatalf("expected 10 entries, got %d", stats.Entries)
+	}
+
+	prefixes := []string{fmt.Sprintf("%x", reports[3].HashedPK[:3]), fmt.Sprintf("%x", reports[8].HashedPK[:3])}
+	res, tailStart, ok := idx.lookup(prefixes, now.Add(-time.Hour), now)
+	if !ok || len(res) != 2 {
+		t.Fatalf("lookup: ok=%v len=%d", ok, len(res))
+	}
+	// what other processes stored since the last tail is still to be read
+	if !tailStart.Equal(idx.watermark.Time().Add(-indexTailOverlap)) {
+		t.Fatalf("lookup: tail from %v, watermark %v", tailStart, idx.watermark.Time())
+	}
+	res, _, ok = idx.lookup(prefixes, now.Add(-5*time.Minute), now)
+	if !ok || len(res) != 1 {
+		t.Fatalf("lookup since: ok=%v len=%d", ok, len(res))
+	}
+
+	// shrinking the budget evicts the oldest reports and moves coverage forward
+	idx.maxSize = idx.size / 2
+	idx.add(prefixes[0])
+	stats := idx.stats()
+	if stats.Entries >= 10 || stats.Bytes > stats.MaxBytes {
+		t.Fatalf("eviction failed: %+v", stats)
+	}
+	if _, _, ok := idx.lookup(prefixes, now.Add(-time.Hour), now); ok {
+		t.Fatalf("lookup before coverage should miss")
+	}
+	if stats := idx.stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("unexpected hit/miss counts %+v", stats)
+	}
+}
+
+func TestPrefixIndexEvictSamePrefix(t *testing.T) {
+	now := time.Now()
+	idx := newPrefixIndex(1<<20, time.Hour)
+	idx.ready = true
+	idx.watermark = bigtable.Time(now)
+	hashKey := api.Computehash([]byte("key"))
+	prefix := fmt.Sprintf("%x", hashKey[:3])
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		ts := bigtable.Time(now.Add(time.Duration(i-10) * time.Minute))
+		idx.add(prefix, timedReport{CTReport: CTReport{HashedPK: hashKey, EncodedMsg: []byte{byte(i)}}, id: fmt.Sprint(i), timestamp: ts})
+	}
+	for i := 0; i < 2; i++ {
+		idx.evictOldest()
+	}
+	res, _, ok := idx.lookup([]string{prefix}, now.Add(-8*time.Minute), now)
+	if !ok || len(res) != 3 {
+		t.Fatalf("lookup: ok=%v len=%d", ok, len(res))
+	}
+	for _, report := range res {
+		if report.id == "0" || report.id == "1" {
+			t.Fatalf("report %s should have been evicted", report.id)
+		}
+	}
+	for slot, e := range idx.prefixes[prefix] {
+		if e.slot != slot {
+			t.Fatalf("entry %s in slot %d, recorded %d", e.report.id, slot, e.slot)
+		}
+	}
+}
+
+// TestPrefixIndexOtherWriters queries through the index of one backend the reports
+// another backend on the same table stored since the index was last refreshed
+func TestPrefixIndexOtherWriters(t *testing.T) {
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conf := Config{BigtableProject: "inmemory", BigtableInstance: "inmemory", IndexMemoryBytes: 1 << 20, IndexRefreshSeconds: 3600}
+	if err := Provision(ctx, &conf, option.WithGRPCConn(conn)); err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := NewBackend(&conf, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewBackend(&Config{BigtableProject: "inmemory", BigtableInstance: "inmemory"}, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now()
+	mine := randomReports(2, "mine")
+	if err := indexed.ProcessReport(ctx, mine); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexed.tailIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// stored by the other backend after the tail
+	theirs := randomReports(2, "theirs")
+	if err := other.ProcessReport(ctx, theirs); err != nil {
+		t.Fatal(err)
+	}
+
+	all := append(mine, theirs...)
+	res, err := indexed.ProcessQueryRange(ctx, prefixes(all...), since, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "ProcessQueryRange", res, all)
+	if stats, _ := indexed.IndexStats(); stats.Hits != 1 {
+		t.Fatalf("expected an index hit, got %+v", stats)
+	}
+
+	// the next tail reads their reports from the changelog, up to its millisecond
+	time.Sleep(2 * time.Millisecond)
+	if err := indexed.tailIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := indexed.IndexStats(); stats.Entries != len(all) {
+		t.Fatalf("expected %d entries after the tail, got %+v", len(all), stats)
+	}
+}
@@ -1,13 +1,65 @@
 package backend
 
-// CTReport payload is sent by client to /fmreport when user reports symptoms
-type CTReport struct {
-	HashedPK   []byte `json:"hashedPK"`
-	EncodedMsg []byte `json:"encodedMsg"`
-}
+import "github.com/wolkdb/contact-tracing-server/api"
+
+// CTReport is the report of the API, see api.CTReport
+type CTReport = api.CTReport
+
+// ReportResult is the outcome of one report of a submission, see api.ReportResult
+type ReportResult = api.ReportResult
+
+// Outcomes of a submitted report
+const (
+	ReportAccepted  = api.ReportAccepted
+	ReportRejected  = api.ReportRejected
+	ReportRetryable = api.ReportRetryable
+)
 
+// PrefixSize is the size of the HashedPK prefixes reports are queried and stored by
+const PrefixSize = api.PrefixSize
+
+// Config holds the backend settings; see the config package for how it is loaded
 type Config struct {
 	MysqlConn        string `json:"mysqlConn,omitempty"`
 	BigtableProject  string `json:"bigtableProject,omitempty"`
 	BigtableInstance string `json:"bigtableInstance,omitempty"`
+
+	// TableName and ColumnFamily locate the reports in Bigtable
+	TableName    string `json:"tableName,omitempty"`
+	ColumnFamily string `json:"columnFamily,omitempty"`
+
+	// ThreadsPerRequest bounds the concurrent Bigtable reads of a single query
+	ThreadsPerRequest int `json:"threadsPerRequest,omitempty"`
+
+	// RetentionDays limits how far back queries and syncs may look, and is the
+	// max age GC policy set by Provision; 0 keeps everything
+	RetentionDays int `json:"retentionDays,omitempty"`
+
+	// IndexMemoryBytes enables the in-memory prefix index with this memory budget
+	IndexMemoryBytes    int64 `json:"indexMemoryBytes,omitempty"`
+	IndexWindowSeconds  int64 `json:"indexWindowSeconds,omitempty"`
+	IndexRefreshSeconds int64 `json:"indexRefreshSeconds,omitempty"`
+
+	// WALDir enables the ingestion queue: reports are acknowledged once appended to a
+	// write-ahead log in this directory and written to Bigtable in batches
+	WALDir string `json:"walDir,omitempty"`
+
+	// QueueMaxReports bounds the reports waiting to be written; beyond it ProcessReport
+	// returns ErrQueueFull
+	QueueMaxReports int `json:"queueMaxReports,omitempty"`
+
+	// FlushBatchSize and FlushIntervalMillis set the size of a batch written by the
+	// ingestion queue and how long it waits for a batch to fill
+	FlushBatchSize      int   `json:"flushBatchSize,omitempty"`
+	FlushIntervalMillis int64 `json:"flushIntervalMillis,omitempty"`
+
+	// PubSub selects how stored reports reach subscribers: PubSubMemory (the default)
+	// only reaches the subscribers of the replica storing them, PubSubBigtable polls
+	// the changelog every PubSubPollMillis to reach the subscribers of every replica
+	PubSub           string `json:"pubsub,omitempty"`
+	PubSubPollMillis int64  `json:"pubsubPollMillis,omitempty"`
+
+	// IdempotencyWindowSeconds is how long the outcome of a report submission made with
+	// an idempotency key is remembered (default one day)
+	IdempotencyWindowSeconds int64 `json:"idempotencyWindowSeconds,omitempty"`
 }
@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// newInMemoryBackend is backendtest.New for the tests of this package, which
+// backendtest imports
+func newInMemoryBackend(conf *Config) (backend *Backend, close func(), err error) {
+	if conf == nil {
+		conf = new(Config)
+	}
+	c := *conf
+	c.BigtableProject, c.BigtableInstance = "inmemory", "inmemory"
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		srv.Close()
+		return nil, nil, err
+	}
+	close = func() {
+		conn.Close()
+		srv.Close()
+	}
+	if err = Provision(context.Background(), &c, option.WithGRPCConn(conn)); err != nil {
+		close()
+		return nil, nil, err
+	}
+	if backend, err = NewBackend(&c, option.WithGRPCConn(conn)); err != nil {
+		close()
+		return nil, nil, err
+	}
+	return backend, close, nil
+}
@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	reportsIngested = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_reports_ingested_total",
+		Help: "Number of reports written to the store.",
+	})
+
+	bigtableDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "contact_tracing_bigtable_call_duration_seconds",
+		Help:    "Latency of Bigtable calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	bigtableErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_bigtable_errors_total",
+		Help: "Number of failed Bigtable calls (and failed rows of bulk writes).",
+	}, []string{"method"})
+
+	indexLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_prefix_index_lookups_total",
+		Help: "Number of queries looked up in the prefix index, by result (hit or miss).",
+	}, []string{"result"})
+
+	indexEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contact_tracing_prefix_index_entries",
+		Help: "Number of reports held in the prefix index.",
+	})
+
+	indexBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contact_tracing_prefix_index_bytes",
+		Help: "Approximate memory used by the prefix index.",
+	})
+
+	ingestQueueReports = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contact_tracing_ingest_queue_reports",
+		Help: "Number of reports in the ingestion queue not yet written to the store.",
+	})
+
+	ingestQueueRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_ingest_queue_rejected_total",
+		Help: "Number of report submissions rejected because the ingestion queue was full.",
+	})
+
+	ingestBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "contact_tracing_ingest_batch_reports",
+		Help:    "Number of reports per batch written by the ingestion queue.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+	})
+
+	ingestDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_ingest_dropped_total",
+		Help: "Number of queued reports moved to the dead-letter file after a permanent write failure.",
+	})
+
+	writeRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_write_retries_total",
+		Help: "Number of reports rewritten after a transient failure of a synchronous write.",
+	})
+
+	ingestRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_ingest_retries_total",
+		Help: "Number of reports the ingestion queue retried after a failed write.",
+	})
+
+	subscriptionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contact_tracing_subscriptions",
+		Help: "Number of open report subscriptions.",
+	})
+
+	subscriptionsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_subscriptions_dropped_total",
+		Help: "Number of subscriptions ended because the subscriber did not keep up.",
+	})
+
+	publishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contact_tracing_publish_errors_total",
+		Help: "Number of batches of stored reports that could not be published to subscribers.",
+	})
+)
+
+// observeBigtable records the latency and outcome of a Bigtable call started at start
+func observeBigtable(method string, start time.Time, err error) {
+	bigtableDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		bigtableErrors.WithLabelValues(method).Inc()
+	}
+}
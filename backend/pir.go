@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+// Experimental two-server XOR PIR.
+//
+// Reports are grouped into PIRNumBuckets fixed-size buckets keyed by the leading
+// PIRBucketBits of HashedPK.  The first byte of a bucket holds its flags, marking
+// a bucket that could not hold all of its reports.  To fetch bucket i a client
+// picks a random bit vector q1, sends q1 to server A and q2 = q1 xor e_i to
+// server B, and XORs the two answers.
+// Each server only sees a uniformly random vector, so neither learns i as long as
+// the two servers do not collude.  A single deployment may answer both halves
+// for testing, but that gives no privacy.
+const (
+	// PIRBucketBits is the number of leading HashedPK bits that select a bucket
+	PIRBucketBits = 12
+
+	// PIRNumBuckets is the number of buckets in the PIR database
+	PIRNumBuckets = 1 << PIRBucketBits
+
+	// PIRBucketSize is the fixed size in bytes of every bucket
+	PIRBucketSize = 4096
+
+	// PIRQuerySize is the size in bytes of a PIR query bit vector
+	PIRQuerySize = PIRNumBuckets / 8
+
+	// PIREpoch is the granularity of the PIR database snapshot.  Both servers
+	// must answer from the same epoch for the XOR of their answers to decode.
+	PIREpoch = 60 * time.Second
+
+	// pirBucketOverflow flags a bucket that some of its reports did not fit in
+	pirBucketOverflow = 1
+)
+
+// ErrPIRBucketOverflow is returned with the reports of a bucket that did not hold
+// all of its reports; the client must fetch the bucket's prefixes with /query
+var ErrPIRBucketOverflow = errors.New("PIR bucket overflowed")
+
+// PIRBucketIndex returns the bucket holding reports for hashedPK
+func PIRBucketIndex(hashedPK []byte) int {
+	if len(hashedPK) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(hashedPK[:2]) >> (16 - PIRBucketBits))
+}
+
+// PIREpochEnd returns the end of the PIR snapshot that covers t
+func PIREpochEnd(t time.Time) time.Time {
+	return t.Truncate(PIREpoch)
+}
+
+// NewPIRQuery returns the two query vectors to send to the two PIR servers for bucket
+func NewPIRQuery(bucket int) (q1 []byte, q2 []byte, err error) {
+	if bucket < 0 || bucket >= PIRNumBuckets {
+		return nil, nil, fmt.Errorf("invalid bucket %d", bucket)
+	}
+	q1 = make([]byte, PIRQuerySize)
+	if _, err = rand.Read(q1); err != nil {
+		return nil, nil, err
+	}
+	q2 = make([]byte, PIRQuerySize)
+	copy(q2, q1)
+	q2[bucket/8] ^= 1 << uint(7-bucket%8)
+	return q1, q2, nil
+}
+
+// DecodePIRAnswers combines the answers of the two PIR servers into the reports of the queried bucket
+func DecodePIRAnswers(a1 []byte, a2 []byte) (reports []CTReport, err error) {
+	if len(a1) != PIRBucketSize || len(a2) != PIRBucketSize {
+		return nil, fmt.Errorf("invalid answer size %d %d", len(a1), len(a2))
+	}
+	bucket := make([]byte, PIRBucketSize)
+	for i := range bucket {
+		bucket[i] = a1[i] ^ a2[i]
+	}
+	return decodePIRBucket(bucket)
+}
+
+// buildPIRDatabase packs reports into PIRNumBuckets buckets of PIRBucketSize bytes.
+// After the flags byte, each record is [len(HashedPK) 1 byte][HashedPK][len(EncodedMsg) 2 bytes][EncodedMsg];
+// a zero length HashedPK terminates the bucket.  Reports that do not fit are dropped
+// and their bucket is flagged with pirBucketOverflow.
+func buildPIRDatabase(reports []CTReport) (db [][]byte, dropped int) {
+	db = make([][]byte, PIRNumBuckets)
+	used := make([]int, PIRNumBuckets)
+	for i := range db {
+		db[i] = make([]byte, PIRBucketSize)
+		used[i] = 1
+	}
+	for _, report := range reports {
+		if len(report.HashedPK) == 0 || len(report.HashedPK) > 255 || len(report.EncodedMsg) > 0xffff {
+			dropped++
+			continue
+		}
+		b := PIRBucketIndex(report.HashedPK)
+		recordSize := 1 + len(report.HashedPK) + 2 + len(report.EncodedMsg)
+		// always leave room for the terminating zero byte
+		if used[b]+recordSize >= PIRBucketSize {
+			db[b][0] |= pirBucketOverflow
+			dropped++
+			continue
+		}
+		buf := db[b][used[b]:]
+		buf[0] = byte(len(report.HashedPK))
+		copy(buf[1:], report.HashedPK)
+		binary.BigEndian.PutUint16(buf[1+len(report.HashedPK):], uint16(len(report.EncodedMsg)))
+		copy(buf[3+len(report.HashedPK):], report.EncodedMsg)
+		used[b] += recordSize
+	}
+	return db, dropped
+}
+
+// decodePIRBucket returns the reports of bucket, with ErrPIRBucketOverflow if
+// the bucket did not hold all of them
+func decodePIRBucket(bucket []byte) (reports []CTReport, err error) {
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("empty bucket")
+	}
+	pos := 1
+	for pos < len(bucket) && bucket[pos] != 0 {
+		pkLen := int(bucket[pos])
+		if pos+1+pkLen+2 > len(bucket) {
+			return reports, fmt.Errorf("corrupted bucket at %d", pos)
+		}
+		hashedPK := bucket[pos+1 : pos+1+pkLen]
+		msgLen := int(binary.BigEndian.Uint16(bucket[pos+1+pkLen:]))
+		start := pos + 3 + pkLen
+		if start+msgLen > len(bucket) {
+			return reports, fmt.Errorf("corrupted bucket at %d", pos)
+		}
+		reports = append(reports, CTReport{
+			HashedPK:   append([]byte{}, hashedPK...),
+			EncodedMsg: append([]byte{}, bucket[start:start+msgLen]...),
+		})
+		pos = start + msgLen
+	}
+	if bucket[0]&pirBucketOverflow != 0 {
+		return reports, ErrPIRBucketOverflow
+	}
+	return reports, nil
+}
+
+// answerPIRQuery XORs together every bucket selected by the query bit vector
+func answerPIRQuery(db [][]byte, query []byte) (answer []byte, err error) {
+	if len(query) != PIRQuerySize {
+		return nil, fmt.Errorf("invalid query size %d, expected %d", len(query), PIRQuerySize)
+	}
+	answer = make([]byte, PIRBucketSize)
+	for b := 0; b < PIRNumBuckets; b++ {
+		if query[b/8]&(1<<uint(7-b%8)) == 0 {
+			continue
+		}
+		for i, v := range db[b] {
+			answer[i] ^= v
+		}
+	}
+	return answer, nil
+}
+
+// ProcessPIR answers a PIR query over the reports received between timestamp
+// (see snapshotStart) and the current epoch.  The database is built once per
+// epoch for a few starts.
+func (backend *Backend) ProcessPIR(ctx context.Context, query []byte, timestamp int64) (answer []byte, epoch int64, err error) {
+	if len(query) != PIRQuerySize {
+		return nil, 0, fmt.Errorf("invalid query size %d, expected %d", len(query), PIRQuerySize)
+	}
+	endTime := PIREpochEnd(time.Now())
+	since, oldest := backend.snapshotStart(time.Unix(timestamp, 0)), backend.snapshotStart(time.Time{})
+	db, err := backend.pirCache.get(ctx, since, oldest, endTime, func(ctx context.Context, startTime time.Time) (interface{}, error) {
+		reports, err := backend.syncRange(ctx, Shard{}, startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		db, dropped := buildPIRDatabase(reports)
+		if dropped > 0 {
+			logging.FromContext(ctx).Warn("ProcessPIR: reports did not fit in their bucket", "dropped", dropped, "reports", len(reports))
+		}
+		return db, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err = answerPIRQuery(db.([][]byte), query)
+	return answer, endTime.Unix(), err
+}
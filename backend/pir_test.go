@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+)
+
+func TestPIR(t *testing.T) {
+	var reports []CTReport
+	for i := 0; i < 500; i++ {
+		key := make([]byte, 16)
+		rand.Read(key)
+		msg := make([]byte, 64)
+		rand.Read(msg)
+		reports = append(reports, CTReport{HashedPK: api.Computehash(key), EncodedMsg: msg})
+	}
+	db, dropped := buildPIRDatabase(reports)
+	if dropped != 0 {
+		t.Fatalf("dropped %d reports", dropped)
+	}
+
+	target := reports[42]
+	bucket := PIRBucketIndex(target.HashedPK)
+	q1, q2, err := NewPIRQuery(bucket)
+	if err != nil {
+		t.Fatalf("NewPIRQuery: %v", err)
+	}
+	if bytes.Equal(q1, q2) {
+		t.Fatalf("queries should differ")
+	}
+
+	a1, err := answerPIRQuery(db, q1)
+	if err != nil {
+		t.Fatalf("answerPIRQuery: %v", err)
+	}
+	a2, err := answerPIRQuery(db, q2)
+	if err != nil {
+		t.Fatalf("answerPIRQuery: %v", err)
+	}
+	res, err := DecodePIRAnswers(a1, a2)
+	if err != nil {
+		t.Fatalf("DecodePIRAnswers: %v", err)
+	}
+	t.Logf("bucket %d holds %d reports", bucket, len(res))
+
+	found := false
+	for _, r := range res {
+		if PIRBucketIndex(r.HashedPK) != bucket {
+			t.Fatalf("report %x does not belong to bucket %d", r.HashedPK, bucket)
+		}
+		if bytes.Equal(r.HashedPK, target.HashedPK) && bytes.Equal(r.EncodedMsg, target.EncodedMsg) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("report %x not found in bucket %d", target.HashedPK, bucket)
+	}
+
+	if _, err := answerPIRQuery(db, q1[1:]); err == nil {
+		t.Fatalf("expected error for short query")
+	}
+}
+
+func TestPIRBucketOverflow(t *testing.T) {
+	hashedPK := api.Computehash([]byte("same bucket"))
+	var reports []CTReport
+	for i := 0; i < 20; i++ {
+		reports = append(reports, CTReport{HashedPK: hashedPK, EncodedMsg: make([]byte, 512)})
+	}
+	db, dropped := buildPIRDatabase(reports)
+	if dropped == 0 {
+		t.Fatalf("expected overflowing reports to be dropped")
+	}
+	res, err := decodePIRBucket(db[PIRBucketIndex(hashedPK)])
+	if !errors.Is(err, ErrPIRBucketOverflow) {
+		t.Fatalf("expected ErrPIRBucketOverflow, got %v", err)
+	}
+	if len(res)+dropped != len(reports) {
+		t.Fatalf("kept %d + dropped %d != %d", len(res), dropped, len(reports))
+	}
+}
+
+func TestPIRCache(t *testing.T) {
+	var cache epochCache
+	ctx := context.Background()
+	builds := 0
+	build := func(ctx context.Context, start time.Time) (interface{}, error) {
+		builds++
+		return builds, nil
+	}
+	oldest := time.Unix(0, 0)
+	since := time.Unix(1589000000, 0).Truncate(snapshotGranularity)
+	end := PIREpochEnd(time.Now())
+	for i := 0; i < 3; i++ {
+		if v, err := cache.get(ctx, since, oldest, end, build); err != nil || v.(int) != 1 {
+			t.Fatalf("get %d: %v %v", i, v, err)
+		}
+	}
+	if v, _ := cache.get(ctx, since.Add(snapshotGranularity), oldest, end, build); v.(int) != 2 {
+		t.Fatalf("expected a build for another start, got %v", v)
+	}
+	if v, _ := cache.get(ctx, since, oldest, end.Add(PIREpoch), build); v.(int) != 3 {
+		t.Fatalf("expected a build for the next epoch, got %v", v)
+	}
+	if len(cache.snapshots) != 1 {
+		t.Fatalf("expected the snapshots of the previous epoch to be dropped, have %d", len(cache.snapshots))
+	}
+
+	// failed builds are retried
+	_, err := cache.get(ctx, since.Add(snapshotGranularity), oldest, end.Add(PIREpoch), func(ctx context.Context, start time.Time) (interface{}, error) {
+		return nil, fmt.Errorf("unavailable")
+	})
+	if err == nil {
+		t.Fatalf("expected the build error")
+	}
+	if v, _ := cache.get(ctx, since.Add(snapshotGranularity), oldest, end.Add(PIREpoch), build); v.(int) != 4 {
+		t.Fatalf("expected a failed build to be retried, got %v", v)
+	}
+
+	// once full, requests are served from a snapshot starting before them, or from oldest
+	end = end.Add(2 * PIREpoch)
+	for i := 1; i <= maxEpochSnapshots; i++ {
+		cache.get(ctx, since.Add(time.Duration(i)*snapshotGranularity), oldest, end, build)
+	}
+	builds = 0
+	if v, _ := cache.get(ctx, since.Add(10*snapshotGranularity), oldest, end, build); builds != 0 || v == nil {
+		t.Fatalf("expected the latest snapshot before since, built %d", builds)
+	}
+	var starts []time.Time
+	for i := 0; i < 3; i++ {
+		cache.get(ctx, since.Add(-time.Duration(i)*snapshotGranularity), oldest, end, func(ctx context.Context, start time.Time) (interface{}, error) {
+			starts = append(starts, start)
+			return len(starts), nil
+		})
+	}
+	if len(starts) != 1 || !starts[0].Equal(oldest) || len(cache.snapshots) != maxEpochSnapshots {
+		t.Fatalf("expected a single build from oldest, built from %v, keeping %d", starts, len(cache.snapshots))
+	}
+
+	// a waiter gives up with its ctx, the build goes on
+	release := make(chan struct{})
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	end = end.Add(PIREpoch)
+	if _, err := cache.get(cancelled, since, oldest, end, func(ctx context.Context, start time.Time) (interface{}, error) {
+		<-release
+		return 5, ctx.Err()
+	}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	close(release)
+	if v, err := cache.get(ctx, since, oldest, end, build); err != nil || v.(int) != 5 {
+		t.Fatalf("expected the detached build, got %v %v", v, err)
+	}
+
+	backend, close, err := newInMemoryBackend(nil)
+	if err != nil {
+		t.Fatalf("newInMemoryBackend: %v", err)
+	}
+	defer close()
+	query := make([]byte, PIRQuerySize)
+	for i := 0; i < 2; i++ {
+		if _, _, err := backend.ProcessPIR(context.Background(), query, 1589000000); err != nil {
+			t.Fatalf("ProcessPIR: %v", err)
+		}
+	}
+	if len(backend.pirCache.snapshots) != 1 {
+		t.Fatalf("expected one PIR database, have %d", len(backend.pirCache.snapshots))
+	}
+}
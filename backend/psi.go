@@ -0,0 +1,245 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+)
+
+// ECDH based private set intersection over P256.
+//
+// The client sends a*H(x) for each candidate x; the server returns b*a*H(x) and a
+// tag of b*H(y) for each HashedPK y it holds.  The client removes a and learns
+// which candidates match; the server only learns their number.
+//
+// b is picked once per epoch, so the server limits the queries per client and
+// epoch (see the server) to bound the candidates tested against one b.
+const (
+	// PSIPointSize is the size of an uncompressed P256 point
+	PSIPointSize = 65
+
+	// PSITagSize is the size of the tags identifying server set elements
+	PSITagSize = 16
+
+	// PSIMaxQuery is the maximum number of blinded points in one PSI request
+	PSIMaxQuery = 10000
+
+	// PSIEpoch is the granularity of the blinded server set
+	PSIEpoch = 60 * time.Second
+)
+
+// ErrInvalidPSIQuery is returned for a PSI query that is not a list of P256 points
+var ErrInvalidPSIQuery = errors.New("invalid PSI query")
+
+// PSIEntry is one element of the server set: a tag and the messages stored under it
+type PSIEntry struct {
+	Tag         []byte   `json:"tag"`
+	EncodedMsgs [][]byte `json:"encodedMsgs"`
+}
+
+// PSIResponse is the server answer to a PSI request
+type PSIResponse struct {
+	// DoubleBlinded holds b*a*H(x) for every client point, in request order
+	DoubleBlinded [][]byte   `json:"doubleBlinded"`
+	ServerSet     []PSIEntry `json:"serverSet"`
+}
+
+// PSIClient holds the client side state of a PSI request
+type PSIClient struct {
+	scalar     *big.Int
+	candidates [][]byte
+}
+
+// HashToP256 maps data to a P256 point with unknown discrete log (try-and-increment)
+func HashToP256(data []byte) (x, y *big.Int) {
+	params := api.P256().Params()
+	three := big.NewInt(3)
+	ctr := make([]byte, 4)
+	for i := uint32(0); ; i++ {
+		binary.BigEndian.PutUint32(ctr, i)
+		h := api.Computehash([]byte("contact-tracing-psi"), data, ctr)
+		x = new(big.Int).SetBytes(h)
+		x.Mod(x, params.P)
+
+		// y^2 = x^3 - 3x + b
+		y2 := new(big.Int).Exp(x, three, params.P)
+		y2.Sub(y2, new(big.Int).Mul(three, x))
+		y2.Add(y2, params.B)
+		y2.Mod(y2, params.P)
+		y = new(big.Int).ModSqrt(y2, params.P)
+		if y == nil {
+			continue
+		}
+		if y.Bit(0) != uint(h[len(h)-1]&1) {
+			y.Sub(params.P, y)
+		}
+		return x, y
+	}
+}
+
+func randomScalar() (*big.Int, error) {
+	n := api.P256().Params().N
+	for {
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() > 0 {
+			return k, nil
+		}
+	}
+}
+
+func psiTag(x, y *big.Int) []byte {
+	return api.Computehash([]byte("contact-tracing-psi-tag"), elliptic.Marshal(api.P256(), x, y))[:PSITagSize]
+}
+
+// NewPSIClient prepares a PSI request for the candidate hashed public keys
+func NewPSIClient(candidates [][]byte) (c *PSIClient, err error) {
+	if len(candidates) > PSIMaxQuery {
+		return nil, fmt.Errorf("too many candidates %d, max %d", len(candidates), PSIMaxQuery)
+	}
+	scalar, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	return &PSIClient{scalar: scalar, candidates: candidates}, nil
+}
+
+// Query returns the blinded candidates, concatenated as the body of POST /psi
+func (c *PSIClient) Query() []byte {
+	query := make([]byte, 0, len(c.candidates)*PSIPointSize)
+	for _, candidate := range c.candidates {
+		x, y := HashToP256(candidate)
+		bx, by := api.P256().ScalarMult(x, y, c.scalar.Bytes())
+		query = append(query, elliptic.Marshal(api.P256(), bx, by)...)
+	}
+	return query
+}
+
+// Intersect returns the reports stored under the candidates that are in the server set
+func (c *PSIClient) Intersect(resp *PSIResponse) (reports []CTReport, err error) {
+	if len(resp.DoubleBlinded) != len(c.candidates) {
+		return nil, fmt.Errorf("expected %d points, got %d", len(c.candidates), len(resp.DoubleBlinded))
+	}
+	serverSet := make(map[string][][]byte)
+	for _, entry := range resp.ServerSet {
+		serverSet[string(entry.Tag)] = entry.EncodedMsgs
+	}
+	inverse := new(big.Int).ModInverse(c.scalar, api.P256().Params().N)
+	for i, point := range resp.DoubleBlinded {
+		x, y := elliptic.Unmarshal(api.P256(), point)
+		if x == nil {
+			return nil, fmt.Errorf("invalid point %d", i)
+		}
+		ux, uy := api.P256().ScalarMult(x, y, inverse.Bytes())
+		msgs, ok := serverSet[string(psiTag(ux, uy))]
+		if !ok {
+			continue
+		}
+		for _, msg := range msgs {
+			reports = append(reports, CTReport{HashedPK: c.candidates[i], EncodedMsg: msg})
+		}
+	}
+	return reports, nil
+}
+
+// psiServerSet is the server set blinded with the scalar of an epoch
+type psiServerSet struct {
+	scalar  *big.Int
+	entries []PSIEntry
+}
+
+// newPSIServerSet blinds the hashed public keys of reports with a fresh scalar
+func newPSIServerSet(reports []CTReport) (set *psiServerSet, err error) {
+	scalar, err := randomScalar()
+	if err != nil {
+		return nil, err
+	}
+	set = &psiServerSet{scalar: scalar}
+	msgs := make(map[string][][]byte)
+	for _, report := range reports {
+		msgs[string(report.HashedPK)] = append(msgs[string(report.HashedPK)], report.EncodedMsg)
+	}
+	for hashedPK, encodedMsgs := range msgs {
+		x, y := HashToP256([]byte(hashedPK))
+		bx, by := api.P256().ScalarMult(x, y, scalar.Bytes())
+		set.entries = append(set.entries, PSIEntry{Tag: psiTag(bx, by), EncodedMsgs: encodedMsgs})
+	}
+	// sort by tag so the order reveals nothing about the hashed public keys
+	sort.Slice(set.entries, func(i, j int) bool {
+		return bytes.Compare(set.entries[i].Tag, set.entries[j].Tag) < 0
+	})
+	return set, nil
+}
+
+// checkPSIQuery returns ErrInvalidPSIQuery unless query is a list of at most
+// PSIMaxQuery P256 points
+func checkPSIQuery(query []byte) error {
+	if len(query)%PSIPointSize != 0 {
+		return fmt.Errorf("%w: length %d is not a multiple of %d", ErrInvalidPSIQuery, len(query), PSIPointSize)
+	}
+	if len(query)/PSIPointSize > PSIMaxQuery {
+		return fmt.Errorf("%w: too many points %d, max %d", ErrInvalidPSIQuery, len(query)/PSIPointSize, PSIMaxQuery)
+	}
+	for q := 0; q < len(query); q += PSIPointSize {
+		if x, _ := elliptic.Unmarshal(api.P256(), query[q:q+PSIPointSize]); x == nil {
+			return fmt.Errorf("%w: invalid point at %d", ErrInvalidPSIQuery, q/PSIPointSize)
+		}
+	}
+	return nil
+}
+
+// answer double blinds the client points of a checked query
+func (set *psiServerSet) answer(query []byte) (resp *PSIResponse) {
+	resp = &PSIResponse{ServerSet: set.entries}
+	for q := 0; q < len(query); q += PSIPointSize {
+		x, y := elliptic.Unmarshal(api.P256(), query[q:q+PSIPointSize])
+		bx, by := api.P256().ScalarMult(x, y, set.scalar.Bytes())
+		resp.DoubleBlinded = append(resp.DoubleBlinded, elliptic.Marshal(api.P256(), bx, by))
+	}
+	return resp
+}
+
+// answerPSIQuery double blinds the client points and blinds the server set with a fresh scalar
+func answerPSIQuery(query []byte, reports []CTReport) (resp *PSIResponse, err error) {
+	if err = checkPSIQuery(query); err != nil {
+		return nil, err
+	}
+	set, err := newPSIServerSet(reports)
+	if err != nil {
+		return nil, err
+	}
+	return set.answer(query), nil
+}
+
+// ProcessPSI answers a PSI query against the reports received between timestamp
+// (see snapshotStart) and the current epoch.  The server set is blinded once per
+// epoch for a few starts.
+func (backend *Backend) ProcessPSI(ctx context.Context, query []byte, timestamp int64) (resp *PSIResponse, err error) {
+	if err = checkPSIQuery(query); err != nil {
+		return nil, err
+	}
+	endTime := time.Now().Truncate(PSIEpoch)
+	since, oldest := backend.snapshotStart(time.Unix(timestamp, 0)), backend.snapshotStart(time.Time{})
+	set, err := backend.psiCache.get(ctx, since, oldest, endTime, func(ctx context.Context, startTime time.Time) (interface{}, error) {
+		reports, err := backend.syncRange(ctx, Shard{}, startTime, endTime)
+		if err != nil {
+			return nil, err
+		}
+		return newPSIServerSet(reports)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set.(*psiServerSet).answer(query), nil
+}
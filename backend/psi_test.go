@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+)
+
+func TestPSI(t *testing.T) {
+	var reports []CTReport
+	var hashKeys [][]byte
+	for i := 0; i < 50; i++ {
+		key := make([]byte, 16)
+		rand.Read(key)
+		hashKey := api.Computehash(key)
+		hashKeys = append(hashKeys, hashKey)
+		reports = append(reports, CTReport{HashedPK: hashKey, EncodedMsg: []byte(fmt.Sprintf("symptom %d", i))})
+	}
+
+	// two candidates the server holds and one it does not
+	unknown := api.Computehash([]byte("not reported"))
+	candidates := [][]byte{hashKeys[3], unknown, hashKeys[17]}
+	client, err := NewPSIClient(candidates)
+	if err != nil {
+		t.Fatalf("NewPSIClient: %v", err)
+	}
+	query := client.Query()
+	if len(query) != len(candidates)*PSIPointSize {
+		t.Fatalf("query length %d", len(query))
+	}
+
+	resp, err := answerPSIQuery(query, reports)
+	if err != nil {
+		t.Fatalf("answerPSIQuery: %v", err)
+	}
+	if len(resp.ServerSet) != len(reports) {
+		t.Fatalf("server set has %d entries, expected %d", len(resp.ServerSet), len(reports))
+	}
+
+	res, err := client.Intersect(resp)
+	if err != nil {
+		t.Fatalf("Intersect: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 matches, got %d", len(res))
+	}
+	if !bytes.Equal(res[0].HashedPK, hashKeys[3]) || string(res[0].EncodedMsg) != "symptom 3" {
+		t.Fatalf("unexpected match %x %s", res[0].HashedPK, res[0].EncodedMsg)
+	}
+	if !bytes.Equal(res[1].HashedPK, hashKeys[17]) || string(res[1].EncodedMsg) != "symptom 17" {
+		t.Fatalf("unexpected match %x %s", res[1].HashedPK, res[1].EncodedMsg)
+	}
+
+	if _, err := answerPSIQuery(query[1:], reports); !errors.Is(err, ErrInvalidPSIQuery) {
+		t.Fatalf("expected ErrInvalidPSIQuery for truncated query, got %v", err)
+	}
+	offCurve := append([]byte{}, query...)
+	offCurve[PSIPointSize-1] ^= 1
+	if _, err := answerPSIQuery(offCurve, reports); !errors.Is(err, ErrInvalidPSIQuery) {
+		t.Fatalf("expected ErrInvalidPSIQuery for an off-curve point, got %v", err)
+	}
+
+	// the server set of an epoch is blinded once
+	set, err := newPSIServerSet(reports)
+	if err != nil {
+		t.Fatalf("newPSIServerSet: %v", err)
+	}
+	res, err = client.Intersect(set.answer(query))
+	if err != nil || len(res) != 2 {
+		t.Fatalf("first answer: %d matches, %v", len(res), err)
+	}
+	other, _ := NewPSIClient([][]byte{hashKeys[5]})
+	res, err = other.Intersect(set.answer(other.Query()))
+	if err != nil || len(res) != 1 || !bytes.Equal(res[0].HashedPK, hashKeys[5]) {
+		t.Fatalf("second answer from the same set: %+v %v", res, err)
+	}
+}
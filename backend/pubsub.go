@@ -0,0 +1,420 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+// PubSub carries the reports stored by every server to the subscribers of every
+// server: each server publishes the reports it stores and delivers the reports
+// published to its own subscribers.  The default MemoryPubSub only reaches the
+// subscribers of this process; with PubSub set to PubSubBigtable every replica
+// polls the changelog for the reports stored by all of them, and other
+// implementations spanning replicas (e.g. on Cloud Pub/Sub or Redis) are set with
+// SetPubSub.
+type PubSub interface {
+	// Publish delivers reports, with their ID and Timestamp set, to every subscriber
+	Publish(ctx context.Context, reports []CTReport) error
+
+	// Subscribe calls deliver with every batch of reports published until cancel is
+	// called; deliver must not block
+	Subscribe(deliver func(reports []CTReport)) (cancel func())
+}
+
+// MemoryPubSub is a PubSub within one process
+type MemoryPubSub struct {
+	mu          sync.RWMutex
+	next        int
+	subscribers map[int]func([]CTReport)
+}
+
+// NewMemoryPubSub returns a PubSub without subscribers
+func NewMemoryPubSub() *MemoryPubSub {
+	return &MemoryPubSub{subscribers: make(map[int]func([]CTReport))}
+}
+
+// Publish calls every subscriber with reports
+func (ps *MemoryPubSub) Publish(ctx context.Context, reports []CTReport) error {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, deliver := range ps.subscribers {
+		deliver(reports)
+	}
+	return nil
+}
+
+// subscribed reports whether there are subscribers
+func (ps *MemoryPubSub) subscribed() bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.subscribers) > 0
+}
+
+// Subscribe adds deliver to the subscribers until cancel is called
+func (ps *MemoryPubSub) Subscribe(deliver func(reports []CTReport)) (cancel func()) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	id := ps.next
+	ps.next++
+	ps.subscribers[id] = deliver
+	return func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		delete(ps.subscribers, id)
+	}
+}
+
+// SetPubSub replaces the PubSub the backend publishes stored reports to and
+// subscriptions listen on; it must be called before the backend is used
+func (backend *Backend) SetPubSub(pubsub PubSub) {
+	backend.pubsub = pubsub
+}
+
+// publish hands the reports just stored to the subscribers
+func (backend *Backend) publish(ctx context.Context, timed []timedReport) {
+	if len(timed) == 0 {
+		return
+	}
+	reports := make([]CTReport, len(timed))
+	for i, report := range timed {
+		reports[i] = report.response()
+	}
+	if err := backend.pubsub.Publish(ctx, reports); err != nil {
+		publishErrors.Inc()
+		logging.FromContext(ctx).Error("Publish", "reports", len(reports), "err", err)
+	}
+}
+
+const (
+	// subscriptionBuffer is the number of published batches held for a subscriber
+	// before it is dropped as too slow
+	subscriptionBuffer = 256
+
+	// resumeBatchSize is the number of reports per batch of a resumed subscription
+	// catching up
+	resumeBatchSize = 1000
+
+	// maxHeldReports bounds the reports held for a resumed subscription while it
+	// catches up
+	maxHeldReports = subscriptionBuffer * resumeBatchSize
+)
+
+// ErrSubscriberTooSlow ends a subscription that does not keep up with the reports
+// published; the subscriber can resume from the last report it received
+var ErrSubscriberTooSlow = errors.New("subscriber too slow")
+
+// Subscription delivers the reports under its prefixes, or in its shard, as they are stored
+type Subscription struct {
+	prefixes map[string]bool
+	shard    Shard
+
+	reports chan []CTReport
+	live    chan []CTReport
+	done    chan struct{}
+	cancel  func()
+
+	once sync.Once
+	err  error
+}
+
+// Subscribe delivers the reports under the query prefixes (a concatenation of 3 byte
+// prefixes, as for ProcessQuery) or, without prefixes, in shard as they are stored.
+// With a non-zero since the reports stored from since on (within the retention period,
+// and at most maxCatchUp ago) are delivered first, so a subscriber can resume where it
+// left off; every report is delivered once.  The subscription ends when ctx is done or
+// Close is called.
+func (backend *Backend) Subscribe(ctx context.Context, query []byte, shard Shard, since time.Time) (sub *Subscription, err error) {
+	if len(query)%PrefixSize != 0 {
+		return nil, fmt.Errorf("query length %d is not a multiple of %d", len(query), PrefixSize)
+	}
+	if !shard.Valid() {
+		return nil, fmt.Errorf("invalid shard %+v", shard)
+	}
+	if !since.IsZero() {
+		if since = backend.retentionStart(since); since.Before(time.Now().Add(-maxCatchUp)) {
+			return nil, fmt.Errorf("since is more than %v ago, sync first", maxCatchUp)
+		}
+	}
+	sub = &Subscription{
+		shard:   shard,
+		reports: make(chan []CTReport),
+		live:    make(chan []CTReport, subscriptionBuffer),
+		done:    make(chan struct{}),
+	}
+	if len(query) > 0 {
+		sub.prefixes = make(map[string]bool)
+		for i := 0; i < len(query); i += PrefixSize {
+			sub.prefixes[string(query[i:i+PrefixSize])] = true
+		}
+	}
+	// listen before catching up, so that nothing stored meanwhile is missed
+	sub.cancel = backend.pubsub.Subscribe(sub.deliver)
+	subscriptionsActive.Inc()
+	go backend.runSubscription(ctx, sub, query, since)
+	return sub, nil
+}
+
+// Reports returns the channel the reports are delivered on, in batches; it is closed
+// when the subscription ends, see Err
+func (sub *Subscription) Reports() <-chan []CTReport {
+	return sub.reports
+}
+
+// Err returns why the subscription ended: ErrSubscriberTooSlow, the error of ctx or of
+// catching up, or nil after Close
+func (sub *Subscription) Err() error {
+	<-sub.done
+	return sub.err
+}
+
+// Close ends the subscription
+func (sub *Subscription) Close() {
+	sub.end(nil)
+}
+
+func (sub *Subscription) end(err error) {
+	sub.once.Do(func() {
+		sub.err = err
+		close(sub.done)
+	})
+}
+
+func (sub *Subscription) matches(report CTReport) bool {
+	if sub.prefixes != nil {
+		return len(report.HashedPK) >= PrefixSize && sub.prefixes[string(report.HashedPK[:PrefixSize])]
+	}
+	return sub.shard.Contains(report.HashedPK)
+}
+
+// deliver is called by the PubSub with every published batch
+func (sub *Subscription) deliver(reports []CTReport) {
+	var matched []CTReport
+	for _, report := range reports {
+		if sub.matches(report) {
+			matched = append(matched, report)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+	select {
+	case sub.live <- matched:
+	default:
+		subscriptionsDropped.Inc()
+		sub.end(ErrSubscriberTooSlow)
+	}
+}
+
+// send hands a batch to the subscriber, false once the subscription ended
+func (sub *Subscription) send(ctx context.Context, reports []CTReport) bool {
+	select {
+	case sub.reports <- reports:
+		return true
+	case <-sub.done:
+	case <-ctx.Done():
+		sub.end(ctx.Err())
+	}
+	return false
+}
+
+// runSubscription catches up from since, then forwards the published reports
+func (backend *Backend) runSubscription(ctx context.Context, sub *Subscription, query []byte, since time.Time) {
+	defer func() {
+		sub.cancel()
+		close(sub.reports)
+		subscriptionsActive.Dec()
+	}()
+
+	// reports stored since are delivered once, even if also published meanwhile
+	var caught *caughtUp
+	if !since.IsZero() {
+		var ok bool
+		if caught, ok = backend.catchUp(ctx, sub, query, since); !ok {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-ctx.Done():
+			sub.end(ctx.Err())
+			return
+		case batch := <-sub.live:
+			if caught != nil && caught.passed() {
+				caught = nil
+			}
+			if caught != nil {
+				batch = caught.fresh(batch)
+			}
+			if len(batch) > 0 && !sub.send(ctx, batch) {
+				return
+			}
+		}
+	}
+}
+
+const (
+	// catchUpWindow is the time span of the reads of a resumed subscription under
+	// prefixes, which cannot be paged by row
+	catchUpWindow = 24 * time.Hour
+
+	// maxCatchUp bounds how far back a subscription resumes; a subscriber further
+	// behind syncs first
+	maxCatchUp = 30 * 24 * time.Hour
+
+	// catchUpOverlap covers the writes landing late around the end of a catch-up, as
+	// indexTailOverlap does for the index
+	catchUpOverlap = 5 * time.Second
+)
+
+// caughtUp tells the published reports a catch-up already delivered: every one
+// received before its horizon less catchUpOverlap, and the ones in ids
+type caughtUp struct {
+	horizon time.Time
+	ids     map[string]bool
+}
+
+// delivered reports whether the catch-up delivered report
+func (c *caughtUp) delivered(report CTReport) bool {
+	return fromUnixMillis(report.Timestamp).Before(c.horizon.Add(-catchUpOverlap)) || c.ids[report.ID]
+}
+
+// fresh returns the reports of batch the catch-up did not deliver
+func (c *caughtUp) fresh(batch []CTReport) []CTReport {
+	var fresh []CTReport
+	for _, report := range batch {
+		if !c.delivered(report) {
+			fresh = append(fresh, report)
+		}
+	}
+	return fresh
+}
+
+// passed reports whether the reports published from now on are past the horizon
+func (c *caughtUp) passed() bool {
+	return time.Now().After(c.horizon.Add(catchUpOverlap))
+}
+
+// catchUp delivers the reports stored from since up to now, in pages, then the ones published meanwhile that the read
+// missed.  The published batches are drained while catching up, so a long
+// catch-up does not overflow the subscription; ok is false once the subscription
+// ended.
+func (backend *Backend) catchUp(ctx context.Context, sub *Subscription, query []byte, since time.Time) (caught *caughtUp, ok bool) {
+	caught = &caughtUp{horizon: readUntilNow(), ids: make(map[string]bool)}
+	var held []CTReport
+	hold := func(batch []CTReport) bool {
+		for _, report := range batch {
+			if !caught.delivered(report) {
+				// held reports are delivered once, as the ones caught up
+				caught.ids[report.ID] = true
+				held = append(held, report)
+			}
+		}
+		if len(held) > maxHeldReports {
+			subscriptionsDropped.Inc()
+			sub.end(ErrSubscriberTooSlow)
+			return false
+		}
+		return true
+	}
+	// await waits until read is closed or, given a batch, until the subscriber takes
+	// it, holding the batches published meanwhile
+	await := func(read <-chan struct{}, batch []CTReport) bool {
+		var reports chan<- []CTReport
+		if batch != nil {
+			reports = sub.reports
+		}
+		for {
+			select {
+			case <-read:
+				return true
+			case reports <- batch:
+				return true
+			case live := <-sub.live:
+				if !hold(live) {
+					return false
+				}
+			case <-sub.done:
+				return false
+			case <-ctx.Done():
+				sub.end(ctx.Err())
+				return false
+			}
+		}
+	}
+	// page reads the next page of the catch-up, holding the batches published meanwhile
+	cursor, windowStart := "", since
+	page := func() (reports []CTReport, more bool, ok bool) {
+		var err error
+		read := make(chan struct{})
+		go func() {
+			defer close(read)
+			if sub.prefixes != nil {
+				windowEnd := windowStart.Add(catchUpWindow)
+				if !windowEnd.Before(caught.horizon) {
+					windowEnd = caught.horizon
+				}
+				reports, err = backend.ProcessQueryRange(ctx, query, windowStart, windowEnd)
+				windowStart, more = windowEnd, windowEnd.Before(caught.horizon)
+			} else {
+				reports, cursor, err = backend.ProcessSyncRangePage(ctx, sub.shard, since, caught.horizon, cursor, resumeBatchSize)
+				more = cursor != ""
+			}
+		}()
+		if !await(read, nil) {
+			return nil, false, false
+		}
+		if err != nil {
+			sub.end(err)
+			return nil, false, false
+		}
+		return reports, more, true
+	}
+
+	for more := true; more; {
+		var reports []CTReport
+		var ok bool
+		if reports, more, ok = page(); !ok {
+			return nil, false
+		}
+		for start := 0; start < len(reports); start += resumeBatchSize {
+			end := start + resumeBatchSize
+			if end > len(reports) {
+				end = len(reports)
+			}
+			// the reports received shortly before the horizon may also be held
+			var batch []CTReport
+			for _, report := range reports[start:end] {
+				if !caught.delivered(report) {
+					caught.ids[report.ID] = true
+				} else if caught.ids[report.ID] {
+					continue
+				}
+				batch = append(batch, report)
+			}
+			if len(batch) > 0 && !await(nil, batch) {
+				return nil, false
+			}
+		}
+	}
+	// then the reports published meanwhile, holding those published while they are sent
+	for len(held) > 0 {
+		n := resumeBatchSize
+		if n > len(held) {
+			n = len(held)
+		}
+		batch := held[:n]
+		held = held[n:]
+		if !await(nil, batch) {
+			return nil, false
+		}
+	}
+	return caught, true
+}
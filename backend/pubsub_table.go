@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+const (
+	// PubSubMemory delivers the reports stored by this process to its own subscribers
+	PubSubMemory = "memory"
+
+	// PubSubBigtable delivers the reports stored by every replica by polling the changelog
+	PubSubBigtable = "bigtable"
+
+	// DefaultPubSubPoll is how often the changelog is polled when PubSubPollMillis is not set
+	DefaultPubSubPoll = time.Second
+
+	// pubSubPollOverlap is re-read on every poll to pick up writes that landed late
+	pubSubPollOverlap = 5 * time.Second
+)
+
+// newPubSub returns the PubSub selected by conf.PubSub
+func newPubSub(conf *Config, backend *Backend) (PubSub, error) {
+	switch conf.PubSub {
+	case "", PubSubMemory:
+		return NewMemoryPubSub(), nil
+	case PubSubBigtable:
+		poll := time.Duration(conf.PubSubPollMillis) * time.Millisecond
+		if poll <= 0 {
+			poll = DefaultPubSubPoll
+		}
+		return &tablePubSub{backend: backend, poll: poll, local: NewMemoryPubSub()}, nil
+	}
+	return nil, fmt.Errorf("unknown pubsub %q: %s or %s", conf.PubSub, PubSubMemory, PubSubBigtable)
+}
+
+// tablePubSub is a PubSub spanning replicas through the changelog of the table.
+// Publish does nothing, the reports being stored already; while there are
+// subscribers, the loop started by Start reads the reports stored by any replica
+// since the last poll from the changelog and delivers the ones not yet delivered.
+// A new subscriber may get a few reports stored shortly before it subscribed.
+type tablePubSub struct {
+	backend *Backend
+	poll    time.Duration
+	local   *MemoryPubSub
+
+	// watermark and delivered belong to the loop
+	watermark time.Time
+	delivered map[string]int64
+}
+
+// Publish does nothing: the reports are read back from the changelog
+func (ps *tablePubSub) Publish(ctx context.Context, reports []CTReport) error {
+	return nil
+}
+
+// Subscribe adds deliver to the subscribers of this process until cancel is called
+func (ps *tablePubSub) Subscribe(deliver func(reports []CTReport)) (cancel func()) {
+	return ps.local.Subscribe(deliver)
+}
+
+// loop polls the changelog every poll interval until ctx is done
+func (ps *tablePubSub) loop(ctx context.Context) {
+	ticker := time.NewTicker(ps.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := ps.pollOnce(ctx); err != nil {
+			publishErrors.Inc()
+			logging.FromContext(ctx).Error("pubsub: poll", "err", err)
+		}
+	}
+}
+
+// pollOnce delivers the reports stored since the last poll; without subscribers it
+// only moves the watermark
+func (ps *tablePubSub) pollOnce(ctx context.Context) error {
+	now := time.Now().Truncate(time.Millisecond)
+	if ps.watermark.IsZero() || !ps.local.subscribed() {
+		ps.watermark, ps.delivered = now, make(map[string]int64)
+		return nil
+	}
+	since := ps.watermark.Add(-pubSubPollOverlap)
+	if oldest := now.Add(-changelogRetention); since.Before(oldest) {
+		logging.FromContext(ctx).Warn("pubsub: poll behind the changelog", "watermark", ps.watermark)
+		since = oldest
+	}
+	var fresh []CTReport
+	err := ps.backend.readChangelog(ctx, since, now, func(key string, report timedReport) {
+		if _, ok := ps.delivered[report.id]; !ok {
+			response := report.response()
+			ps.delivered[report.id] = response.Timestamp
+			fresh = append(fresh, response)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// the next poll re-reads from now - pubSubPollOverlap on
+	oldest := now.Add(-pubSubPollOverlap).UnixNano() / int64(time.Millisecond)
+	for id, timestamp := range ps.delivered {
+		if timestamp < oldest {
+			delete(ps.delivered, id)
+		}
+	}
+	ps.watermark = now
+	if len(fresh) > 0 {
+		return ps.local.Publish(ctx, fresh)
+	}
+	return nil
+}
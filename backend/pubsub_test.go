@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// receive collects n reports from sub
+func receive(t *testing.T, sub *Subscription, n int) (reports []CTReport) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for len(reports) < n {
+		select {
+		case batch, ok := <-sub.Reports():
+			if !ok {
+				t.Fatalf("subscription ended after %d of %d reports: %v", len(reports), n, sub.Err())
+			}
+			reports = append(reports, batch...)
+		case <-timeout:
+			t.Fatalf("received %d of %d reports", len(reports), n)
+		}
+	}
+	return reports
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	reports := randomReports(8, "pushed")
+	for i := range reports {
+		reports[i].HashedPK[0] = byte(i * 0x20)
+	}
+	byPrefix, err := backend.Subscribe(ctx, prefixes(reports[1], reports[2]), Shard{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byPrefix.Close()
+	shard, _ := api.ParseShard("8/1")
+	byShard, err := backend.Subscribe(ctx, nil, shard, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byShard.Close()
+
+	if err := backend.ProcessReport(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+	got := receive(t, byPrefix, 2)
+	checkReports(t, "by prefix", got, reports[1:3])
+	for _, report := range got {
+		if report.ID != reportID(report) || report.Timestamp == 0 {
+			t.Fatalf("report pushed without ID or timestamp: %+v", report)
+		}
+	}
+	checkReports(t, "by shard", receive(t, byShard, 4), reports[4:])
+
+	byPrefix.Close()
+	if err := byPrefix.Err(); err != nil {
+		t.Fatalf("closed subscription: %v", err)
+	}
+	if _, ok := <-byPrefix.Reports(); ok {
+		t.Fatalf("reports after Close")
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	since := time.Now()
+	earlier := randomReports(5, "earlier")
+	if err := backend.ProcessReport(ctx, earlier); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := backend.Subscribe(ctx, nil, Shard{}, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	// stored again while catching up: delivered once
+	later := append(randomReports(3, "later"), earlier[0])
+	if err := backend.ProcessReport(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	got := receive(t, sub, len(earlier)+len(later)-1)
+	checkReports(t, "resumed", got, append(earlier, later[:3]...))
+	select {
+	case batch := <-sub.Reports():
+		t.Fatalf("unexpected reports %+v", batch)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribeResumeHeld(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	since := time.Now()
+	earlier := randomReports(5, "earlier")
+	if err := backend.ProcessReport(ctx, earlier); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := backend.Subscribe(ctx, nil, Shard{}, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	// twice the batches the subscription buffers are published while it catches up,
+	// in bursts it can drain
+	time.Sleep(10 * time.Millisecond)
+	flood := randomReports(2*subscriptionBuffer, "flood")
+	for i, report := range flood {
+		report.ID, report.Timestamp = reportID(report), time.Now().UnixNano()/int64(time.Millisecond)
+		backend.pubsub.Publish(ctx, []CTReport{report})
+		if i%(subscriptionBuffer/2) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	got := receive(t, sub, len(earlier)+len(flood))
+	checkReports(t, "resumed", got, append(earlier, flood...))
+}
+
+func TestSubscribeResumePaged(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	since := time.Now()
+	earlier := randomReports(2*resumeBatchSize+10, "earlier")
+	if err := backend.ProcessReport(ctx, earlier); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := backend.Subscribe(ctx, nil, Shard{}, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	checkReports(t, "by shard", receive(t, sub, len(earlier)), earlier)
+
+	// prefix subscriptions catch up a day at a time
+	byPrefix, err := backend.Subscribe(ctx, prefixes(earlier[:3]...), Shard{}, since.Add(-3*catchUpWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byPrefix.Close()
+	got := receive(t, byPrefix, 3)
+	var expected []CTReport
+	for _, report := range earlier {
+		for _, other := range earlier[:3] {
+			if string(report.HashedPK[:PrefixSize]) == string(other.HashedPK[:PrefixSize]) {
+				expected = append(expected, report)
+				break
+			}
+		}
+	}
+	if len(got) < len(expected) {
+		got = append(got, receive(t, byPrefix, len(expected)-len(got))...)
+	}
+	checkReports(t, "by prefix", got, expected)
+
+	if _, err := backend.Subscribe(ctx, nil, Shard{}, since.Add(-maxCatchUp-time.Hour)); err == nil {
+		t.Fatalf("expected a since more than %v ago to be refused", maxCatchUp)
+	}
+}
+
+func TestSubscriberTooSlow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newTestBackend(t)
+
+	slow, err := backend.Subscribe(ctx, nil, Shard{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := randomReports(1, "flood")
+	for i := 0; i < subscriptionBuffer+2; i++ {
+		backend.pubsub.Publish(ctx, reports)
+	}
+	if err := slow.Err(); !errors.Is(err, ErrSubscriberTooSlow) {
+		t.Fatalf("expected ErrSubscriberTooSlow, got %v", err)
+	}
+
+	ended, err := backend.Subscribe(ctx, nil, Shard{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := ended.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestTablePubSub(t *testing.T) {
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conf := Config{BigtableProject: "inmemory", BigtableInstance: "inmemory", PubSub: PubSubBigtable, PubSubPollMillis: 10}
+	if err := Provision(ctx, &conf, option.WithGRPCConn(conn)); err != nil {
+		t.Fatal(err)
+	}
+	subscribed, err := NewBackend(&conf, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewBackend(&conf, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribed.Start()
+
+	sub, err := subscribed.Subscribe(ctx, nil, Shard{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	// let the poller see the subscriber before the reports are stored
+	time.Sleep(50 * time.Millisecond)
+	mine, theirs := randomReports(2, "mine"), randomReports(3, "theirs")
+	if err := subscribed.ProcessReport(ctx, mine); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.ProcessReport(ctx, theirs); err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "every replica", receive(t, sub, 5), append(mine, theirs...))
+	select {
+	case batch := <-sub.Reports():
+		t.Fatalf("reports delivered twice: %+v", batch)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := NewBackend(&Config{BigtableProject: "inmemory", BigtableInstance: "inmemory", PubSub: "redis"}, option.WithGRPCConn(conn)); err == nil {
+		t.Fatalf("expected error for an unknown pubsub")
+	}
+}
@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/wolkdb/contact-tracing-server/logging"
+	"google.golang.org/api/option"
+)
+
+// tableNames returns the configured table and column family, or their defaults
+func (conf *Config) tableNames() (table string, family string) {
+	table, family = conf.TableName, conf.ColumnFamily
+	if table == "" {
+		table = DefaultTableName
+	}
+	if family == "" {
+		family = DefaultColumnFamily
+	}
+	return table, family
+}
+
+// gcPolicy expires reports after RetentionDays, or never
+func (conf *Config) gcPolicy() bigtable.GCPolicy {
+	if conf.RetentionDays > 0 {
+		return bigtable.MaxAgePolicy(time.Duration(conf.RetentionDays) * 24 * time.Hour)
+	}
+	return bigtable.NoGcPolicy()
+}
+
+// Provision creates the reports table and its column families (reports, federation
+// watermarks, idempotent submissions and the changelog) if they are missing and sets
+// their GC policies.  It is safe to run repeatedly.
+func Provision(ctx context.Context, conf *Config, opts ...option.ClientOption) (err error) {
+	logger := logging.FromContext(ctx)
+	admin, err := bigtable.NewAdminClient(ctx, conf.BigtableProject, conf.BigtableInstance, opts...)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	tableName, family := conf.tableNames()
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	if !contains(tables, tableName) {
+		if err = admin.CreateTable(ctx, tableName); err != nil {
+			return err
+		}
+		logger.Info("Provision: created table", "table", tableName)
+	}
+
+	info, err := admin.TableInfo(ctx, tableName)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name   string
+		policy bigtable.GCPolicy
+	}{
+		{family, conf.gcPolicy()},
+		// one watermark per federation peer, only the latest is read
+		{FederationColumnFamily, bigtable.MaxVersionsPolicy(1)},
+		{IdempotencyColumnFamily, conf.idempotencyGCPolicy()},
+		{ChangelogColumnFamily, changelogGCPolicy()},
+	} {
+		if !contains(info.Families, f.name) {
+			if err = admin.CreateColumnFamily(ctx, tableName, f.name); err != nil {
+				return err
+			}
+			logger.Info("Provision: created column family", "table", tableName, "family", f.name)
+		}
+		if err = admin.SetGCPolicy(ctx, tableName, f.name, f.policy); err != nil {
+			return err
+		}
+		logger.Info("Provision: schema ready", "table", tableName, "family", f.name, "gcPolicy", f.policy.String())
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestProvision(t *testing.T) {
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conf := &Config{
+		BigtableProject:  "test",
+		BigtableInstance: "test",
+		TableName:        "reports",
+		ColumnFamily:     "r",
+		RetentionDays:    14,
+	}
+	backend, err := NewBackend(conf, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.Ping(ctx); err == nil {
+		t.Fatalf("Ping succeeded before provisioning")
+	}
+
+	// provisioning twice must not fail
+	for i := 0; i < 2; i++ {
+		if err = Provision(ctx, conf, option.WithGRPCConn(conn)); err != nil {
+			t.Fatalf("Provision %d: %v", i, err)
+		}
+	}
+
+	admin, err := bigtable.NewAdminClient(ctx, conf.BigtableProject, conf.BigtableInstance, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	info, err := admin.TableInfo(ctx, "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := make(map[string]string)
+	for _, f := range info.FamilyInfos {
+		policies[f.Name] = f.GCPolicy
+	}
+	if len(policies) != 4 {
+		t.Fatalf("unexpected families %v", info.Families)
+	}
+	if policies["r"] != conf.gcPolicy().String() {
+		t.Fatalf("GC policy %q, expected %q", policies["r"], conf.gcPolicy().String())
+	}
+	if policy, ok := policies[FederationColumnFamily]; !ok || policy != bigtable.MaxVersionsPolicy(1).String() {
+		t.Fatalf("federation family missing or GC policy %q", policy)
+	}
+	if policy, ok := policies[IdempotencyColumnFamily]; !ok || policy != conf.idempotencyGCPolicy().String() {
+		t.Fatalf("idempotency family missing or GC policy %q", policy)
+	}
+	if policy, ok := policies[ChangelogColumnFamily]; !ok || policy != changelogGCPolicy().String() {
+		t.Fatalf("changelog family missing or GC policy %q", policy)
+	}
+
+	if err = backend.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package backend
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/wolkdb/contact-tracing-server/api"
+)
+
+// Shard selects the reports whose HashedPK starts with a bit prefix, see api.Shard
+type Shard = api.Shard
+
+// shardRowRanges splits the shard into ranges of at most one leading hex digit, read in parallel
+func shardRowRanges(shard Shard) (ranges []bigtable.RowRange) {
+	if shard.Bits >= 4 {
+		start, limit := shard.KeyRange()
+		return []bigtable.RowRange{bigtable.NewRange(start, limit)}
+	}
+	n := 1 << uint(4-shard.Bits)
+	first := int(shard.Prefix) << uint(4-shard.Bits)
+	for digit := first; digit < first+n; digit++ {
+		ranges = append(ranges, bigtable.PrefixRange(fmt.Sprintf("%x", digit)))
+	}
+	return ranges
+}
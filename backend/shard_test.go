@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+)
+
+func TestBackendShardSync(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+
+	since := time.Now()
+	reports := randomReports(64, "sharded")
+	for i := range reports {
+		reports[i].HashedPK[0] = byte(i * 4)
+	}
+	if err := backend.ProcessReport(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, str := range []string{"", "8/1", "4/2", "a", "a8/5", "fc", fmt.Sprintf("%x", reports[7].HashedPK[:3])} {
+		shard, err := api.ParseShard(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []CTReport
+		for _, report := range reports {
+			if shard.Contains(report.HashedPK) {
+				expected = append(expected, report)
+			}
+		}
+		res, err := backend.ProcessSyncRange(ctx, shard, since, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkReports(t, "ProcessSyncRange("+str+")", res, expected)
+
+		// paged, one row at a time
+		res = nil
+		cursor := ""
+		for {
+			page, next, err := backend.ProcessSyncRangePage(ctx, shard, since, time.Time{}, cursor, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		checkReports(t, "ProcessSyncRangePage("+str+")", res, expected)
+	}
+
+	if _, err := backend.ProcessSyncRange(ctx, Shard{Prefix: 2, Bits: 1}, since, time.Time{}); err == nil {
+		t.Fatalf("expected an error for an invalid shard")
+	}
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotGranularity is what the start of a snapshot is rounded down to, so that
+	// the since of a request picks one of a few snapshots rather than keying its own
+	snapshotGranularity = 24 * time.Hour
+
+	// maxEpochSnapshots bounds the snapshots built for one epoch
+	maxEpochSnapshots = 4
+
+	// snapshotBuildTimeout bounds a build, which outlives the request starting it
+	snapshotBuildTimeout = 2 * time.Minute
+)
+
+// snapshotStart returns the start of the snapshot serving a request for the
+// reports received since: since is moved forward to the retention period and
+// rounded down to snapshotGranularity
+func (backend *Backend) snapshotStart(since time.Time) time.Time {
+	if epoch := time.Unix(0, 0); since.Before(epoch) {
+		since = epoch
+	}
+	return backend.retentionStart(since).Truncate(snapshotGranularity)
+}
+
+// epochCache keeps the snapshots built for the current epoch, keyed by their
+// start, so that every request of an epoch shares one of a few builds
+type epochCache struct {
+	mu        sync.Mutex
+	end       time.Time
+	snapshots map[int64]*epochSnapshot
+}
+
+type epochSnapshot struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// get returns a snapshot of [start, end) for a start at or before since, calling
+// build once per start and epoch.  Once maxEpochSnapshots are kept, a request is
+// served from the latest snapshot starting before its since, or else from the
+// one starting at oldest, which covers every request.  The build runs detached
+// from the caller; concurrent callers wait for it until their ctx is done, and a
+// failed build is not kept.
+func (c *epochCache) get(ctx context.Context, since time.Time, oldest time.Time, end time.Time, build func(ctx context.Context, start time.Time) (interface{}, error)) (value interface{}, err error) {
+	c.mu.Lock()
+	if !c.end.Equal(end) {
+		c.end = end
+		c.snapshots = make(map[int64]*epochSnapshot)
+	}
+	key := since.Unix()
+	s, ok := c.snapshots[key]
+	if !ok && len(c.snapshots) >= maxEpochSnapshots {
+		key, s, ok = c.covering(since, oldest)
+	}
+	if !ok {
+		s = &epochSnapshot{done: make(chan struct{})}
+		c.snapshots[key] = s
+		go c.build(ctx, key, s, build)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return s.value, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// covering returns the latest snapshot starting at or before since, or makes
+// room for the snapshot starting at oldest; c.mu is held
+func (c *epochCache) covering(since time.Time, oldest time.Time) (key int64, s *epochSnapshot, ok bool) {
+	keys := make([]int64, 0, len(c.snapshots))
+	for k := range c.snapshots {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if i := sort.Search(len(keys), func(i int) bool { return keys[i] > since.Unix() }); i > 0 {
+		return keys[i-1], c.snapshots[keys[i-1]], true
+	}
+	// every snapshot starts after since: the latest one gives way
+	delete(c.snapshots, keys[len(keys)-1])
+	key = oldest.Unix()
+	s, ok = c.snapshots[key]
+	return key, s, ok
+}
+
+func (c *epochCache) build(ctx context.Context, key int64, s *epochSnapshot, build func(ctx context.Context, start time.Time) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), snapshotBuildTimeout)
+	defer cancel()
+	s.value, s.err = build(ctx, time.Unix(key, 0))
+	if s.err != nil {
+		c.mu.Lock()
+		if c.snapshots[key] == s {
+			delete(c.snapshots, key)
+		}
+		c.mu.Unlock()
+	}
+	close(s.done)
+}
@@ -0,0 +1,485 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/wolkdb/contact-tracing-server/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// With WALDir set, ProcessReport appends the reports to a write-ahead log and returns;
+// the loop started by Start writes them to Bigtable in batches.  The log is a sequence
+// of segment files, each a stream of records: the uvarint length of an ExportedReport
+// protobuf, its big-endian CRC-32 and the protobuf.  Records carry no timestamp: a
+// report takes its receipt time when it is written, so readers that synced past the
+// time it was queued still get it.  A new segment is started whenever a batch is
+// taken, and a segment is removed once all its reports are written.  On startup the
+// segments left over are read back (up to a torn last record) and written again;
+// reports are stored under their report IDs, so writing one twice is harmless.
+// Reports failing with a permanent error are appended to the dead-letter file, in
+// the same format, and dropped from the log.
+const (
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+
+	// walDeadLetter is the file of the reports that could not be written
+	walDeadLetter = "dead-letter.log"
+
+	// DefaultQueueMaxReports bounds the reports waiting to be written when QueueMaxReports is not set
+	DefaultQueueMaxReports = 1000000
+
+	// DefaultFlushBatchSize is the number of reports per ApplyBulk when FlushBatchSize is not set
+	DefaultFlushBatchSize = 10000
+
+	// DefaultFlushInterval is how long a batch is coalesced when FlushIntervalMillis is not set
+	DefaultFlushInterval = 100 * time.Millisecond
+
+	// maxFlushBatchSize keeps a batch (two mutations per report, and two for its
+	// changelog copy) under the 100,000 mutations ApplyBulk accepts
+	maxFlushBatchSize = 20000
+
+	// maxFlushBackoff bounds the wait between retries of failed writes
+	maxFlushBackoff = 5 * time.Second
+)
+
+// ErrQueueFull is returned by ProcessReport when the ingestion queue holds
+// QueueMaxReports reports; clients should retry later
+var ErrQueueFull = errors.New("ingestion queue full")
+
+type walSegment struct {
+	path string
+
+	// pending counts the reports of the segment not yet written
+	pending int
+
+	// closed segments take no more reports and are removed once pending is 0
+	closed bool
+}
+
+type walEntry struct {
+	report  CTReport
+	segment *walSegment
+}
+
+type ingestQueue struct {
+	dir        string
+	maxReports int
+	batchSize  int
+	interval   time.Duration
+
+	// write stores a batch, returning the per-report errors (see Backend.writeReports)
+	write func(ctx context.Context, reports []CTReport) (errs []error, err error)
+
+	mu       sync.Mutex
+	file     *os.File
+	current  *walSegment
+	offset   int64 // the size of the current segment
+	nextSeq  uint64
+	pending  []*walEntry
+	inflight int
+	buf      []byte
+	notify   chan struct{}
+}
+
+// openIngestQueue opens the write-ahead log in conf.WALDir, queueing the reports
+// left over by a previous run
+func openIngestQueue(conf *Config) (q *ingestQueue, err error) {
+	q = &ingestQueue{
+		dir:        conf.WALDir,
+		maxReports: conf.QueueMaxReports,
+		batchSize:  conf.FlushBatchSize,
+		interval:   time.Duration(conf.FlushIntervalMillis) * time.Millisecond,
+		notify:     make(chan struct{}, 1),
+	}
+	if q.maxReports <= 0 {
+		q.maxReports = DefaultQueueMaxReports
+	}
+	if q.batchSize <= 0 {
+		q.batchSize = DefaultFlushBatchSize
+	}
+	if q.batchSize > maxFlushBatchSize {
+		q.batchSize = maxFlushBatchSize
+	}
+	if q.interval <= 0 {
+		q.interval = DefaultFlushInterval
+	}
+	if err = os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		segment := &walSegment{path: q.segmentPath(seq), closed: true}
+		reports, err := readSegment(segment.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, report := range reports {
+			q.pending = append(q.pending, &walEntry{report: report, segment: segment})
+		}
+		segment.pending = len(reports)
+		if segment.pending == 0 {
+			os.Remove(segment.path)
+		}
+		q.nextSeq = seq + 1
+	}
+	if len(q.pending) > 0 {
+		logging.FromContext(context.Background()).Info("write-ahead log replay", "dir", q.dir, "segments", len(seqs), "reports", len(q.pending))
+		q.notify <- struct{}{}
+	}
+	ingestQueueReports.Set(float64(len(q.pending)))
+	return q, nil
+}
+
+func (q *ingestQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s%016d%s", walSegmentPrefix, seq, walSegmentSuffix))
+}
+
+// readSegment reads the reports of a segment up to its end or its first torn or
+// corrupted record
+func readSegment(path string) (reports []CTReport, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return reports, nil
+		}
+		var sum [4]byte
+		if err == nil && size > maxRecordSize {
+			err = fmt.Errorf("record of %d bytes", size)
+		}
+		if err == nil {
+			_, err = io.ReadFull(r, sum[:])
+		}
+		data := make([]byte, size)
+		if err == nil {
+			_, err = io.ReadFull(r, data)
+		}
+		if err == nil && crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum[:]) {
+			err = fmt.Errorf("checksum mismatch")
+		}
+		report := new(ExportedReport)
+		if err == nil {
+			err = proto.Unmarshal(data, report)
+		}
+		if err != nil {
+			logging.FromContext(context.Background()).Warn("write-ahead log: skipping the rest of a segment", "file", path, "reports", len(reports), "err", err)
+			return reports, nil
+		}
+		reports = append(reports, CTReport{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg})
+	}
+}
+
+// enqueue durably appends reports to the log and queues them for writing
+func (q *ingestQueue) enqueue(reports []CTReport) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending)+q.inflight+len(reports) > q.maxReports {
+		ingestQueueRejected.Inc()
+		return ErrQueueFull
+	}
+	if q.current == nil {
+		path := q.segmentPath(q.nextSeq)
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		q.nextSeq++
+		q.file, q.current, q.offset = file, &walSegment{path: path}, 0
+	}
+	var err error
+	if q.buf, err = appendRecords(q.buf[:0], reports); err != nil {
+		return err
+	}
+	if _, err = q.file.Write(q.buf); err == nil {
+		err = q.file.Sync()
+	}
+	if err != nil {
+		q.abandonSegment()
+		return err
+	}
+	q.offset += int64(len(q.buf))
+	for _, report := range reports {
+		q.pending = append(q.pending, &walEntry{report: report, segment: q.current})
+	}
+	q.current.pending += len(reports)
+	ingestQueueReports.Set(float64(len(q.pending) + q.inflight))
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// appendRecords appends the log records of reports to buf
+func appendRecords(buf []byte, reports []CTReport) ([]byte, error) {
+	for _, report := range reports {
+		data, err := proto.Marshal(&ExportedReport{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg})
+		if err != nil {
+			return buf, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(data))
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+// abandonSegment cuts what a failed append left off the current segment and closes
+// it, so that the next append starts a new one; q.mu is held
+func (q *ingestQueue) abandonSegment() {
+	if err := os.Truncate(q.current.path, q.offset); err != nil {
+		// a torn record ends the segment when it is read back
+		logging.FromContext(context.Background()).Error("write-ahead log: truncate after a failed append", "file", q.current.path, "err", err)
+	}
+	q.file.Close()
+	q.current.closed = true
+	if q.current.pending == 0 {
+		os.Remove(q.current.path)
+	}
+	q.file, q.current = nil, nil
+}
+
+// take removes up to batchSize reports from the head of the queue.  The current
+// segment is closed first, so the reports appended from now on go to a new one.
+func (q *ingestQueue) take() (batch []*walEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current != nil {
+		q.file.Close()
+		q.current.closed = true
+		q.file, q.current = nil, nil
+	}
+	n := len(q.pending)
+	if n > q.batchSize {
+		n = q.batchSize
+	}
+	batch = append(batch, q.pending[:n]...)
+	q.pending = q.pending[n:]
+	q.inflight += n
+	return batch
+}
+
+// done settles a batch: the written reports leave the log, the failed ones go back
+// to the head of the queue
+func (q *ingestQueue) done(batch []*walEntry, failed []*walEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight -= len(batch)
+	q.pending = append(failed[:len(failed):len(failed)], q.pending...)
+	isFailed := make(map[*walEntry]bool, len(failed))
+	for _, entry := range failed {
+		isFailed[entry] = true
+	}
+	for _, entry := range batch {
+		if isFailed[entry] {
+			continue
+		}
+		entry.segment.pending--
+		if entry.segment.pending == 0 && entry.segment.closed {
+			if err := os.Remove(entry.segment.path); err != nil {
+				logging.FromContext(context.Background()).Error("write-ahead log: remove segment", "file", entry.segment.path, "err", err)
+			}
+		}
+	}
+	ingestQueueReports.Set(float64(len(q.pending) + q.inflight))
+}
+
+// size returns the number of reports not yet written
+func (q *ingestQueue) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) + q.inflight
+}
+
+// flush writes one batch, returning the number of reports written (or dead-lettered
+// after a permanent failure) and the number failed transiently, which are queued again
+func (q *ingestQueue) flush(ctx context.Context) (written int, failed int) {
+	batch := q.take()
+	if len(batch) == 0 {
+		return 0, 0
+	}
+	ingestBatchSize.Observe(float64(len(batch)))
+	retry, err := q.writeBatch(ctx, batch)
+	if len(retry) > 0 {
+		ingestRetries.Add(float64(len(retry)))
+		logging.FromContext(ctx).Warn("ingestion queue: retrying failed writes", "batch", len(batch), "failed", len(retry), "err", err)
+	}
+	q.done(batch, retry)
+	return len(batch) - len(retry), len(retry)
+}
+
+// writeBatch writes batch and returns the entries to retry.  A batch refused as a
+// whole for its content (see isPoison) is written in halves, down to the reports
+// refused on their own, which go to the dead-letter file as the reports failing
+// permanently.
+func (q *ingestQueue) writeBatch(ctx context.Context, batch []*walEntry) (retry []*walEntry, err error) {
+	reports := make([]CTReport, len(batch))
+	for i, entry := range batch {
+		reports[i] = entry.report
+	}
+	errs, err := q.write(ctx, reports)
+	switch {
+	case err == nil:
+		var dead []*walEntry
+		for i, rowErr := range errs {
+			if rowErr == nil {
+				continue
+			}
+			if isTransient(rowErr) {
+				retry = append(retry, batch[i])
+			} else {
+				// repeating it would fail again
+				logging.FromContext(ctx).Error("ingestion queue: dropping report", "report", reportID(batch[i].report), "err", rowErr)
+				dead = append(dead, batch[i])
+			}
+		}
+		q.deadLetter(ctx, dead)
+		return retry, nil
+	case !isPoison(err):
+		return batch, err
+	case len(batch) == 1:
+		logging.FromContext(ctx).Error("ingestion queue: dropping report", "report", reportID(batch[0].report), "err", err)
+		q.deadLetter(ctx, batch)
+		return nil, nil
+	}
+	half := len(batch) / 2
+	retry, err = q.writeBatch(ctx, batch[:half])
+	more, moreErr := q.writeBatch(ctx, batch[half:])
+	if err == nil {
+		err = moreErr
+	}
+	return append(retry, more...), err
+}
+
+// isPoison reports whether a write failing as a whole may fail for some of its
+// reports, rather than for the table or the connection
+func isPoison(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.OutOfRange:
+		return true
+	}
+	return false
+}
+
+// deadLetter appends the reports of entries to the dead-letter file and counts them
+// as dropped
+func (q *ingestQueue) deadLetter(ctx context.Context, entries []*walEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	ingestDropped.Add(float64(len(entries)))
+	reports := make([]CTReport, len(entries))
+	for i, entry := range entries {
+		reports[i] = entry.report
+	}
+	path := filepath.Join(q.dir, walDeadLetter)
+	buf, err := appendRecords(nil, reports)
+	if err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			if _, err = file.Write(buf); err == nil {
+				err = file.Sync()
+			}
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("ingestion queue: dead-letter file", "file", path, "reports", len(reports), "err", err)
+	}
+}
+
+// loop writes the queued reports: it waits for reports, lets a batch build up for
+// the flush interval, then writes batches until the queue is empty, backing off
+// while writes fail
+func (q *ingestQueue) loop(ctx context.Context) {
+	backoff := q.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.notify:
+		}
+		if q.size() < q.batchSize {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(q.interval):
+			}
+		}
+		for q.size() > 0 && ctx.Err() == nil {
+			if _, failed := q.flush(ctx); failed > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > maxFlushBackoff {
+					backoff = maxFlushBackoff
+				}
+			} else {
+				backoff = q.interval
+			}
+		}
+	}
+}
+
+// Flush waits until the reports queued so far are written to Bigtable, e.g. before
+// shutting down; it returns at once without the ingestion queue
+func (backend *Backend) Flush(ctx context.Context) error {
+	if backend.queue == nil {
+		return nil
+	}
+	select {
+	case backend.queue.notify <- struct{}{}:
+	default:
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for backend.queue.size() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d reports not yet written: %v", backend.queue.size(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newQueuedBackend(t *testing.T, conf *Config) *Backend {
+	backend, close, err := newInMemoryBackend(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(close)
+	return backend
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"+walSegmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestIngestQueue(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := newQueuedBackend(t, &Config{WALDir: dir, FlushBatchSize: 7, FlushIntervalMillis: 1})
+	backend.Start()
+
+	var reports []CTReport
+	for i := 0; i < 5; i++ {
+		batch := randomReports(6, "queued")
+		if err := backend.ProcessReport(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, batch...)
+	}
+	flushCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := backend.Flush(flushCtx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := backend.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "sync after flush", got, reports)
+	if segments := walSegments(t, dir); len(segments) > 1 {
+		t.Fatalf("written segments not removed: %v", segments)
+	}
+}
+
+func TestIngestQueueReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// not started: the reports stay in the log, as if the server crashed
+	crashed := newQueuedBackend(t, &Config{WALDir: dir})
+	reports := randomReports(10, "replayed")
+	if err := crashed.ProcessReport(ctx, reports[:6]); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.ProcessReport(ctx, reports[6:]); err != nil {
+		t.Fatal(err)
+	}
+	// a torn write at the end of the segment
+	segments := walSegments(t, dir)
+	if len(segments) != 1 {
+		t.Fatalf("expected one segment, got %v", segments)
+	}
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{200, 1, 0, 0})
+	file.Close()
+
+	restarted := newQueuedBackend(t, &Config{WALDir: dir, FlushIntervalMillis: 1})
+	if n := restarted.queue.size(); n != len(reports) {
+		t.Fatalf("replayed %d reports, expected %d", n, len(reports))
+	}
+	restarted.Start()
+	flushCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := restarted.Flush(flushCtx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := restarted.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "sync after replay", got, reports)
+	if segments := walSegments(t, dir); len(segments) != 0 {
+		t.Fatalf("replayed segments not removed: %v", segments)
+	}
+}
+
+func TestIngestQueueRetry(t *testing.T) {
+	ctx := context.Background()
+	backend := newQueuedBackend(t, &Config{WALDir: t.TempDir(), FlushIntervalMillis: 1})
+	// the first attempt reports every other row failed, the second fails the whole call
+	attempts := 0
+	backend.queue.write = func(ctx context.Context, reports []CTReport) ([]error, error) {
+		attempts++
+		switch attempts {
+		case 1:
+			errs, err := backend.writeReports(ctx, reports)
+			if err != nil {
+				return nil, err
+			}
+			if errs == nil {
+				errs = make([]error, len(reports))
+			}
+			for i := range errs {
+				if i%2 == 1 {
+					errs[i] = status.Error(codes.Unavailable, "row failed")
+				}
+			}
+			return errs, nil
+		case 2:
+			return nil, errors.New("unavailable")
+		}
+		return backend.writeReports(ctx, reports)
+	}
+	reports := randomReports(8, "retried")
+	if err := backend.ProcessReport(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+	if written, failed := backend.queue.flush(ctx); written != 4 || failed != 4 {
+		t.Fatalf("first flush: written %d, failed %d", written, failed)
+	}
+	if written, failed := backend.queue.flush(ctx); written != 0 || failed != 4 {
+		t.Fatalf("second flush: written %d, failed %d", written, failed)
+	}
+	if written, failed := backend.queue.flush(ctx); written != 4 || failed != 0 {
+		t.Fatalf("third flush: written %d, failed %d", written, failed)
+	}
+	got, err := backend.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "sync after retries", got, reports)
+	if n := backend.queue.size(); n != 0 {
+		t.Fatalf("%d reports still queued", n)
+	}
+}
+
+func TestIngestQueuePoison(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := newQueuedBackend(t, &Config{WALDir: dir, FlushIntervalMillis: 1})
+	reports := randomReports(8, "batch")
+	poison := reports[5]
+	// a batch holding the poison report is refused as a whole
+	backend.queue.write = func(ctx context.Context, batch []CTReport) ([]error, error) {
+		for _, report := range batch {
+			if reportID(report) == reportID(poison) {
+				return nil, status.Error(codes.InvalidArgument, "poison")
+			}
+		}
+		return backend.writeReports(ctx, batch)
+	}
+	if err := backend.ProcessReport(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+	if written, failed := backend.queue.flush(ctx); written != len(reports) || failed != 0 {
+		t.Fatalf("flush: written %d, failed %d", written, failed)
+	}
+	got, err := backend.ProcessSync(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "sync around the poison report", got, append(reports[:5:5], reports[6:]...))
+	dead, err := readSegment(filepath.Join(dir, walDeadLetter))
+	if err != nil || len(dead) != 1 || reportID(dead[0]) != reportID(poison) {
+		t.Fatalf("dead letters %v %v", dead, err)
+	}
+	if n := backend.queue.size(); n != 0 {
+		t.Fatalf("%d reports still queued", n)
+	}
+}
+
+func TestIngestQueueFailedAppend(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	crashed := newQueuedBackend(t, &Config{WALDir: dir})
+	reports := randomReports(6, "appended")
+	if err := crashed.ProcessReport(ctx, reports[:3]); err != nil {
+		t.Fatal(err)
+	}
+	// the append fails: nothing of it may be replayed, and the next one goes to a new segment
+	crashed.queue.file.Close()
+	if err := crashed.ProcessReport(ctx, randomReports(2, "lost")); err == nil {
+		t.Fatalf("expected the append to fail")
+	}
+	if err := crashed.ProcessReport(ctx, reports[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if segments := walSegments(t, dir); len(segments) != 2 {
+		t.Fatalf("expected two segments, got %v", segments)
+	}
+	restarted := newQueuedBackend(t, &Config{WALDir: dir})
+	if n := restarted.queue.size(); n != len(reports) {
+		t.Fatalf("replayed %d reports, expected %d", n, len(reports))
+	}
+}
+
+func TestIngestQueueLoopCancel(t *testing.T) {
+	backend := newQueuedBackend(t, &Config{WALDir: t.TempDir(), FlushIntervalMillis: 60000})
+	backend.queue.write = func(ctx context.Context, reports []CTReport) ([]error, error) {
+		return nil, errors.New("unavailable")
+	}
+	if err := backend.queue.enqueue(randomReports(1, "stuck")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		backend.queue.loop(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("loop still waiting after cancel")
+	}
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	ctx := context.Background()
+	backend := newQueuedBackend(t, &Config{WALDir: t.TempDir(), QueueMaxReports: 5})
+	if err := backend.ProcessReport(ctx, randomReports(3, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.ProcessReport(ctx, randomReports(3, "b")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if err := backend.ProcessReport(ctx, randomReports(2, "c")); err != nil {
+		t.Fatal(err)
+	}
+}
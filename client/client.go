@@ -0,0 +1,434 @@
+// Package client is a Go client for the contact tracing API.
+package client
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+)
+
+const (
+	// DefaultTimeout bounds a single HTTP request
+	DefaultTimeout = 120 * time.Second
+
+	// DefaultMaxRetries is the number of retries of a failed request
+	DefaultMaxRetries = 3
+
+	// DefaultBackoff bounds the random wait before the first retry; it doubles on every retry
+	DefaultBackoff = 500 * time.Millisecond
+
+	// DefaultQueryBatch is the number of prefixes sent in one query
+	DefaultQueryBatch = 1000
+
+	// DefaultSyncPage is the number of reports requested per sync page
+	DefaultSyncPage = 1000
+)
+
+// Config holds the client settings; zero values select the defaults
+type Config struct {
+	// BaseURL is the API endpoint, e.g. https://api.wolk.com
+	BaseURL string
+
+	// TLSConfig is used for https endpoints, e.g. to trust a private CA
+	TLSConfig *tls.Config
+
+	// HTTPClient overrides the HTTP client built from TLSConfig and Timeout
+	HTTPClient *http.Client
+
+	Timeout time.Duration
+
+	// MaxRetries is the number of retries of a failed request; negative disables retries
+	MaxRetries int
+
+	Backoff    time.Duration
+	QueryBatch int
+	SyncPage   int
+}
+
+// Client calls the contact tracing API
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+	queryBatch int
+	syncPage   int
+}
+
+// APIError is returned for responses with a non 2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("contact tracing API: %d %s", e.StatusCode, e.Message)
+}
+
+// retryable reports whether a request failing with this status may succeed later
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// New returns a Client for conf.BaseURL
+func New(conf *Config) (c *Client, err error) {
+	u, err := url.Parse(conf.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q", conf.BaseURL)
+	}
+	c = &Client{
+		baseURL:    strings.TrimRight(conf.BaseURL, "/"),
+		httpClient: conf.HTTPClient,
+		maxRetries: conf.MaxRetries,
+		backoff:    conf.Backoff,
+		queryBatch: conf.QueryBatch,
+		syncPage:   conf.SyncPage,
+	}
+	if c.httpClient == nil {
+		timeout := conf.Timeout
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = conf.TLSConfig
+		c.httpClient = &http.Client{Timeout: timeout, Transport: transport}
+	}
+	if c.maxRetries == 0 {
+		c.maxRetries = DefaultMaxRetries
+	} else if c.maxRetries < 0 {
+		c.maxRetries = 0
+	}
+	if c.backoff <= 0 {
+		c.backoff = DefaultBackoff
+	}
+	if c.queryBatch <= 0 {
+		c.queryBatch = DefaultQueryBatch
+	}
+	if c.syncPage <= 0 {
+		c.syncPage = DefaultSyncPage
+	}
+	return c, nil
+}
+
+// do sends the request with the extra header (which may be nil), retrying network errors,
+// 429 and 5xx responses up to retries times with exponential backoff
+func (c *Client) do(ctx context.Context, retries int, method string, path string, params url.Values, extra http.Header, body []byte) (result []byte, header http.Header, err error) {
+	u := c.baseURL + "/" + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, values := range extra {
+			req.Header[name] = values
+		}
+		var resp *http.Response
+		resp, err = c.httpClient.Do(req)
+		if err == nil {
+			result, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode/100 == 2 {
+				return result, resp.Header, nil
+			}
+			if err == nil {
+				err = &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(result))}
+				if !retryable(resp.StatusCode) {
+					return nil, nil, err
+				}
+			}
+		}
+		if attempt >= retries || ctx.Err() != nil {
+			return nil, nil, err
+		}
+		if err = wait(ctx, backoff); err != nil {
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// wait sleeps for a random time up to backoff (full jitter), or until ctx is done
+func wait(ctx context.Context, backoff time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rand.Int63n(int64(backoff)))):
+		return nil
+	}
+}
+
+// retryableError reports whether a request failing with err may succeed later
+func retryableError(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return retryable(apiErr.StatusCode)
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func decodeReports(result []byte) (reports []api.CTReport, err error) {
+	if err = json.Unmarshal(result, &reports); err != nil {
+		return nil, fmt.Errorf("decode reports: %v", err)
+	}
+	return reports, nil
+}
+
+func sinceParam(since time.Time) url.Values {
+	return url.Values{"since": {timeParam(since)}}
+}
+
+// windowParam sets since and, unless it is zero, until
+func windowParam(since time.Time, until time.Time) url.Values {
+	params := sinceParam(since)
+	if !until.IsZero() {
+		params.Set("until", timeParam(until))
+	}
+	return params
+}
+
+// timeParam formats t in unix seconds, or milliseconds if it is not a whole second
+func timeParam(t time.Time) string {
+	if t.Before(time.Unix(0, 0)) {
+		return "0"
+	}
+	if t.Nanosecond() >= int(time.Millisecond) {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// ReportResults submits reports to POST /report once and returns the outcome of each.
+// The submission carries a fresh idempotency key, so a request repeated after a
+// network error gets the results of the first one.
+func (c *Client) ReportResults(ctx context.Context, reports []api.CTReport) (results []api.ReportResult, err error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	return c.reportResults(ctx, reports, key, c.maxRetries)
+}
+
+// newIdempotencyKey returns a random key naming one submission
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := crand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// reportResults is ReportResults under the idempotency key, repeating the request up
+// to retries times
+func (c *Client) reportResults(ctx context.Context, reports []api.CTReport, key string, retries int) (results []api.ReportResult, err error) {
+	body, err := json.Marshal(reports)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{api.IdempotencyKeyHeader: {key}}
+	result, _, err := c.do(ctx, retries, http.MethodPost, api.EndpointCTReport, nil, header, body)
+	if err != nil {
+		return nil, err
+	}
+	// servers without per-report results answer OK once every report is stored
+	if string(result) == "OK" {
+		results = make([]api.ReportResult, len(reports))
+		for i := range results {
+			results[i].Status = api.ReportAccepted
+		}
+		return results, nil
+	}
+	if err = json.Unmarshal(result, &results); err != nil {
+		return nil, fmt.Errorf("decode report results: %v", err)
+	}
+	if len(results) != len(reports) {
+		return nil, fmt.Errorf("%d report results for %d reports", len(results), len(reports))
+	}
+	return results, nil
+}
+
+// Report submits reports to POST /report, resubmitting the ones failing transiently up
+// to MaxRetries times; it fails if any report is not accepted.  Failed requests count
+// against the same MaxRetries and are repeated under the same idempotency key, so a
+// submission stored before its response was lost is not stored twice.
+func (c *Client) Report(ctx context.Context, reports []api.CTReport) error {
+	backoff := c.backoff
+	var rejected error
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		results, err := c.reportResults(ctx, reports, key, 0)
+		if err != nil {
+			if attempt >= c.maxRetries || !retryableError(err) {
+				return err
+			}
+			if err = wait(ctx, backoff); err != nil {
+				return err
+			}
+			backoff *= 2
+			continue
+		}
+		var retry []api.CTReport
+		var reason string
+		for i, result := range results {
+			switch result.Status {
+			case api.ReportAccepted:
+			case api.ReportRetryable:
+				retry = append(retry, reports[i])
+				reason = result.Reason
+			default:
+				if rejected == nil {
+					rejected = fmt.Errorf("report rejected: %s", result.Reason)
+				}
+			}
+		}
+		if len(retry) == 0 {
+			return rejected
+		}
+		if attempt >= c.maxRetries {
+			return fmt.Errorf("%d reports not accepted: %s", len(retry), reason)
+		}
+		if err = wait(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+		// the reports resubmitted make a new submission
+		if key, err = newIdempotencyKey(); err != nil {
+			return err
+		}
+		reports = retry
+	}
+}
+
+// QueryPrefixes returns every report received since under the given 3 byte prefixes
+// (concatenated), in as many requests as needed
+func (c *Client) QueryPrefixes(ctx context.Context, prefixes []byte, since time.Time) (reports []api.CTReport, err error) {
+	if len(prefixes)%api.PrefixSize != 0 {
+		return nil, fmt.Errorf("prefixes length %d is not a multiple of %d", len(prefixes), api.PrefixSize)
+	}
+	batch := c.queryBatch * api.PrefixSize
+	for start := 0; start < len(prefixes); start += batch {
+		end := start + batch
+		if end > len(prefixes) {
+			end = len(prefixes)
+		}
+		result, _, err := c.do(ctx, c.maxRetries, http.MethodPost, api.EndpointCTQuery, sinceParam(since), nil, prefixes[start:end])
+		if err != nil {
+			return nil, err
+		}
+		page, err := decodeReports(result)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, page...)
+	}
+	return reports, nil
+}
+
+// Query returns the reports received since for exactly the given hashed public keys.
+// Only their prefixes are sent to the server.
+func (c *Client) Query(ctx context.Context, hashedPKs [][]byte, since time.Time) (reports []api.CTReport, err error) {
+	wanted := make(map[string]bool)
+	seen := make(map[string]bool)
+	var prefixes []byte
+	for _, hashedPK := range hashedPKs {
+		if len(hashedPK) < api.PrefixSize {
+			return nil, fmt.Errorf("hashedPK too short")
+		}
+		wanted[string(hashedPK)] = true
+		prefix := hashedPK[:api.PrefixSize]
+		if !seen[string(prefix)] {
+			seen[string(prefix)] = true
+			prefixes = append(prefixes, prefix...)
+		}
+	}
+	all, err := c.QueryPrefixes(ctx, prefixes, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, report := range all {
+		if wanted[string(report.HashedPK)] {
+			reports = append(reports, report)
+		}
+	}
+	return reports, nil
+}
+
+// SyncPage returns one page of GET /sync; pass the returned next cursor to get the
+// following page, next is "" after the last page
+func (c *Client) SyncPage(ctx context.Context, since time.Time, cursor string, limit int) (reports []api.CTReport, next string, err error) {
+	return c.SyncShardPage(ctx, api.Shard{}, since, time.Time{}, cursor, limit)
+}
+
+// SyncShardPage returns one page of the reports of shard received in [since, until),
+// see SyncPage; a zero until is now
+func (c *Client) SyncShardPage(ctx context.Context, shard api.Shard, since time.Time, until time.Time, cursor string, limit int) (reports []api.CTReport, next string, err error) {
+	params := windowParam(since, until)
+	if shard.Bits > 0 {
+		params.Set("prefix", shard.String())
+	}
+	params.Set("limit", strconv.Itoa(limit))
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	result, header, err := c.do(ctx, c.maxRetries, http.MethodGet, api.EndpointCTSync, params, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	reports, err = decodeReports(result)
+	if err != nil {
+		return nil, "", err
+	}
+	return reports, header.Get(api.NextCursorHeader), nil
+}
+
+// Sync returns every report received since, following the sync pages to the end
+func (c *Client) Sync(ctx context.Context, since time.Time) (reports []api.CTReport, err error) {
+	return c.SyncRange(ctx, since, time.Time{})
+}
+
+// SyncRange returns every report received in [since, until), following the sync pages
+// to the end; a zero until is now.  Disjoint windows can be downloaded in parallel.
+func (c *Client) SyncRange(ctx context.Context, since time.Time, until time.Time) (reports []api.CTReport, err error) {
+	return c.SyncShard(ctx, api.Shard{}, since, until)
+}
+
+// SyncShard returns every report of shard received in [since, until), following the
+// sync pages to the end; a zero until is now.  Use api.ParseShard to name a shard.
+func (c *Client) SyncShard(ctx context.Context, shard api.Shard, since time.Time, until time.Time) (reports []api.CTReport, err error) {
+	cursor := ""
+	for {
+		page, next, err := c.SyncShardPage(ctx, shard, since, until, cursor, c.syncPage)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, page...)
+		if next == "" {
+			return reports, nil
+		}
+		cursor = next
+	}
+}
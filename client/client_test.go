@@ -0,0 +1,287 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/memopb"
+	"github.com/wolkdb/contact-tracing-server/server/servertest"
+)
+
+func newTestClient(t *testing.T, conf Config) *Client {
+	c, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func encounter(t *testing.T) (a Encounter, b Encounter) {
+	aPriv, err := NewEncounterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bPriv, err := NewEncounterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Encounter{PrivateKey: aPriv, PeerPublicKey: &bPriv.PublicKey}, Encounter{PrivateKey: bPriv, PeerPublicKey: &aPriv.PublicKey}
+}
+
+func TestClientParticipants(t *testing.T) {
+	ctx := context.Background()
+	ts := servertest.New(t, nil)
+	c := newTestClient(t, Config{BaseURL: ts.URL})
+	since := time.Now()
+
+	// A met B and C; B met D
+	ab, ba := encounter(t)
+	ac, ca := encounter(t)
+	bd, _ := encounter(t)
+
+	memo := &memopb.ContactTracingMemo{ReportType: memopb.ContactTracingMemo_CERTIFIED_INFECTION, DiseaseID: 2, SymptomID: []int32{5, 7}}
+	if err := c.ReportEncounters(ctx, []Encounter{ab, ac}, memo); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []Encounter{ba, ca} {
+		exposures, err := c.CheckExposures(ctx, []Encounter{e, bd}, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(exposures) != 1 {
+			t.Fatalf("expected 1 exposure, got %d", len(exposures))
+		}
+		got := exposures[0].Memo
+		if got.ReportType != memo.ReportType || got.DiseaseID != 2 || len(got.SymptomID) != 2 {
+			t.Fatalf("unexpected memo %v", got)
+		}
+		if exposures[0].Encounter != e {
+			t.Fatalf("exposure matched the wrong encounter")
+		}
+	}
+
+	exposures, err := c.CheckExposures(ctx, []Encounter{bd}, since)
+	if err != nil || len(exposures) != 0 {
+		t.Fatalf("unexpected exposures %d %v", len(exposures), err)
+	}
+}
+
+func TestClientSync(t *testing.T) {
+	ctx := context.Background()
+	ts := servertest.New(t, nil)
+	c := newTestClient(t, Config{BaseURL: ts.URL, SyncPage: 7})
+	since := time.Now()
+
+	var reports []api.CTReport
+	for i := 0; i < 50; i++ {
+		key := make([]byte, 16)
+		rand.Read(key)
+		reports = append(reports, api.CTReport{HashedPK: api.Computehash(key), EncodedMsg: []byte(fmt.Sprintf("msg %d", i))})
+	}
+	if err := c.Report(ctx, reports); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := 0
+	seen := make(map[string]int)
+	cursor := ""
+	for {
+		page, next, err := c.SyncPage(ctx, since, cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, r := range page {
+			seen[string(r.EncodedMsg)]++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 50 || pages < 8 {
+		t.Fatalf("expected 50 reports in at least 8 pages, got %d in %d", len(seen), pages)
+	}
+	for msg, n := range seen {
+		if n != 1 {
+			t.Fatalf("%s returned %d times", msg, n)
+		}
+	}
+
+	all, err := c.Sync(ctx, since)
+	if err != nil || len(all) != 50 {
+		t.Fatalf("Sync: %d reports, err %v", len(all), err)
+	}
+
+	// disjoint windows, in milliseconds
+	time.Sleep(2 * time.Millisecond)
+	until := time.Now()
+	later := reports[:5]
+	for i := range later {
+		later[i].EncodedMsg = []byte(fmt.Sprintf("later %d", i))
+	}
+	if err := c.Report(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if window, err := c.SyncRange(ctx, since, until); err != nil || len(window) != 50 {
+		t.Fatalf("SyncRange before until: %d reports, err %v", len(window), err)
+	}
+	if window, err := c.SyncRange(ctx, until, time.Time{}); err != nil || len(window) != 5 {
+		t.Fatalf("SyncRange after until: %d reports, err %v", len(window), err)
+	}
+
+	if _, _, err = c.SyncPage(ctx, since, "garbage", 7); err == nil {
+		t.Fatalf("expected error for invalid cursor")
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	ctx := context.Background()
+	ts := servertest.New(t, nil)
+
+	var calls int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, ts.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer flaky.Close()
+
+	c := newTestClient(t, Config{BaseURL: flaky.URL, Backoff: time.Millisecond})
+	if _, err := c.Sync(ctx, time.Now()); err != nil {
+		t.Fatalf("Sync after retries: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected 3 calls, got %d", n)
+	}
+
+	// client errors are not retried
+	atomic.StoreInt32(&calls, 10)
+	_, err := c.QueryPrefixes(ctx, []byte{1, 2}, time.Now())
+	if err == nil {
+		t.Fatalf("expected error for a partial prefix")
+	}
+	c = newTestClient(t, Config{BaseURL: ts.URL, Backoff: time.Millisecond})
+	err = c.Report(ctx, []api.CTReport{{HashedPK: []byte{1}}})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 APIError, got %v", err)
+	}
+
+	// retries give up
+	atomic.StoreInt32(&calls, -100)
+	c = newTestClient(t, Config{BaseURL: flaky.URL, Backoff: time.Millisecond, MaxRetries: 2})
+	if _, err := c.Sync(ctx, time.Now()); err == nil {
+		t.Fatalf("expected error after retries")
+	}
+	if n := atomic.LoadInt32(&calls); n != -97 {
+		t.Fatalf("expected 3 attempts, got %d", n+100)
+	}
+
+	// negative MaxRetries disables retries
+	atomic.StoreInt32(&calls, -100)
+	c = newTestClient(t, Config{BaseURL: flaky.URL, Backoff: time.Millisecond, MaxRetries: -1})
+	if _, err := c.Sync(ctx, time.Now()); err == nil {
+		t.Fatalf("expected error without retries")
+	}
+	if n := atomic.LoadInt32(&calls); n != -99 {
+		t.Fatalf("expected 1 attempt, got %d", n+100)
+	}
+
+	// failed report submissions share the same retries
+	atomic.StoreInt32(&calls, -100)
+	c = newTestClient(t, Config{BaseURL: flaky.URL, Backoff: time.Millisecond, MaxRetries: 2})
+	if err := c.Report(ctx, []api.CTReport{{HashedPK: []byte{1, 2, 3}}}); err == nil {
+		t.Fatalf("expected error after retries")
+	}
+	if n := atomic.LoadInt32(&calls); n != -97 {
+		t.Fatalf("expected 3 report attempts, got %d", n+100)
+	}
+}
+
+func TestClientReportResubmit(t *testing.T) {
+	ctx := context.Background()
+	// the first submission fails the second report transiently, the third permanently
+	var submissions [][]api.CTReport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reports []api.CTReport
+		if err := json.NewDecoder(r.Body).Decode(&reports); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		submissions = append(submissions, reports)
+		results := make([]api.ReportResult, len(reports))
+		for i := range results {
+			results[i].Status = api.ReportAccepted
+		}
+		if len(submissions) == 1 {
+			results[1] = api.ReportResult{Status: api.ReportRetryable, Reason: "unavailable"}
+			results[2] = api.ReportResult{Status: api.ReportRejected, Reason: "hashedPK too short"}
+		}
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer ts.Close()
+
+	c := newTestClient(t, Config{BaseURL: ts.URL, Backoff: time.Millisecond})
+	reports := []api.CTReport{
+		{HashedPK: []byte{1, 2, 3}, EncodedMsg: []byte("a")},
+		{HashedPK: []byte{4, 5, 6}, EncodedMsg: []byte("b")},
+		{HashedPK: []byte{7}, EncodedMsg: []byte("c")},
+	}
+	err := c.Report(ctx, reports)
+	if err == nil || !strings.Contains(err.Error(), "hashedPK too short") {
+		t.Fatalf("expected the rejection, got %v", err)
+	}
+	if len(submissions) != 2 || len(submissions[1]) != 1 || string(submissions[1][0].EncodedMsg) != "b" {
+		t.Fatalf("expected only the retryable report resubmitted, got %v", submissions)
+	}
+
+	// ReportResults against the real server
+	c = newTestClient(t, Config{BaseURL: servertest.New(t, nil).URL})
+	results, err := c.ReportResults(ctx, reports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{api.ReportAccepted, api.ReportAccepted, api.ReportRejected} {
+		if results[i].Status != expected {
+			t.Fatalf("report %d: expected %s, got %+v", i, expected, results[i])
+		}
+	}
+}
+
+func TestClientReportIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	ts := servertest.New(t, nil)
+	// the response to the first attempt is lost
+	var keys []string
+	lossy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(api.IdempotencyKeyHeader))
+		if len(keys) == 1 {
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+			return
+		}
+		http.Redirect(w, r, ts.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer lossy.Close()
+
+	c := newTestClient(t, Config{BaseURL: lossy.URL, Backoff: time.Millisecond})
+	if err := c.Report(ctx, []api.CTReport{{HashedPK: []byte{1, 2, 3}, EncodedMsg: []byte("once")}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Fatalf("expected the retry under the same idempotency key, got %q", keys)
+	}
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/memopb"
+)
+
+// Encounter is one BLE contact as seen by this device: the key pair this device
+// advertised to the peer, and the public key the peer advertised to this device.
+//
+// If the peer reports, it makes a report for PublicKey (MakeCTReport with our
+// public key and its private key); we find it under the hash of PublicKey and
+// decrypt it with the secret shared by PrivateKey and PeerPublicKey.
+type Encounter struct {
+	PrivateKey    *ecdsa.PrivateKey
+	PeerPublicKey *ecdsa.PublicKey
+}
+
+// Exposure is a report addressed to one of our encounters, decrypted
+type Exposure struct {
+	Encounter Encounter
+	Report    api.CTReport
+	Memo      *memopb.ContactTracingMemo
+}
+
+// NewEncounterKey returns a fresh key pair to advertise to a peer
+func NewEncounterKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(api.P256(), rand.Reader)
+}
+
+// HashedPK returns the hashed public key our peer's reports are stored under
+func (e Encounter) HashedPK() []byte {
+	return api.Computehash(api.FromECDSAPub(&e.PrivateKey.PublicKey))
+}
+
+// MakeReports encrypts memo for the peer of every encounter
+func MakeReports(encounters []Encounter, memo *memopb.ContactTracingMemo) (reports []api.CTReport, err error) {
+	memoByte, err := proto.Marshal(memo)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range encounters {
+		report, err := api.MakeCTReport(e.PeerPublicKey, e.PrivateKey, memoByte)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// ReportEncounters sends memo (e.g. a certified infection) to the peers of encounters
+func (c *Client) ReportEncounters(ctx context.Context, encounters []Encounter, memo *memopb.ContactTracingMemo) error {
+	reports, err := MakeReports(encounters, memo)
+	if err != nil {
+		return err
+	}
+	return c.Report(ctx, reports)
+}
+
+// DecryptReport decrypts a report addressed to encounter
+func DecryptReport(encounter Encounter, report api.CTReport) (memo *memopb.ContactTracingMemo, err error) {
+	if !bytes.Equal(report.HashedPK, encounter.HashedPK()) {
+		return nil, fmt.Errorf("report is not addressed to this encounter")
+	}
+	ss := api.GenerateSessionSecret(encounter.PeerPublicKey, encounter.PrivateKey)
+	memoByte, err := api.DecryptCTReport(report, ss[:])
+	if err != nil {
+		return nil, err
+	}
+	memo = new(memopb.ContactTracingMemo)
+	if err = proto.Unmarshal(memoByte, memo); err != nil {
+		return nil, err
+	}
+	return memo, nil
+}
+
+// CheckExposures queries the reports received since for our encounters and returns
+// the ones that decrypt.  Reports that do not decrypt (e.g. forged) are skipped.
+func (c *Client) CheckExposures(ctx context.Context, encounters []Encounter, since time.Time) (exposures []Exposure, err error) {
+	byHashedPK := make(map[string]Encounter)
+	var hashedPKs [][]byte
+	for _, e := range encounters {
+		hashedPK := e.HashedPK()
+		byHashedPK[string(hashedPK)] = e
+		hashedPKs = append(hashedPKs, hashedPK)
+	}
+	reports, err := c.Query(ctx, hashedPKs, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, report := range reports {
+		e := byHashedPK[string(report.HashedPK)]
+		memo, err := DecryptReport(e, report)
+		if err != nil {
+			continue
+		}
+		exposures = append(exposures, Exposure{Encounter: e, Report: report, Memo: memo})
+	}
+	return exposures, nil
+}
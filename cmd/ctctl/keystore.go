@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/client"
+)
+
+// keyEntry is one encounter key: the private key we advertised and, once known,
+// the public key the peer advertised to us (hex, uncompressed)
+type keyEntry struct {
+	PrivateKey    string `json:"privateKey"`
+	PublicKey     string `json:"publicKey"`
+	PeerPublicKey string `json:"peerPublicKey,omitempty"`
+}
+
+// keyStore is a JSON file of named encounter keys.  It holds private keys in the
+// clear and is written with mode 0600.
+type keyStore struct {
+	path string
+	Keys map[string]*keyEntry `json:"keys"`
+}
+
+func loadKeyStore(path string) (ks *keyStore, err error) {
+	ks = &keyStore{path: path, Keys: make(map[string]*keyEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, ks); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if ks.Keys == nil {
+		ks.Keys = make(map[string]*keyEntry)
+	}
+	return ks, nil
+}
+
+func (ks *keyStore) save() error {
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ks.path, data, 0600)
+}
+
+func (ks *keyStore) names() (names []string) {
+	for name := range ks.Keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ks *keyStore) add(name string, priv *ecdsa.PrivateKey) error {
+	if _, ok := ks.Keys[name]; ok {
+		return fmt.Errorf("key %q already exists", name)
+	}
+	ks.Keys[name] = &keyEntry{
+		PrivateKey: hex.EncodeToString(priv.D.Bytes()),
+		PublicKey:  hex.EncodeToString(api.FromECDSAPub(&priv.PublicKey)),
+	}
+	return nil
+}
+
+// encounter returns the named key as an Encounter; it needs the peer public key
+func (ks *keyStore) encounter(name string) (e client.Encounter, err error) {
+	entry, ok := ks.Keys[name]
+	if !ok {
+		return e, fmt.Errorf("no key %q", name)
+	}
+	if entry.PeerPublicKey == "" {
+		return e, fmt.Errorf("key %q has no peer public key, run ctctl encounter first", name)
+	}
+	d, err := hex.DecodeString(entry.PrivateKey)
+	if err != nil {
+		return e, fmt.Errorf("key %q: %v", name, err)
+	}
+	priv := new(ecdsa.PrivateKey)
+	priv.Curve = api.P256()
+	priv.D = new(big.Int).SetBytes(d)
+	priv.PublicKey.X, priv.PublicKey.Y = priv.Curve.ScalarBaseMult(d)
+	peer, err := parsePublicKey(entry.PeerPublicKey)
+	if err != nil {
+		return e, fmt.Errorf("key %q: %v", name, err)
+	}
+	return client.Encounter{PrivateKey: priv, PeerPublicKey: peer}, nil
+}
+
+// encounters returns every key with a peer public key
+func (ks *keyStore) encounters() (names []string, encounters []client.Encounter, err error) {
+	for _, name := range ks.names() {
+		if ks.Keys[name].PeerPublicKey == "" {
+			continue
+		}
+		e, err := ks.encounter(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+		encounters = append(encounters, e)
+	}
+	return names, encounters, nil
+}
+
+func parsePublicKey(s string) (*ecdsa.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return api.ByteToPublicKey(b)
+}
@@ -0,0 +1,460 @@
+// Command ctctl is a command line tool for operators and testers of the contact tracing API.
+//
+//	ctctl keygen    -name bob-monday                   new encounter key, prints the public key to advertise
+//	ctctl encounter -name bob-monday -peer <hex>       record the public key the peer advertised
+//	ctctl report    -name bob-monday [-type ...]       encrypt a memo for the peer and submit it
+//	ctctl check     [-since 24h]                       query all encounters and decrypt the reports found
+//	ctctl query     -prefix <hex>[,<hex>]              query by HashedPK prefix
+//	ctctl sync      [-since 24h]                       download every report
+//	ctctl decrypt   -name bob-monday < reports.json    decrypt reports addressed to a key
+//	ctctl memo      encode|decode                      build or inspect a ContactTracingMemo
+//
+// Keys are kept in the key store file (-keys, default ~/.ctctl/keys.json).
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/client"
+	"github.com/wolkdb/contact-tracing-server/memopb"
+)
+
+const defaultServer = "https://api.wolk.com"
+
+var errUsage = errors.New("usage")
+
+func main() {
+	err := run(context.Background(), os.Args[1:], os.Stdin, os.Stdout)
+	if err == errUsage {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ctctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: ctctl <keygen|encounter|report|check|query|sync|decrypt|memo> [flags]")
+	fmt.Fprintln(w, "run ctctl <command> -h for the flags of a command")
+}
+
+// command holds the flags shared by all subcommands
+type command struct {
+	fs       *flag.FlagSet
+	server   *string
+	caFile   *string
+	insecure *bool
+	keys     *string
+	out      io.Writer
+	in       io.Reader
+}
+
+func newCommand(name string, in io.Reader, out io.Writer) *command {
+	fs := flag.NewFlagSet("ctctl "+name, flag.ContinueOnError)
+	fs.SetOutput(out)
+	home, _ := os.UserHomeDir()
+	return &command{
+		fs:       fs,
+		server:   fs.String("server", envOr("CT_SERVER", defaultServer), "API endpoint ($CT_SERVER)"),
+		caFile:   fs.String("ca", "", "PEM file of the CA to trust for the server certificate"),
+		insecure: fs.Bool("insecure", false, "skip verification of the server certificate"),
+		keys:     fs.String("keys", envOr("CT_KEYS", filepath.Join(home, ".ctctl", "keys.json")), "key store file ($CT_KEYS)"),
+		in:       in,
+		out:      out,
+	}
+}
+
+func envOr(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (c *command) client() (*client.Client, error) {
+	conf := &client.Config{BaseURL: *c.server}
+	if *c.caFile != "" || *c.insecure {
+		conf.TLSConfig = &tls.Config{InsecureSkipVerify: *c.insecure}
+		if *c.caFile != "" {
+			pem, err := ioutil.ReadFile(*c.caFile)
+			if err != nil {
+				return nil, err
+			}
+			conf.TLSConfig.RootCAs = x509.NewCertPool()
+			if !conf.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", *c.caFile)
+			}
+		}
+	}
+	return client.New(conf)
+}
+
+func (c *command) keyStore() (*keyStore, error) {
+	if err := os.MkdirAll(filepath.Dir(*c.keys), 0700); err != nil {
+		return nil, err
+	}
+	return loadKeyStore(*c.keys)
+}
+
+func (c *command) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func run(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	err := runCommand(ctx, args, in, out)
+	if err == flag.ErrHelp {
+		// -h printed the flags of the command
+		return nil
+	}
+	return err
+}
+
+func runCommand(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	name, args := args[0], args[1:]
+	c := newCommand(name, in, out)
+	switch name {
+	case "keygen":
+		return c.keygen(args)
+	case "encounter":
+		return c.encounter(args)
+	case "report":
+		return c.report(ctx, args)
+	case "check":
+		return c.check(ctx, args)
+	case "query":
+		return c.query(ctx, args)
+	case "sync":
+		return c.sync(ctx, args)
+	case "decrypt":
+		return c.decrypt(args)
+	case "memo":
+		return c.memo(args)
+	case "help", "-h", "--help":
+		usage(out)
+		return nil
+	}
+	return errUsage
+}
+
+// parseSince accepts unix seconds, an RFC 3339 time or a duration ago (e.g. 24h)
+func parseSince(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q: unix seconds, RFC 3339 time or duration", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+func (c *command) keygen(args []string) error {
+	name := c.fs.String("name", "", "name of the new key")
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	ks, err := c.keyStore()
+	if err != nil {
+		return err
+	}
+	priv, err := client.NewEncounterKey()
+	if err != nil {
+		return err
+	}
+	if err = ks.add(*name, priv); err != nil {
+		return err
+	}
+	if err = ks.save(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, ks.Keys[*name].PublicKey)
+	return nil
+}
+
+func (c *command) encounter(args []string) error {
+	name := c.fs.String("name", "", "name of the key advertised to the peer")
+	peer := c.fs.String("peer", "", "public key advertised by the peer (hex)")
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	ks, err := c.keyStore()
+	if err != nil {
+		return err
+	}
+	entry, ok := ks.Keys[*name]
+	if !ok {
+		return fmt.Errorf("no key %q", *name)
+	}
+	if _, err = parsePublicKey(*peer); err != nil {
+		return fmt.Errorf("invalid peer public key: %v", err)
+	}
+	entry.PeerPublicKey = *peer
+	return ks.save()
+}
+
+// memoFlags adds the flags describing a ContactTracingMemo
+func (c *command) memoFlags() func() (*memopb.ContactTracingMemo, error) {
+	reportType := c.fs.String("type", "CERTIFIED_INFECTION", "report type: SELF_REPORTED or CERTIFIED_INFECTION")
+	disease := c.fs.Int("disease", 0, "disease ID")
+	symptoms := c.fs.String("symptoms", "", "comma separated symptom IDs")
+	return func() (*memopb.ContactTracingMemo, error) {
+		t, ok := memopb.ContactTracingMemo_ReportType_value[strings.ToUpper(*reportType)]
+		if !ok {
+			return nil, fmt.Errorf("unknown report type %q", *reportType)
+		}
+		memo := &memopb.ContactTracingMemo{ReportType: memopb.ContactTracingMemo_ReportType(t), DiseaseID: int32(*disease)}
+		for _, s := range strings.Split(*symptoms, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid symptom ID %q", s)
+			}
+			memo.SymptomID = append(memo.SymptomID, int32(id))
+		}
+		return memo, nil
+	}
+}
+
+func (c *command) report(ctx context.Context, args []string) error {
+	names := c.fs.String("name", "", "comma separated keys whose peers are notified")
+	dryRun := c.fs.Bool("dry-run", false, "print the reports instead of submitting them")
+	memoFromFlags := c.memoFlags()
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	memo, err := memoFromFlags()
+	if err != nil {
+		return err
+	}
+	ks, err := c.keyStore()
+	if err != nil {
+		return err
+	}
+	var encounters []client.Encounter
+	for _, name := range strings.Split(*names, ",") {
+		e, err := ks.encounter(name)
+		if err != nil {
+			return err
+		}
+		encounters = append(encounters, e)
+	}
+	reports, err := client.MakeReports(encounters, memo)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return c.printJSON(reports)
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	if err = cl.Report(ctx, reports); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "submitted %d reports\n", len(reports))
+	return nil
+}
+
+// exposure is the output of check and decrypt
+type exposure struct {
+	Name       string                     `json:"name"`
+	HashedPK   string                     `json:"hashedPK"`
+	ReportType string                     `json:"reportType"`
+	Memo       *memopb.ContactTracingMemo `json:"memo"`
+}
+
+func (c *command) check(ctx context.Context, args []string) error {
+	since := c.fs.String("since", "336h", "unix seconds, RFC 3339 time or duration ago")
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	t, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+	ks, err := c.keyStore()
+	if err != nil {
+		return err
+	}
+	names, encounters, err := ks.encounters()
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	exposures, err := cl.CheckExposures(ctx, encounters, t)
+	if err != nil {
+		return err
+	}
+	out := []exposure{}
+	for _, e := range exposures {
+		for i := range encounters {
+			if encounters[i] == e.Encounter {
+				out = append(out, exposure{Name: names[i], HashedPK: hex.EncodeToString(e.Report.HashedPK), ReportType: e.Memo.ReportType.String(), Memo: e.Memo})
+			}
+		}
+	}
+	return c.printJSON(out)
+}
+
+func (c *command) query(ctx context.Context, args []string) error {
+	prefixList := c.fs.String("prefix", "", "comma separated hex HashedPK prefixes (3 bytes each, longer values are cut)")
+	since := c.fs.String("since", "336h", "unix seconds, RFC 3339 time or duration ago")
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	t, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+	var prefixes []byte
+	for _, s := range strings.Split(*prefixList, ",") {
+		b, err := hex.DecodeString(strings.TrimSpace(s))
+		if err != nil || len(b) < api.PrefixSize {
+			return fmt.Errorf("invalid prefix %q", s)
+		}
+		prefixes = append(prefixes, b[:api.PrefixSize]...)
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	reports, err := cl.QueryPrefixes(ctx, prefixes, t)
+	if err != nil {
+		return err
+	}
+	return c.printJSON(reports)
+}
+
+func (c *command) sync(ctx context.Context, args []string) error {
+	since := c.fs.String("since", "24h", "unix seconds, RFC 3339 time or duration ago")
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	t, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+	cl, err := c.client()
+	if err != nil {
+		return err
+	}
+	reports, err := cl.Sync(ctx, t)
+	if err != nil {
+		return err
+	}
+	if reports == nil {
+		reports = []api.CTReport{}
+	}
+	return c.printJSON(reports)
+}
+
+func (c *command) decrypt(args []string) error {
+	name := c.fs.String("name", "", "key the reports are addressed to (default: try every key)")
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+	var reports []api.CTReport
+	if err := json.NewDecoder(c.in).Decode(&reports); err != nil {
+		return fmt.Errorf("reading reports from stdin: %v", err)
+	}
+	ks, err := c.keyStore()
+	if err != nil {
+		return err
+	}
+	names, encounters, err := ks.encounters()
+	if err != nil {
+		return err
+	}
+	out := []exposure{}
+	for _, report := range reports {
+		for i, e := range encounters {
+			if *name != "" && names[i] != *name {
+				continue
+			}
+			memo, err := client.DecryptReport(e, report)
+			if err != nil {
+				continue
+			}
+			out = append(out, exposure{Name: names[i], HashedPK: hex.EncodeToString(report.HashedPK), ReportType: memo.ReportType.String(), Memo: memo})
+		}
+	}
+	return c.printJSON(out)
+}
+
+func (c *command) memo(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ctctl memo encode [-type ...] | ctctl memo decode <hex>")
+	}
+	switch args[0] {
+	case "encode":
+		memoFromFlags := c.memoFlags()
+		if err := c.fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		memo, err := memoFromFlags()
+		if err != nil {
+			return err
+		}
+		b, err := proto.Marshal(memo)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, hex.EncodeToString(b))
+		return nil
+	case "decode":
+		if err := c.fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if c.fs.NArg() != 1 {
+			return fmt.Errorf("usage: ctctl memo decode <hex>")
+		}
+		b, err := hex.DecodeString(c.fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		memo := new(memopb.ContactTracingMemo)
+		if err = proto.Unmarshal(b, memo); err != nil {
+			return err
+		}
+		return c.printJSON(struct {
+			ReportType string                     `json:"reportType"`
+			Memo       *memopb.ContactTracingMemo `json:"memo"`
+		}{memo.ReportType.String(), memo})
+	}
+	return fmt.Errorf("unknown memo command %q", args[0])
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/memopb"
+	"github.com/wolkdb/contact-tracing-server/server/servertest"
+)
+
+// ctctl runs one command and returns its output
+func ctctl(t *testing.T, stdin string, args ...string) string {
+	var out bytes.Buffer
+	if err := run(context.Background(), args, strings.NewReader(stdin), &out); err != nil {
+		t.Fatalf("ctctl %s: %v", strings.Join(args, " "), err)
+	}
+	return out.String()
+}
+
+func TestCtctl(t *testing.T) {
+	ts := servertest.New(t, nil)
+	dir := t.TempDir()
+	alice := []string{"-server", ts.URL, "-keys", filepath.Join(dir, "alice.json")}
+	bob := []string{"-server", ts.URL, "-keys", filepath.Join(dir, "bob.json")}
+	with := func(cmd string, common []string, args ...string) []string {
+		return append(append([]string{cmd}, common...), args...)
+	}
+
+	alicePub := strings.TrimSpace(ctctl(t, "", with("keygen", alice, "-name", "bob")...))
+	bobPub := strings.TrimSpace(ctctl(t, "", with("keygen", bob, "-name", "alice")...))
+	ctctl(t, "", with("encounter", alice, "-name", "bob", "-peer", bobPub)...)
+	ctctl(t, "", with("encounter", bob, "-name", "alice", "-peer", alicePub)...)
+
+	out := ctctl(t, "", with("report", alice, "-name", "bob", "-type", "certified_infection", "-disease", "2", "-symptoms", "5,7")...)
+	if !strings.Contains(out, "submitted 1 reports") {
+		t.Fatalf("unexpected report output %q", out)
+	}
+
+	var exposures []exposure
+	if err := json.Unmarshal([]byte(ctctl(t, "", with("check", bob, "-since", "1h")...)), &exposures); err != nil {
+		t.Fatal(err)
+	}
+	if len(exposures) != 1 || exposures[0].Name != "alice" || exposures[0].Memo.DiseaseID != 2 || len(exposures[0].Memo.SymptomID) != 2 {
+		t.Fatalf("unexpected exposures %+v", exposures)
+	}
+	if err := json.Unmarshal([]byte(ctctl(t, "", with("check", alice, "-since", "1h")...)), &exposures); err != nil || len(exposures) != 0 {
+		t.Fatalf("alice should have no exposures: %+v %v", exposures, err)
+	}
+
+	// sync everything, then decrypt offline
+	synced := ctctl(t, "", with("sync", bob, "-since", "1h")...)
+	if err := json.Unmarshal([]byte(ctctl(t, synced, with("decrypt", bob)...)), &exposures); err != nil || len(exposures) != 1 {
+		t.Fatalf("decrypt: %+v %v", exposures, err)
+	}
+	var reports []api.CTReport
+	if err := json.Unmarshal([]byte(ctctl(t, "", with("query", bob, "-prefix", exposures[0].HashedPK)...)), &reports); err != nil || len(reports) != 1 {
+		t.Fatalf("query: %d %v", len(reports), err)
+	}
+
+	encoded := strings.TrimSpace(ctctl(t, "", "memo", "encode", "-type", "SELF_REPORTED", "-symptoms", "3"))
+	var decoded struct {
+		ReportType string                     `json:"reportType"`
+		Memo       *memopb.ContactTracingMemo `json:"memo"`
+	}
+	if err := json.Unmarshal([]byte(ctctl(t, "", "memo", "decode", encoded)), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ReportType != "SELF_REPORTED" || len(decoded.Memo.SymptomID) != 1 || decoded.Memo.SymptomID[0] != 3 {
+		t.Fatalf("unexpected memo %+v", decoded)
+	}
+}
+
+func TestCtctlHelp(t *testing.T) {
+	if out := ctctl(t, "", "query", "-h"); !strings.Contains(out, "-server") {
+		t.Fatalf("expected the query flags, got %q", out)
+	}
+}
+
+func TestCtctlErrors(t *testing.T) {
+	dir := t.TempDir()
+	keys := filepath.Join(dir, "keys.json")
+	for _, args := range [][]string{
+		{},
+		{"nope"},
+		{"keygen", "-keys", keys},
+		{"report", "-keys", keys, "-name", "missing", "-dry-run"},
+		{"encounter", "-keys", keys, "-name", "missing", "-peer", "00"},
+		{"memo", "encode", "-type", "bogus"},
+		{"memo", "decode", "zz"},
+		{"query", "-prefix", "0102"},
+		{"sync", "-since", "yesterday"},
+	} {
+		if err := run(context.Background(), args, strings.NewReader(""), &bytes.Buffer{}); err == nil {
+			t.Fatalf("expected error for %v", args)
+		}
+	}
+}
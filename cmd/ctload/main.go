@@ -0,0 +1,352 @@
+// Command ctload is a load generator for the contact tracing API.  It simulates a
+// population of devices with a BLE encounter graph; infected devices report their
+// encounters and every device polls for exposures by query (or sync) at a fixed
+// interval.  It prints latency percentiles, throughput and error rates per call,
+// and checks that every exposure was found.
+//
+//	ctload -devices 10000 -poll 10s -duration 5m                      # against an in-process server
+//	ctload -server https://api.wolk.com -devices 1000 -duration 1m    # against a deployment
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/backend/backendtest"
+	"github.com/wolkdb/contact-tracing-server/client"
+	"github.com/wolkdb/contact-tracing-server/server"
+)
+
+// options are the simulation parameters
+type options struct {
+	server        string
+	insecure      bool
+	devices       int
+	contacts      float64
+	household     int
+	strangers     float64
+	infectionRate float64
+	certified     float64
+	duration      time.Duration
+	poll          time.Duration
+	syncFraction  float64
+	connections   int
+	timeout       time.Duration
+	retries       int
+	interval      time.Duration
+	seed          int64
+	json          bool
+}
+
+func parseFlags(args []string, out io.Writer) (opts *options, err error) {
+	opts = new(options)
+	fs := flag.NewFlagSet("ctload", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&opts.server, "server", "", "API endpoint; empty starts an in-process server on the Bigtable emulator")
+	fs.BoolVar(&opts.insecure, "insecure", false, "skip verification of the server certificate")
+	fs.IntVar(&opts.devices, "devices", 1000, "number of simulated devices")
+	fs.Float64Var(&opts.contacts, "contacts", 10, "average encounters per device outside its household")
+	fs.IntVar(&opts.household, "household", 5, "maximum household size")
+	fs.Float64Var(&opts.strangers, "strangers", 0.2, "fraction of encounters with random devices rather than nearby ones")
+	fs.Float64Var(&opts.infectionRate, "infection-rate", 0.02, "fraction of devices that report during the run")
+	fs.Float64Var(&opts.certified, "certified", 0.5, "fraction of reports that are certified infections rather than self reported")
+	fs.DurationVar(&opts.duration, "duration", time.Minute, "length of the run")
+	fs.DurationVar(&opts.poll, "poll", 30*time.Second, "interval at which every device polls for exposures")
+	fs.Float64Var(&opts.syncFraction, "sync-fraction", 0.1, "fraction of polls that sync everything instead of querying prefixes")
+	fs.IntVar(&opts.connections, "connections", 100, "maximum idle HTTP connections to the server")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "timeout of a single request")
+	fs.IntVar(&opts.retries, "retries", 0, "retries of a failed request (retries hide errors and inflate latencies)")
+	fs.DurationVar(&opts.interval, "interval", 10*time.Second, "interval of progress reports; 0 disables them")
+	fs.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "seed of the encounter graph")
+	fs.BoolVar(&opts.json, "json", false, "print the final result as JSON")
+	if err = fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if opts.devices < 1 || opts.household < 1 || opts.duration <= 0 || opts.poll <= 0 {
+		return nil, fmt.Errorf("devices, household, duration and poll must be positive")
+	}
+	return opts, nil
+}
+
+// result is the outcome of a run
+type result struct {
+	Devices    int           `json:"devices"`
+	Encounters int           `json:"encounters"`
+	Reporters  int           `json:"reporters"`
+	Elapsed    time.Duration `json:"elapsed"`
+	Ops        []opSummary   `json:"ops"`
+
+	// Expected is the number of encounters whose peer reported, Detected the
+	// number of them found by the polls, including a final poll of every device
+	Expected int `json:"expected"`
+	Detected int `json:"detected"`
+}
+
+type simulation struct {
+	opts     *options
+	client   *client.Client
+	rec      *recorder
+	start    time.Time
+	mu       sync.Mutex
+	expected map[string]bool
+	detected map[string]bool
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	opts, err := parseFlags(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "ctload: %v\n", err)
+		os.Exit(2)
+	}
+	res, err := simulate(ctx, opts, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ctload: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+	} else {
+		fmt.Printf("\n%d devices, %d encounters, %d reporters in %v\n", res.Devices, res.Encounters, res.Reporters, res.Elapsed.Round(time.Millisecond))
+		printSummary(os.Stdout, res.Ops)
+		fmt.Printf("exposures detected: %d of %d\n", res.Detected, res.Expected)
+	}
+	if res.Detected != res.Expected {
+		os.Exit(1)
+	}
+}
+
+// startLocalServer serves the API on a loopback port backed by the Bigtable emulator
+func startLocalServer() (url string, stop func(), err error) {
+	b, closeBackend, err := backendtest.New(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	conf := server.DefaultConfig()
+	s, err := server.NewServer(&conf, b)
+	if err != nil {
+		closeBackend()
+		return "", nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		closeBackend()
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: s.Handler}
+	go srv.Serve(l)
+	return "http://" + l.Addr().String(), func() {
+		srv.Close()
+		closeBackend()
+	}, nil
+}
+
+// simulate builds the population and runs it against opts.server; progress
+// reports are written to out
+func simulate(ctx context.Context, opts *options, out io.Writer) (res *result, err error) {
+	if opts.server == "" {
+		url, stop, err := startLocalServer()
+		if err != nil {
+			return nil, err
+		}
+		defer stop()
+		opts.server = url
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.connections
+	transport.MaxIdleConnsPerHost = opts.connections
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: opts.insecure}
+	retries := opts.retries
+	if retries == 0 {
+		retries = -1
+	}
+	c, err := client.New(&client.Config{
+		BaseURL:    opts.server,
+		HTTPClient: &http.Client{Transport: transport, Timeout: opts.timeout},
+		MaxRetries: retries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := newPopulation(opts)
+	if err != nil {
+		return nil, err
+	}
+	res = &result{Devices: len(devices)}
+	for _, d := range devices {
+		res.Encounters += len(d.encounters)
+		if d.infectAt >= 0 {
+			res.Reporters++
+		}
+	}
+	res.Encounters /= 2
+	fmt.Fprintf(out, "simulating %d devices with %d encounters against %s for %v\n", res.Devices, res.Encounters, opts.server, opts.duration)
+
+	s := &simulation{
+		opts:     opts,
+		client:   c,
+		rec:      newRecorder(),
+		start:    time.Now(),
+		expected: make(map[string]bool),
+		detected: make(map[string]bool),
+	}
+	runCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			s.runDevice(runCtx, d)
+		}(d)
+	}
+	if opts.interval > 0 {
+		go s.progress(runCtx, out)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	// a last query of every device finds the exposures reported after its last poll
+	sem := make(chan struct{}, opts.connections)
+	for _, d := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d *device) {
+			defer wg.Done()
+			s.query(ctx, d, "final query", s.start)
+			<-sem
+		}(d)
+	}
+	wg.Wait()
+
+	res.Elapsed = time.Since(s.start)
+	res.Ops = s.rec.summary(res.Elapsed)
+	res.Expected, res.Detected = len(s.expected), 0
+	for hashedPK := range s.expected {
+		if s.detected[hashedPK] {
+			res.Detected++
+		}
+	}
+	return res, nil
+}
+
+func (s *simulation) progress(ctx context.Context, out io.Writer) {
+	ticker := time.NewTicker(s.opts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			elapsed := time.Since(s.start)
+			fmt.Fprintf(out, "\n%v\n", elapsed.Round(time.Second))
+			printSummary(out, s.rec.summary(elapsed))
+		}
+	}
+}
+
+// runDevice polls every opts.poll, starting at a random phase, and reports the
+// encounters of the device once its infection time has come
+func (s *simulation) runDevice(ctx context.Context, d *device) {
+	timer := time.NewTimer(time.Duration(d.rng.Int63n(int64(s.opts.poll))))
+	defer timer.Stop()
+	lastPoll := s.start
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if d.infectAt >= 0 && !d.reported && time.Since(s.start) >= d.infectAt {
+			s.report(ctx, d)
+		}
+		// since has a resolution of one second
+		pollStart := time.Now()
+		since := lastPoll.Add(-time.Second)
+		if d.rng.Float64() < s.opts.syncFraction {
+			s.sync(ctx, d, since)
+		} else {
+			s.query(ctx, d, "query", since)
+		}
+		lastPoll = pollStart
+		timer.Reset(s.opts.poll)
+	}
+}
+
+func (s *simulation) report(ctx context.Context, d *device) {
+	reports, err := client.MakeReports(d.encounters, d.memo)
+	if err == nil && len(reports) > 0 {
+		start := time.Now()
+		err = s.client.Report(ctx, reports)
+		if ctx.Err() != nil {
+			return
+		}
+		s.rec.record("report", start, len(reports), err)
+	}
+	if err != nil {
+		return
+	}
+	d.reported = true
+	s.mu.Lock()
+	for _, e := range d.encounters {
+		s.expected[string(api.Computehash(api.FromECDSAPub(e.PeerPublicKey)))] = true
+	}
+	s.mu.Unlock()
+}
+
+func (s *simulation) query(ctx context.Context, d *device, op string, since time.Time) {
+	if len(d.encounters) == 0 {
+		return
+	}
+	start := time.Now()
+	exposures, err := s.client.CheckExposures(ctx, d.encounters, since)
+	if ctx.Err() != nil {
+		return
+	}
+	s.rec.record(op, start, len(exposures), err)
+	s.mu.Lock()
+	for _, e := range exposures {
+		s.detected[string(e.Report.HashedPK)] = true
+	}
+	s.mu.Unlock()
+}
+
+// sync downloads every report received since and decrypts the ones addressed to d
+func (s *simulation) sync(ctx context.Context, d *device, since time.Time) {
+	start := time.Now()
+	reports, err := s.client.Sync(ctx, since)
+	if ctx.Err() != nil {
+		return
+	}
+	s.rec.record("sync", start, len(reports), err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, report := range reports {
+		e, ok := d.hashedPKs[string(report.HashedPK)]
+		if !ok {
+			continue
+		}
+		if _, err := client.DecryptReport(e, report); err == nil {
+			s.detected[string(report.HashedPK)] = true
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestPopulation(t *testing.T) {
+	opts, err := parseFlags([]string{"-devices", "200", "-contacts", "6", "-infection-rate", "0.5", "-seed", "1"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := newPopulation(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, reporters := 0, 0
+	for _, d := range devices {
+		total += len(d.encounters)
+		if d.infectAt >= 0 {
+			reporters++
+			if d.infectAt >= opts.duration || d.memo == nil {
+				t.Fatalf("device %d: bad infection %v %v", d.id, d.infectAt, d.memo)
+			}
+		}
+		if len(d.hashedPKs) != len(d.encounters) {
+			t.Fatalf("device %d: %d hashedPKs for %d encounters", d.id, len(d.hashedPKs), len(d.encounters))
+		}
+	}
+	// households add about 1.3 encounters per device on top of the contacts
+	if avg := float64(total) / float64(len(devices)); avg < 6 || avg > 9.5 {
+		t.Fatalf("unexpected average encounters %.1f", avg)
+	}
+	if reporters < 70 || reporters > 130 {
+		t.Fatalf("unexpected number of reporters %d", reporters)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	opts, err := parseFlags([]string{"-devices", "40", "-contacts", "4", "-infection-rate", "0.25", "-duration", "2s", "-poll", "300ms", "-sync-fraction", "0.3", "-interval", "0", "-seed", "2"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	res, err := simulate(context.Background(), opts, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < opts.duration {
+		t.Fatalf("simulation ended early")
+	}
+	if res.Reporters == 0 || res.Expected == 0 || res.Detected != res.Expected {
+		t.Fatalf("detected %d of %d exposures from %d reporters", res.Detected, res.Expected, res.Reporters)
+	}
+	ops := make(map[string]opSummary)
+	for _, op := range res.Ops {
+		ops[op.Op] = op
+		if op.Errors != 0 {
+			t.Fatalf("%s: %d errors, last %s", op.Op, op.Errors, op.LastError)
+		}
+		if op.P50 > op.P99 || op.P99 > op.Max {
+			t.Fatalf("%s: percentiles out of order %+v", op.Op, op)
+		}
+	}
+	for _, op := range []string{"report", "query", "sync", "final query"} {
+		if ops[op].Count == 0 {
+			t.Fatalf("no %s calls", op)
+		}
+	}
+	if ops["final query"].Count != res.Devices {
+		t.Fatalf("expected %d final queries, got %d", res.Devices, ops["final query"].Count)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/client"
+	"github.com/wolkdb/contact-tracing-server/memopb"
+)
+
+// neighbourhood is how far along the ring a local contact can be
+const neighbourhood = 50
+
+// device is one simulated phone
+type device struct {
+	id         int
+	rng        *rand.Rand
+	encounters []client.Encounter
+	hashedPKs  map[string]client.Encounter
+
+	// infectAt is the offset into the run at which the device reports its
+	// encounters; negative if it never does
+	infectAt time.Duration
+	memo     *memopb.ContactTracingMemo
+	reported bool
+}
+
+func (d *device) meet(e client.Encounter) {
+	d.encounters = append(d.encounters, e)
+	d.hashedPKs[string(e.HashedPK())] = e
+}
+
+// newPopulation builds the encounter graph of opts.devices devices.  Devices live
+// in households of 1 to opts.household members who all meet each other.  On top of
+// that every device has on average opts.contacts encounters, most of them with
+// devices nearby on a ring (co-workers, neighbours) and opts.strangers of them with
+// anyone, which gives the clustered small world graph BLE contacts tend to form.
+func newPopulation(opts *options) (devices []*device, err error) {
+	rng := rand.New(rand.NewSource(opts.seed))
+	devices = make([]*device, opts.devices)
+	for i := range devices {
+		devices[i] = &device{
+			id:        i,
+			rng:       rand.New(rand.NewSource(rng.Int63())),
+			hashedPKs: make(map[string]client.Encounter),
+			infectAt:  -1,
+		}
+	}
+
+	meet := func(a, b *device) error {
+		aPriv, err := client.NewEncounterKey()
+		if err != nil {
+			return err
+		}
+		bPriv, err := client.NewEncounterKey()
+		if err != nil {
+			return err
+		}
+		a.meet(client.Encounter{PrivateKey: aPriv, PeerPublicKey: &bPriv.PublicKey})
+		b.meet(client.Encounter{PrivateKey: bPriv, PeerPublicKey: &aPriv.PublicKey})
+		return nil
+	}
+
+	// households
+	for start := 0; start < len(devices); {
+		size := 1 + rng.Intn(opts.household)
+		if start+size > len(devices) {
+			size = len(devices) - start
+		}
+		for i := start; i < start+size; i++ {
+			for j := i + 1; j < start+size; j++ {
+				if err = meet(devices[i], devices[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		start += size
+	}
+
+	// every contact adds an encounter to both sides, so each device starts half of them
+	if len(devices) > 1 {
+		for i, d := range devices {
+			for k := poisson(rng, opts.contacts/2); k > 0; k-- {
+				var j int
+				if rng.Float64() < opts.strangers {
+					j = rng.Intn(len(devices))
+				} else {
+					j = i + rng.Intn(2*neighbourhood+1) - neighbourhood
+					j = (j%len(devices) + len(devices)) % len(devices)
+				}
+				if j == i {
+					continue
+				}
+				if err = meet(d, devices[j]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// infections, spread over the run
+	for _, d := range devices {
+		if rng.Float64() >= opts.infectionRate {
+			continue
+		}
+		d.infectAt = time.Duration(rng.Int63n(int64(opts.duration)))
+		d.memo = &memopb.ContactTracingMemo{ReportType: memopb.ContactTracingMemo_SELF_REPORTED, DiseaseID: 1}
+		if rng.Float64() < opts.certified {
+			d.memo.ReportType = memopb.ContactTracingMemo_CERTIFIED_INFECTION
+		}
+	}
+	return devices, nil
+}
+
+// poisson draws from a Poisson distribution with mean lambda (Knuth)
+func poisson(rng *rand.Rand, lambda float64) (k int) {
+	l := math.Exp(-lambda)
+	for p := rng.Float64(); p > l; p *= rng.Float64() {
+		k++
+	}
+	return k
+}
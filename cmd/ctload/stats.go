@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// recorder collects the latency and outcome of every API call
+type recorder struct {
+	mu  sync.Mutex
+	ops map[string]*opStats
+}
+
+type opStats struct {
+	latencies []time.Duration
+	errors    int
+	items     int
+	lastError string
+}
+
+// opSummary is the result for one kind of call
+type opSummary struct {
+	Op        string        `json:"op"`
+	Count     int           `json:"count"`
+	Errors    int           `json:"errors"`
+	ErrorRate float64       `json:"errorRate"`
+	Items     int           `json:"items"`
+	PerSecond float64       `json:"perSecond"`
+	P50       time.Duration `json:"p50"`
+	P90       time.Duration `json:"p90"`
+	P99       time.Duration `json:"p99"`
+	Max       time.Duration `json:"max"`
+	LastError string        `json:"lastError,omitempty"`
+}
+
+func newRecorder() *recorder {
+	return &recorder{ops: make(map[string]*opStats)}
+}
+
+// record adds a call started at start that moved items reports
+func (r *recorder) record(op string, start time.Time, items int, err error) {
+	latency := time.Since(start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.ops[op]
+	if !ok {
+		s = new(opStats)
+		r.ops[op] = s
+	}
+	s.latencies = append(s.latencies, latency)
+	s.items += items
+	if err != nil {
+		s.errors++
+		s.lastError = err.Error()
+	}
+}
+
+// summary returns the per call results, sorted by name; elapsed is used for the rates
+func (r *recorder) summary(elapsed time.Duration) (summaries []opSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for op, s := range r.ops {
+		latencies := append([]time.Duration(nil), s.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		summaries = append(summaries, opSummary{
+			Op:        op,
+			Count:     len(latencies),
+			Errors:    s.errors,
+			ErrorRate: float64(s.errors) / float64(len(latencies)),
+			Items:     s.items,
+			PerSecond: float64(len(latencies)) / elapsed.Seconds(),
+			P50:       percentile(latencies, 0.50),
+			P90:       percentile(latencies, 0.90),
+			P99:       percentile(latencies, 0.99),
+			Max:       latencies[len(latencies)-1],
+			LastError: s.lastError,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Op < summaries[j].Op })
+	return summaries
+}
+
+// percentile returns the nearest rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func printSummary(w io.Writer, summaries []opSummary) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcalls\tcalls/s\terrors\treports\tp50\tp90\tp99\tmax\t")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.2f%%\t%d\t%v\t%v\t%v\t%v\t\n", s.Op, s.Count, s.PerSecond, 100*s.ErrorRate, s.Items,
+			s.P50.Round(time.Microsecond), s.P90.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+	}
+	tw.Flush()
+	for _, s := range summaries {
+		if s.LastError != "" {
+			fmt.Fprintf(w, "last %s error: %s\n", s.Op, s.LastError)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Package config loads the server configuration.
+//
+// Settings are taken, in increasing order of precedence, from built-in defaults,
+// the JSON config file ($CTDIR/ct.conf, or -config / $CT_CONFIG), environment
+// variables and command line flags.  The config file may use the sections
+// "server" and "backend", or the older flat layout with the backend keys
+// (bigtableProject, bigtableInstance, ...) at the top level.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/federation"
+	"github.com/wolkdb/contact-tracing-server/logging"
+	"github.com/wolkdb/contact-tracing-server/server"
+	"github.com/wolkdb/contact-tracing-server/tracing"
+)
+
+const (
+	// FileName is the name of the config file in $CTDIR
+	FileName = "ct.conf"
+
+	defaultCTDir           = "/tmp"
+	defaultShutdownTimeout = 30
+
+	masked = "********"
+)
+
+// Config is the complete server configuration
+type Config struct {
+	Server     server.Config     `json:"server"`
+	Backend    backend.Config    `json:"backend"`
+	Federation federation.Config `json:"federation"`
+
+	LogLevel      string `json:"logLevel,omitempty"`
+	TraceExporter string `json:"traceExporter,omitempty"`
+	TraceFile     string `json:"traceFile,omitempty"`
+
+	// ShutdownTimeoutSeconds bounds how long in-flight requests may take to finish on SIGTERM
+	ShutdownTimeoutSeconds int64 `json:"shutdownTimeoutSeconds,omitempty"`
+
+	// File is the config file that was loaded, if any
+	File string `json:"-"`
+}
+
+// Default returns the configuration used when nothing else is set
+func Default() *Config {
+	return &Config{
+		Server: server.DefaultConfig(),
+		Backend: backend.Config{
+			TableName:         backend.DefaultTableName,
+			ColumnFamily:      backend.DefaultColumnFamily,
+			ThreadsPerRequest: backend.DefaultThreadsPerRequest,
+		},
+		Federation:             federation.DefaultConfig(),
+		LogLevel:               "info",
+		TraceExporter:          tracing.ExporterNone,
+		ShutdownTimeoutSeconds: defaultShutdownTimeout,
+	}
+}
+
+// Load builds the configuration from defaults, the config file, the environment
+// (read through getenv) and the command line args, then validates it
+func Load(args []string, getenv func(string) string) (conf *Config, err error) {
+	return LoadWith(args, getenv, nil)
+}
+
+// LoadWith is Load for commands with flags of their own, which extra defines
+// alongside the configuration flags
+func LoadWith(args []string, getenv func(string) string, extra func(fs *flag.FlagSet)) (conf *Config, err error) {
+	conf = Default()
+
+	fs := flag.NewFlagSet("contact-tracing", flag.ContinueOnError)
+	if extra != nil {
+		extra(fs)
+	}
+	configFile := fs.String("config", "", "config file (default $CT_CONFIG or $CTDIR/"+FileName+")")
+	port := fs.String("port", "", "HTTP port")
+	grpcPort := fs.String("grpc-port", "", "gRPC port (empty disables the gRPC API)")
+	sslDir := fs.String("ssldir", "", "directory holding the TLS key and certificate bundle")
+	project := fs.String("bigtable-project", "", "Bigtable project")
+	instance := fs.String("bigtable-instance", "", "Bigtable instance")
+	table := fs.String("table", "", "Bigtable table")
+	family := fs.String("column-family", "", "Bigtable column family")
+	threads := fs.Int("threads-per-request", 0, "concurrent Bigtable reads per query")
+	retention := fs.Int("retention-days", 0, "days of reports served by queries and syncs (0 keeps everything)")
+	indexMemory := fs.Int64("index-memory-bytes", 0, "memory budget of the prefix index (0 disables it)")
+	walDir := fs.String("wal-dir", "", "write-ahead log directory of the ingestion queue (empty writes reports synchronously)")
+	pubsub := fs.String("pubsub", "", "how reports reach subscribers: memory (this replica only) or bigtable (every replica)")
+	maxBody := fs.Int64("max-body-bytes", 0, "maximum request body size")
+	maxPrefixes := fs.Int("max-query-prefixes", 0, "maximum prefixes per query")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error")
+	traceExporter := fs.String("trace-exporter", "", "none, otlp, stdout or file")
+	traceFile := fs.String("trace-file", "", "file written by the file trace exporter")
+	if err = fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// config file: an explicitly named file must exist, the default one may not
+	conf.File = *configFile
+	if conf.File == "" {
+		conf.File = getenv("CT_CONFIG")
+	}
+	explicit := conf.File != ""
+	if !explicit {
+		ctdir := getenv("CTDIR")
+		if ctdir == "" {
+			ctdir = defaultCTDir
+		}
+		conf.File = filepath.Join(ctdir, FileName)
+	}
+	if err = conf.loadFile(conf.File); err != nil {
+		if explicit || !os.IsNotExist(err) {
+			return nil, fmt.Errorf("config file %s: %v", conf.File, err)
+		}
+		conf.File = ""
+	}
+
+	// environment
+	if err = conf.loadEnv(getenv); err != nil {
+		return nil, err
+	}
+
+	// flags
+	if set["port"] {
+		conf.Server.Port = *port
+	}
+	if set["grpc-port"] {
+		conf.Server.GRPCPort = *grpcPort
+	}
+	if set["ssldir"] {
+		conf.Server.SSLDir = *sslDir
+	}
+	if set["bigtable-project"] {
+		conf.Backend.BigtableProject = *project
+	}
+	if set["bigtable-instance"] {
+		conf.Backend.BigtableInstance = *instance
+	}
+	if set["table"] {
+		conf.Backend.TableName = *table
+	}
+	if set["column-family"] {
+		conf.Backend.ColumnFamily = *family
+	}
+	if set["threads-per-request"] {
+		conf.Backend.ThreadsPerRequest = *threads
+	}
+	if set["retention-days"] {
+		conf.Backend.RetentionDays = *retention
+	}
+	if set["index-memory-bytes"] {
+		conf.Backend.IndexMemoryBytes = *indexMemory
+	}
+	if set["wal-dir"] {
+		conf.Backend.WALDir = *walDir
+	}
+	if set["pubsub"] {
+		conf.Backend.PubSub = *pubsub
+	}
+	if set["max-body-bytes"] {
+		conf.Server.MaxBodyBytes = *maxBody
+	}
+	if set["max-query-prefixes"] {
+		conf.Server.MaxQueryPrefixes = *maxPrefixes
+	}
+	if set["log-level"] {
+		conf.LogLevel = *logLevel
+	}
+	if set["trace-exporter"] {
+		conf.TraceExporter = *traceExporter
+	}
+	if set["trace-file"] {
+		conf.TraceFile = *traceFile
+	}
+
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (conf *Config) loadFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	// older config files carry the backend keys at the top level
+	if err = json.Unmarshal(data, &conf.Backend); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, conf)
+}
+
+func (conf *Config) loadEnv(getenv func(string) string) (err error) {
+	for name, dst := range map[string]*string{
+		"PORT":              &conf.Server.Port,
+		"GRPC_PORT":         &conf.Server.GRPCPort,
+		"SSLDIR":            &conf.Server.SSLDir,
+		"MYSQL_CONN":        &conf.Backend.MysqlConn,
+		"BIGTABLE_PROJECT":  &conf.Backend.BigtableProject,
+		"BIGTABLE_INSTANCE": &conf.Backend.BigtableInstance,
+		"BIGTABLE_TABLE":    &conf.Backend.TableName,
+		"BIGTABLE_FAMILY":   &conf.Backend.ColumnFamily,
+		"LOG_LEVEL":         &conf.LogLevel,
+		"TRACE_EXPORTER":    &conf.TraceExporter,
+		"TRACE_FILE":        &conf.TraceFile,
+		"FEDERATION_REGION": &conf.Federation.Region,
+		"WAL_DIR":           &conf.Backend.WALDir,
+		"PUBSUB":            &conf.Backend.PubSub,
+	} {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	for name, dst := range map[string]*int{
+		"THREADS_PER_REQUEST": &conf.Backend.ThreadsPerRequest,
+		"RETENTION_DAYS":      &conf.Backend.RetentionDays,
+		"MAX_QUERY_PREFIXES":  &conf.Server.MaxQueryPrefixes,
+	} {
+		if v := getenv(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	for name, dst := range map[string]*int64{
+		"INDEX_MEMORY_BYTES": &conf.Backend.IndexMemoryBytes,
+		"MAX_BODY_BYTES":     &conf.Server.MaxBodyBytes,
+	} {
+		if v := getenv(name); v != "" {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the configuration is complete and consistent
+func (conf *Config) Validate() error {
+	port, err := strconv.Atoi(conf.Server.Port)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", conf.Server.Port)
+	}
+	if conf.Server.GRPCPort != "" {
+		grpcPort, err := strconv.Atoi(conf.Server.GRPCPort)
+		if err != nil || grpcPort <= 0 || grpcPort > 65535 {
+			return fmt.Errorf("invalid grpcPort %q", conf.Server.GRPCPort)
+		}
+		if grpcPort == port {
+			return fmt.Errorf("grpcPort must differ from port")
+		}
+	}
+	if conf.Server.SSLKeyFile == "" || conf.Server.CAFile == "" {
+		return fmt.Errorf("sslKeyFile and caFile must be set")
+	}
+	if conf.Server.ReadTimeoutSeconds <= 0 || conf.Server.WriteTimeoutSeconds <= 0 {
+		return fmt.Errorf("readTimeoutSeconds and writeTimeoutSeconds must be positive")
+	}
+	if conf.Server.MaxBodyBytes <= 0 {
+		return fmt.Errorf("maxBodyBytes must be positive")
+	}
+	if conf.Server.MaxQueryPrefixes <= 0 {
+		return fmt.Errorf("maxQueryPrefixes must be positive")
+	}
+	if conf.Backend.BigtableProject == "" || conf.Backend.BigtableInstance == "" {
+		return fmt.Errorf("bigtableProject and bigtableInstance must be set")
+	}
+	if conf.Backend.TableName == "" || conf.Backend.ColumnFamily == "" {
+		return fmt.Errorf("tableName and columnFamily must be set")
+	}
+	if conf.Backend.ThreadsPerRequest <= 0 {
+		return fmt.Errorf("threadsPerRequest must be positive")
+	}
+	if conf.Backend.RetentionDays < 0 {
+		return fmt.Errorf("retentionDays must not be negative")
+	}
+	if conf.Backend.IndexMemoryBytes < 0 || conf.Backend.IndexWindowSeconds < 0 || conf.Backend.IndexRefreshSeconds < 0 {
+		return fmt.Errorf("index settings must not be negative")
+	}
+	if conf.Backend.QueueMaxReports < 0 || conf.Backend.FlushBatchSize < 0 || conf.Backend.FlushIntervalMillis < 0 {
+		return fmt.Errorf("ingestion queue settings must not be negative")
+	}
+	switch conf.Backend.PubSub {
+	case "", backend.PubSubMemory, backend.PubSubBigtable:
+	default:
+		return fmt.Errorf("invalid pubsub %q: %s or %s", conf.Backend.PubSub, backend.PubSubMemory, backend.PubSubBigtable)
+	}
+	if conf.Backend.PubSubPollMillis < 0 {
+		return fmt.Errorf("pubsubPollMillis must not be negative")
+	}
+	if conf.Backend.IdempotencyWindowSeconds < 0 {
+		return fmt.Errorf("idempotencyWindowSeconds must not be negative")
+	}
+	if err := conf.Federation.Validate(); err != nil {
+		return err
+	}
+	if conf.ShutdownTimeoutSeconds <= 0 {
+		return fmt.Errorf("shutdownTimeoutSeconds must be positive")
+	}
+	if _, err := logging.ParseLevel(conf.LogLevel); err != nil {
+		return err
+	}
+	switch conf.TraceExporter {
+	case "", tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	case tracing.ExporterFile:
+		if conf.TraceFile == "" {
+			return fmt.Errorf("traceFile must be set for the file trace exporter")
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter %q", conf.TraceExporter)
+	}
+	return nil
+}
+
+// Masked returns a copy of the configuration with secrets replaced, safe to log
+func (conf *Config) Masked() *Config {
+	c := *conf
+	if c.Backend.MysqlConn != "" {
+		c.Backend.MysqlConn = masked
+	}
+	c.Federation = c.Federation.Masked(masked)
+	return &c
+}
+
+// String returns the masked configuration as JSON
+func (conf *Config) String() string {
+	b, err := json.Marshal(conf.Masked())
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// flat (older) layout plus a server section
+	data := `{"bigtableProject": "fileproject", "bigtableInstance": "fileinstance", "mysqlConn": "user:secret@tcp(db)/ct",
+		"server": {"port": "9000", "maxQueryPrefixes": 10}, "logLevel": "warn"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, FileName), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Load([]string{"-log-level", "debug"}, env(map[string]string{
+		"CTDIR":             dir,
+		"BIGTABLE_INSTANCE": "envinstance",
+		"LOG_LEVEL":         "error",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Backend.BigtableProject != "fileproject" {
+		t.Fatalf("file value not loaded: %s", conf.Backend.BigtableProject)
+	}
+	if conf.Backend.BigtableInstance != "envinstance" {
+		t.Fatalf("env did not override file: %s", conf.Backend.BigtableInstance)
+	}
+	if conf.LogLevel != "debug" {
+		t.Fatalf("flag did not override env: %s", conf.LogLevel)
+	}
+	if conf.Server.Port != "9000" || conf.Server.MaxQueryPrefixes != 10 {
+		t.Fatalf("server section not loaded: %+v", conf.Server)
+	}
+	if conf.Server.WriteTimeoutSeconds != 600 {
+		t.Fatalf("default lost: %+v", conf.Server)
+	}
+
+	s := conf.String()
+	if strings.Contains(s, "secret") {
+		t.Fatalf("secret not masked: %s", s)
+	}
+	if conf.Backend.MysqlConn == masked {
+		t.Fatalf("Masked modified the config")
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	ok := map[string]string{"CTDIR": "/nonexistent", "BIGTABLE_PROJECT": "p", "BIGTABLE_INSTANCE": "i"}
+	if _, err := Load(nil, env(ok)); err != nil {
+		t.Fatalf("missing default config file should be fine: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"-port", "http"},
+		{"-grpc-port", "grpc"},
+		{"-port", "9000", "-grpc-port", "9000"},
+		{"-threads-per-request", "0"},
+		{"-retention-days", "-1"},
+		{"-log-level", "loud"},
+		{"-trace-exporter", "file"},
+		{"-pubsub", "redis"},
+		{"-config", "/nonexistent/ct.conf"},
+	} {
+		if _, err := Load(args, env(ok)); err == nil {
+			t.Fatalf("%v: expected error", args)
+		}
+	}
+
+	if _, err := Load(nil, env(map[string]string{"CTDIR": "/nonexistent"})); err == nil {
+		t.Fatalf("expected error without Bigtable settings")
+	}
+	if _, err := Load(nil, env(map[string]string{"CTDIR": "/nonexistent", "BIGTABLE_PROJECT": "p", "BIGTABLE_INSTANCE": "i", "RETENTION_DAYS": "x"})); err == nil {
+		t.Fatalf("expected error for bad RETENTION_DAYS")
+	}
+}
+
+func TestLoadWith(t *testing.T) {
+	var out string
+	conf, err := LoadWith([]string{"-out", "reports.ctx", "-table", "reports2"}, env(map[string]string{"CTDIR": "/nonexistent", "BIGTABLE_PROJECT": "p", "BIGTABLE_INSTANCE": "i"}), func(fs *flag.FlagSet) {
+		fs.StringVar(&out, "out", "", "output file")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "reports.ctx" || conf.Backend.TableName != "reports2" {
+		t.Fatalf("unexpected out %q table %q", out, conf.Backend.TableName)
+	}
+}
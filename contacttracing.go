@@ -1,66 +1,122 @@
 package main
 
 import (
-	"encoding/json"
-	//"flag"
-	//"fmt"
-	"io/ioutil"
-	"log"
+	"context"
+	"flag"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/config"
+	"github.com/wolkdb/contact-tracing-server/federation"
+	"github.com/wolkdb/contact-tracing-server/logging"
 	"github.com/wolkdb/contact-tracing-server/server"
+	"github.com/wolkdb/contact-tracing-server/tracing"
 )
 
-const (
-	version        = "0.1"
-	configFileName = "ct.conf"
-	defaultCTDir   = "/tmp"
-)
+const version = "0.1"
 
 func main() {
-	ctdir := os.Getenv("CTDIR")
-	if ctdir == "" {
-		ctdir = defaultCTDir
+	if err := logging.Init(os.Getenv("LOG_LEVEL")); err != nil {
+		slog.Warn("Err - LOG_LEVEL", "err", err)
 	}
 
-	confFile := filepath.Join(ctdir, configFileName)
-	conf, err := loadConfig(confFile)
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && (args[0] == "init" || args[0] == "export" || args[0] == "import") {
+		command, args = args[0], args[1:]
+	}
+	var transfer transferFlags
+	conf, err := config.LoadWith(args, os.Getenv, func(fs *flag.FlagSet) {
+		if command == "export" || command == "import" {
+			transfer.register(fs, command)
+		}
+	})
 	if err != nil {
-		log.Printf("Err - loadConfig: %v\n", err)
+		fatal("Err - config", err)
 	}
-	log.Printf("conf %v", conf)
+	logging.Init(conf.LogLevel)
+	slog.Info("conf", "file", conf.File, "conf", conf.String())
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = server.DefaultPort
+	switch command {
+	// contact-tracing init [flags] creates the Bigtable table and column family and exits
+	case "init":
+		if err := backend.Provision(context.Background(), &conf.Backend); err != nil {
+			fatal("Err - init", err)
+		}
+		return
+	// contact-tracing export|import [-file f] [-key-file k] [flags] copies the reports to or from an export file
+	case "export":
+		if err := exportReports(context.Background(), &conf.Backend, &transfer); err != nil {
+			fatal("Err - export", err)
+		}
+		return
+	case "import":
+		if err := importReports(context.Background(), &conf.Backend, &transfer); err != nil {
+			fatal("Err - import", err)
+		}
+		return
 	}
 
-	backend, err := backend.NewBackend(conf)
+	shutdownTracing, err := tracing.Init(context.Background(), conf.TraceExporter, conf.TraceFile, version)
 	if err != nil {
+		fatal("Err - tracing", err)
 	}
-	//backend.Start()
-	s, err := server.NewServer(port, backend)
+	defer shutdownTracing(context.Background())
+
+	backend, err := backend.NewBackend(&conf.Backend)
 	if err != nil {
-		panic(err)
+		fatal("Err - NewBackend", err)
 	}
-	s.Start()
-	log.Printf("Contact Tracing Server v%s - Listening on port %s...\n", version, port)
-	for {
+	backend.Start()
+	s, err := server.NewServer(&conf.Server, backend)
+	if err != nil {
+		fatal("Err - NewServer", err)
 	}
-}
 
-func loadConfig(configFile string) (*backend.Config, error) {
-	conf := new(backend.Config)
-	jsonString, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return conf, err
+	// federation: serve our reports to the peers and pull theirs
+	pullCtx, stopPull := context.WithCancel(context.Background())
+	defer stopPull()
+	if conf.Federation.Enabled() {
+		s.Handle("/"+federation.EndpointReports, federation.NewHandler(&conf.Federation, backend))
+		puller, err := federation.NewPuller(&conf.Federation, backend, nil)
+		if err != nil {
+			fatal("Err - federation", err)
+		}
+		puller.Start(pullCtx)
+		slog.Info("Federation enabled", "region", conf.Federation.Region, "peers", len(conf.Federation.Peers))
 	}
 
-	err = json.Unmarshal(jsonString, conf)
-	if err != nil {
-		return conf, err
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Start()
+	}()
+	slog.Info("Contact Tracing Server - Listening", "version", version, "port", conf.Server.Port)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errCh:
+		fatal("Err - Start", err)
+	case sig := <-sigCh:
+		slog.Info("Received signal, shutting down", "signal", sig.String())
+	}
+	stopPull()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Error("Err - Shutdown", "err", err)
 	}
-	return conf, err
+	// reports still queued are written by the next run if this times out
+	if err := backend.Flush(ctx); err != nil {
+		slog.Error("Err - Flush", "err", err)
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
@@ -1,225 +1,668 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	//"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/wolkdb/contact-tracing-server/api"
 	"github.com/wolkdb/contact-tracing-server/backend"
 	"github.com/wolkdb/contact-tracing-server/server"
+	"github.com/wolkdb/contact-tracing-server/server/servertest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
-const endpoint = "api.wolk.com"
-
-// DefaultTransport contains all HTTP client operation parameters
-var DefaultTransport http.RoundTripper = &http.Transport{
-	Dial: (&net.Dialer{
-		// limits the time spent establishing a TCP connection (if a new one is needed)
-		Timeout:   120 * time.Second,
-		KeepAlive: 120 * time.Second, // 60 * time.Second,
-	}).Dial,
-	//MaxIdleConns: 5,
-	MaxIdleConnsPerHost: 25, // changed from 100 -> 25
-
-	// limits the time spent reading the headers of the response.
-	ResponseHeaderTimeout: 120 * time.Second,
-	IdleConnTimeout:       120 * time.Second, // 90 * time.Second,
-
-	// limits the time the client will wait between sending the request headers when including an Expect: 100-continue and receiving the go-ahead to send the body.
-	ExpectContinueTimeout: 1 * time.Second,
-
-	// limits the time spent performing the TLS handshake.
-	TLSHandshakeTimeout: 5 * time.Second,
+// newTestServer starts the API on an in-memory backend
+func newTestServer(t *testing.T) *httptest.Server {
+	ts, _, _ := newTestAPI(t)
+	return ts
 }
 
-func httppost(url string, body []byte) (result []byte, err error) {
-
-	httpclient := &http.Client{Timeout: time.Second * 120, Transport: DefaultTransport}
-	bodyReader := bytes.NewReader(body)
-	req, err := http.NewRequest(http.MethodPost, url, bodyReader)
+// newTestAPI starts the HTTP and gRPC APIs on an in-memory backend, the gRPC one on an
+// in-memory listener
+func newTestAPI(t *testing.T) (ts *httptest.Server, client server.ContactTracingClient, s *server.Server) {
+	conf := server.DefaultConfig()
+	conf.MaxQueryPrefixes = 1000
+	conf.MaxBodyBytes = 1 << 20
+	srv := servertest.New(t, &conf)
+	s = srv.API
+	lis := bufconn.Listen(1 << 20)
+	go s.ServeGRPC(lis)
+	conn, err := grpc.Dial("bufconn", grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
-		return result, fmt.Errorf("[ct_test:httppost] %s", err)
+		t.Fatal(err)
 	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return srv.Server, server.NewContactTracingClient(conn), s
+}
 
-	resp, err := httpclient.Do(req)
+func httpdo(method string, url string, body []byte) (status int, result []byte, err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
-		return result, fmt.Errorf("[ct_test:httppost] %s", err)
+		return 0, nil, fmt.Errorf("[ct_test:httpdo] %s", err)
 	}
-
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("[ct_test:httpdo] %s", err)
+	}
+	defer resp.Body.Close()
 	result, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return result, fmt.Errorf("[ct_test:httppost] %s", err)
+		return resp.StatusCode, nil, fmt.Errorf("[ct_test:httpdo] %s", err)
 	}
-	resp.Body.Close()
-
-	return result, nil
+	return resp.StatusCode, result, nil
 }
 
-func TestCTSimple(t *testing.T) {
-	/*
-		hostname, err := os.Hostname()
-		if err != nil {
-		}
-		localendpoint := fmt.Sprintf("%s.wolk.com:%s", hostname, server.DefaultPort)
-	*/
-	localendpoint := endpoint
-	timestamp := time.Now().Unix()
+func httppost(url string, body []byte) (result []byte, err error) {
+	status, result, err := httpdo(http.MethodPost, url, body)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("[ct_test:httppost] %d %s", status, result)
+	}
+	return result, err
+}
 
-	var reports []backend.CTReport
-	var hashKeys [][]byte
-	for i := 0; i < 10; i++ {
+func GenerateRandomReport(n int) (reports []backend.CTReport, hashKeys [][]byte) {
+	for i := 0; i < n; i++ {
 		key := make([]byte, 16)
+		msg := make([]byte, 128)
 		rand.Read(key)
-		hashKey := backend.Computehash(key)
+		hashKey := api.Computehash(key)
 		hashKeys = append(hashKeys, hashKey)
-		symptom := "sample symptom"
-
-		report := backend.CTReport{HashedPK: hashKey, EncodedMsg: []byte(symptom)}
+		rand.Read(msg)
+		report := backend.CTReport{HashedPK: hashKey, EncodedMsg: msg}
 		reports = append(reports, report)
 	}
+	return reports, hashKeys
+}
 
-	// Post CTReports to /report
+func postReports(t *testing.T, url string, reports []backend.CTReport) {
+	t.Helper()
 	ctReportJSON, err := json.Marshal(reports)
-	ctReportURL := fmt.Sprintf("https://%s/%s", localendpoint, server.EndpointCTReport)
-	fmt.Printf("\nPOST Report:\n curl -X POST \"%v\" -d '%v'\n", ctReportURL, string(ctReportJSON))
-	res, err := httppost(ctReportURL, ctReportJSON)
 	if err != nil {
-		t.Fatalf("EndpointCTReport: %s", err)
+		t.Fatal(err)
 	}
-	fmt.Printf("\nPOST Report Result:%s\n", res)
-
-	var prefixHashedKey []byte
-	sampleKey := hashKeys[3]
-	sampleKey2 := hashKeys[6]
-	prefixSampleKey := sampleKey[:3]
-	prefixSampleKey2 := sampleKey2[:3]
-	prefixHashedKey = append(prefixHashedKey, prefixSampleKey...)
-	prefixHashedKey = append(prefixHashedKey, prefixSampleKey2...)
-	/*
-	   prefixHashedKey = append(prefixHashedKey, sampleKey[0])
-	   prefixHashedKey = append(prefixHashedKey, sampleKey[1])
-	   prefixHashedKey = append(prefixHashedKey, (sampleKey[2]&0xC0)|(sampleKey2[0]&0xFC>>2))
-	   prefixHashedKey = append(prefixHashedKey, (sampleKey2[0]&03<<6)|(sampleKey2[1]&0xFC>>2))
-	   prefixHashedKey = append(prefixHashedKey, (sampleKey2[1]&03<<6)|(sampleKey2[2]&0xFC>>2))
-	*/
-	ctQueryUrl := fmt.Sprintf("https://%s/%s?since=%d", localendpoint, server.EndpointCTQuery, timestamp)
-	/*
-		prefixHashedKeyByte := base64.StdEncoding.EncodeToString(prefixHashedKey)
-		fmt.Printf("\nprefixHashedKey:%v\n", prefixHashedKey)
-		//b64.URLEncoding.DecodeString(uEnc)
-		fmt.Printf("\nPOST Query:\n curl -X POST \"%v\" --data-binary '%s'\n", ctQueryUrl, prefixHashedKeyByte)
-	*/
-
-	res, err = httppost(ctQueryUrl, prefixHashedKey)
+	res, err := httppost(fmt.Sprintf("%s/%s", url, api.EndpointCTReport), ctReportJSON)
 	if err != nil {
 		t.Fatalf("EndpointCTReport: %s", err)
 	}
-	fmt.Printf("\nPOST Query Result:%v\n", string(res))
+	var results []backend.ReportResult
+	if err = json.Unmarshal(res, &results); err != nil || len(results) != len(reports) {
+		t.Fatalf("EndpointCTReport: unexpected result %s", res)
+	}
+	for i, result := range results {
+		if result.Status != backend.ReportAccepted {
+			t.Fatalf("EndpointCTReport: report %d %s: %s", i, result.Status, result.Reason)
+		}
+	}
+}
 
-	var resultreport []*backend.CTReport
-	err = json.Unmarshal(res, &resultreport)
-	if err != nil {
-		t.Fatalf("EndpointCTReport(check1): %s", err)
+func decodeReports(t *testing.T, res []byte) (reports []backend.CTReport) {
+	t.Helper()
+	if err := json.Unmarshal(res, &reports); err != nil {
+		t.Fatalf("decode reports: %s (%s)", err, res)
 	}
-	fmt.Printf("\nPOST Query resultreport: %v\n", string(res))
-	for _, r := range resultreport {
-		if bytes.Compare(r.HashedPK, sampleKey) == 0 || bytes.Compare(r.HashedPK, sampleKey2) == 0 {
-			fmt.Println("ok")
-		} else {
-			fmt.Println("err")
+	return reports
+}
+
+// checkReports compares reports with expected, ignoring order
+func checkReports(t *testing.T, what string, reports []backend.CTReport, expected []backend.CTReport) {
+	t.Helper()
+	str := func(list []backend.CTReport) (out []string) {
+		for _, r := range list {
+			out = append(out, fmt.Sprintf("%x/%x", r.HashedPK, r.EncodedMsg))
+		}
+		sort.Strings(out)
+		return out
+	}
+	got, want := str(reports), str(expected)
+	if len(got) != len(want) {
+		t.Fatalf("%s: expected %d reports, got %d", what, len(want), len(got))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: expected %s, got %s", what, want[i], got[i])
 		}
 	}
 }
 
-func GenerateRandomReport(n int) (reports []backend.CTReport, hashKeys [][]byte) {
-	key := make([]byte, 16)
-	msg := make([]byte, 128)
-	for i := 0; i < n; i++ {
-		rand.Read(key)
-		hashKey := backend.Computehash(key)
-		hashKeys = append(hashKeys, hashKey)
-		rand.Read(msg)
-		report := backend.CTReport{HashedPK: hashKey, EncodedMsg: msg}
-		reports = append(reports, report)
+func TestCTSimple(t *testing.T) {
+	ts := newTestServer(t)
+	timestamp := time.Now().Unix()
+
+	reports, hashKeys := GenerateRandomReport(10)
+	postReports(t, ts.URL, reports)
+
+	var prefixHashedKey []byte
+	prefixHashedKey = append(prefixHashedKey, hashKeys[3][:3]...)
+	prefixHashedKey = append(prefixHashedKey, hashKeys[6][:3]...)
+	ctQueryUrl := fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTQuery, timestamp)
+	res, err := httppost(ctQueryUrl, prefixHashedKey)
+	if err != nil {
+		t.Fatalf("EndpointCTQuery: %s", err)
 	}
-	return reports, hashKeys
+	checkReports(t, "query", decodeReports(t, res), []backend.CTReport{reports[3], reports[6]})
+
+	// nothing was received after now
+	ctQueryUrl = fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTQuery, time.Now().Unix()+1)
+	res, err = httppost(ctQueryUrl, prefixHashedKey)
+	if err != nil {
+		t.Fatalf("EndpointCTQuery: %s", err)
+	}
+	checkReports(t, "query since now", decodeReports(t, res), nil)
+
+	ctSyncUrl := fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTSync, timestamp)
+	status, res, err := httpdo(http.MethodGet, ctSyncUrl, nil)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("EndpointCTSync: %d %s %v", status, res, err)
+	}
+	checkReports(t, "sync", decodeReports(t, res), reports)
 }
 
 func TestCTLong(t *testing.T) {
+	ts := newTestServer(t)
+	timeStart := time.Now()
+
 	var reports []backend.CTReport
 	var hashKeys [][]byte
-	key := make([]byte, 16)
-	msg := make([]byte, 128)
-	timeStart := time.Now()
 	for reportNum := 0; reportNum < 10; reportNum++ {
-		for i := 0; i < 100; i++ {
-			rand.Read(key)
-			hashKey := backend.Computehash(key)
-			hashKeys = append(hashKeys, hashKey)
-			rand.Read(msg)
-
-			report := backend.CTReport{HashedPK: hashKey, EncodedMsg: msg}
-			reports = append(reports, report)
-		}
-		ctReportJSON, err := json.Marshal(reports)
-		timeReportStart := time.Now()
-		ctReportURL := fmt.Sprintf("https://%s/%s", endpoint, server.EndpointCTReport)
-		_, err = httppost(ctReportURL, ctReportJSON)
-		//fmt.Printf("\nPOST Report:\n curl -X POST \"%v\" -d '%v'\n", ctReportURL, string(ctReportJSON))
-
-		fmt.Printf("request %d time %v\n", reportNum, time.Since(timeReportStart))
-		if err != nil {
-			t.Fatalf("EndpointCTReport: %s", err)
-		}
+		batch, keys := GenerateRandomReport(100)
+		postReports(t, ts.URL, batch)
+		reports = append(reports, batch...)
+		hashKeys = append(hashKeys, keys...)
 	}
-	fmt.Printf("request totaltime = %v\n", time.Since(timeStart))
 
-	queryTimeTotalStart := time.Now()
 	for queryNum := 0; queryNum < 10; queryNum++ {
 		var prefixHashedKey []byte
-		sampleKey := hashKeys[rand.Intn(100)]
-		sampleKey2 := hashKeys[rand.Intn(100)]
-		/*
-		   prefixHashedKey = append(prefixHashedKey, sampleKey[0])
-		   prefixHashedKey = append(prefixHashedKey, sampleKey[1])
-		   prefixHashedKey = append(prefixHashedKey, (sampleKey[2]&0xC0)|(sampleKey2[0]&0xFC>>2))
-		   prefixHashedKey = append(prefixHashedKey, (sampleKey2[0]&03<<6)|(sampleKey2[1]&0xFC>>2))
-		   prefixHashedKey = append(prefixHashedKey, (sampleKey2[1]&03<<6)|(sampleKey2[2]&0xFC>>2))
-		*/
-		prefixSampleKey := sampleKey[:3]
-		prefixSampleKey2 := sampleKey2[:3]
-		prefixHashedKey = append(prefixHashedKey, prefixSampleKey...)
-		prefixHashedKey = append(prefixHashedKey, prefixSampleKey2...)
-
-		queryTimeStart := time.Now()
-		ctQueryUrl := fmt.Sprintf("https://%s/%s?since=%d", endpoint, server.EndpointCTQuery, timeStart.Unix())
-		//fmt.Printf("\nPOST Query:\n curl -X POST \"%v\" --data-binary '%s'\n", ctQueryUrl, prefixHashedKey)
-
-		result, err := httppost(ctQueryUrl, prefixHashedKey)
-		fmt.Printf("query %d time %v\n", queryNum, time.Since(queryTimeStart))
+		queried := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			prefix := hashKeys[rand.Intn(len(reports))][:3]
+			prefixHashedKey = append(prefixHashedKey, prefix...)
+			queried[string(prefix)] = true
+		}
+		// every report stored under a queried prefix
+		var expected []backend.CTReport
+		for _, report := range reports {
+			if queried[string(report.HashedPK[:3])] {
+				expected = append(expected, report)
+			}
+		}
+		ctQueryUrl := fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTQuery, timeStart.Unix())
+		res, err := httppost(ctQueryUrl, prefixHashedKey)
 		if err != nil {
-			t.Fatalf("EndpointCTReport: %s", err)
+			t.Fatalf("EndpointCTQuery: %s", err)
 		}
+		checkReports(t, fmt.Sprintf("query %d", queryNum), decodeReports(t, res), expected)
+	}
 
-		var resultreport []*backend.CTReport
-		err = json.Unmarshal(result, &resultreport)
+	status, res, err := httpdo(http.MethodGet, fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTSync, timeStart.Unix()), nil)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("EndpointCTSync: %d %v", status, err)
+	}
+	checkReports(t, "sync", decodeReports(t, res), reports)
+}
+
+func TestCTErrors(t *testing.T) {
+	ts := newTestServer(t)
+	now := time.Now().Unix()
+	reportURL := fmt.Sprintf("%s/%s", ts.URL, api.EndpointCTReport)
+	queryURL := fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTQuery, now)
+	syncURL := fmt.Sprintf("%s/%s", ts.URL, api.EndpointCTSync)
+	psiURL := fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTPSI, now-3600)
+	psiClient, _ := backend.NewPSIClient([][]byte{api.Computehash([]byte("candidate"))})
+	offCurve := append([]byte{4}, make([]byte, backend.PSIPointSize-1)...)
+	offCurve[backend.PSIPointSize-1] = 1
+
+	for _, c := range []struct {
+		name   string
+		method string
+		url    string
+		body   []byte
+		status int
+	}{
+		{"report malformed JSON", http.MethodPost, reportURL, []byte("{not json"), http.StatusBadRequest},
+		{"report not a list", http.MethodPost, reportURL, []byte(`{"hashedPK": "AAAA"}`), http.StatusBadRequest},
+		{"report empty list", http.MethodPost, reportURL, []byte(`[]`), http.StatusBadRequest},
+		{"report short hashedPK", http.MethodPost, reportURL, []byte(`[{"hashedPK": "AAE=", "encodedMsg": "AA=="}]`), http.StatusBadRequest},
+		{"report too large", http.MethodPost, reportURL, make([]byte, 2<<20), http.StatusRequestEntityTooLarge},
+		{"query no since", http.MethodPost, fmt.Sprintf("%s/%s", ts.URL, api.EndpointCTQuery), []byte{1, 2, 3}, http.StatusBadRequest},
+		{"query bad since", http.MethodPost, fmt.Sprintf("%s/%s?since=yesterday", ts.URL, api.EndpointCTQuery), []byte{1, 2, 3}, http.StatusBadRequest},
+		{"query partial prefix", http.MethodPost, queryURL, []byte{1, 2, 3, 4}, http.StatusBadRequest},
+		{"query too many prefixes", http.MethodPost, queryURL, make([]byte, 3*1001), http.StatusBadRequest},
+		{"query empty", http.MethodPost, queryURL, nil, http.StatusOK},
+		{"sync no since", http.MethodGet, syncURL, nil, http.StatusBadRequest},
+		{"sync bad since", http.MethodGet, syncURL + "?since=x", nil, http.StatusBadRequest},
+		{"sync future since", http.MethodGet, fmt.Sprintf("%s?since=%d", syncURL, now+3600), nil, http.StatusBadRequest},
+		{"sync future since (ms)", http.MethodGet, fmt.Sprintf("%s?since=%d", syncURL, (now+3600)*1000), nil, http.StatusBadRequest},
+		{"sync negative since", http.MethodGet, syncURL + "?since=-1", nil, http.StatusBadRequest},
+		{"sync bad until", http.MethodGet, fmt.Sprintf("%s?since=%d&until=soon", syncURL, now), nil, http.StatusBadRequest},
+		{"sync until before since", http.MethodGet, fmt.Sprintf("%s?since=%d&until=%d", syncURL, now, now-60), nil, http.StatusBadRequest},
+		{"sync since and until (ms)", http.MethodGet, fmt.Sprintf("%s?since=%d&until=%d", syncURL, (now-60)*1000, now*1000+1), nil, http.StatusOK},
+		{"sync shard", http.MethodGet, fmt.Sprintf("%s?since=%d&prefix=a8/5", syncURL, now), nil, http.StatusOK},
+		{"sync bad shard", http.MethodGet, fmt.Sprintf("%s?since=%d&prefix=xyz", syncURL, now), nil, http.StatusBadRequest},
+		{"query until before since", http.MethodPost, queryURL + fmt.Sprintf("&until=%d", now), []byte{1, 2, 3}, http.StatusBadRequest},
+		{"psi", http.MethodPost, psiURL, psiClient.Query(), http.StatusOK},
+		{"psi partial point", http.MethodPost, psiURL, make([]byte, backend.PSIPointSize+1), http.StatusBadRequest},
+		{"psi off-curve point", http.MethodPost, psiURL, offCurve, http.StatusBadRequest},
+		{"healthz", http.MethodGet, fmt.Sprintf("%s/%s", ts.URL, server.EndpointHealthz), nil, http.StatusOK},
+	} {
+		status, res, err := httpdo(c.method, c.url, c.body)
 		if err != nil {
-			t.Fatalf("EndpointCTReport(check1): %s", err)
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if status != c.status {
+			t.Fatalf("%s: expected status %d, got %d (%s)", c.name, c.status, status, res)
 		}
-		for _, r := range resultreport {
-			if bytes.Compare(r.HashedPK, sampleKey) == 0 || bytes.Compare(r.HashedPK, sampleKey2) == 0 {
-				fmt.Println("ok")
-			} else {
-				fmt.Println("err")
+	}
+
+	// a result per report: the valid ones are stored, the others rejected with the reason
+	valid, _ := GenerateRandomReport(2)
+	mixed, _ := json.Marshal([]backend.CTReport{valid[0], {HashedPK: []byte{1}}, valid[1]})
+	status, res, err := httpdo(http.MethodPost, reportURL, mixed)
+	var results []backend.ReportResult
+	if err == nil {
+		err = json.Unmarshal(res, &results)
+	}
+	if err != nil || status != http.StatusOK || len(results) != 3 {
+		t.Fatalf("mixed report: %d %s %v", status, res, err)
+	}
+	for i, expected := range []string{backend.ReportAccepted, backend.ReportRejected, backend.ReportAccepted} {
+		if results[i].Status != expected {
+			t.Fatalf("mixed report %d: expected %s, got %+v", i, expected, results[i])
+		}
+	}
+	if results[1].Reason == "" {
+		t.Fatalf("rejected report without a reason")
+	}
+
+	// an empty query returns an empty list, not null
+	_, res, _ = httpdo(http.MethodPost, queryURL, nil)
+	if strings.TrimSpace(string(res)) != "[]" {
+		t.Fatalf("empty query returned %s", res)
+	}
+}
+
+func TestCTPSIRateLimit(t *testing.T) {
+	conf := server.DefaultConfig()
+	conf.MaxPSIPerClient = 2
+	ts := servertest.New(t, &conf)
+	psiURL := fmt.Sprintf("%s/%s?since=%d", ts.URL, api.EndpointCTPSI, time.Now().Unix()-3600)
+	psiClient, _ := backend.NewPSIClient([][]byte{api.Computehash([]byte("candidate"))})
+
+	// the epoch may turn between the queries, which resets the counts
+	limited := false
+	for i := 0; i < 2*conf.MaxPSIPerClient+1 && !limited; i++ {
+		req, _ := http.NewRequest(http.MethodPost, psiURL, bytes.NewReader(psiClient.Query()))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests && i >= conf.MaxPSIPerClient:
+			limited = resp.Header.Get("Retry-After") != ""
+		case resp.StatusCode != http.StatusOK:
+			t.Fatalf("query %d: status %d", i, resp.StatusCode)
+		}
+	}
+	if !limited {
+		t.Fatalf("expected the queries beyond %d per epoch to be answered 429 with Retry-After", conf.MaxPSIPerClient)
+	}
+}
+
+func TestCTIdempotency(t *testing.T) {
+	ts := newTestServer(t)
+	reportURL := fmt.Sprintf("%s/%s", ts.URL, api.EndpointCTReport)
+	submit := func(key string, body []byte) (status int, replayed string, result []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, reportURL, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(api.IdempotencyKeyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		result, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get(api.IdempotentReplayedHeader), result
+	}
+
+	reports, _ := GenerateRandomReport(2)
+	body, _ := json.Marshal([]backend.CTReport{reports[0], {HashedPK: []byte{1}}})
+	status, replayed, first := submit("submission-1", body)
+	if status != http.StatusOK || replayed != "" {
+		t.Fatalf("first submission: %d %q %s", status, replayed, first)
+	}
+	status, replayed, again := submit("submission-1", body)
+	if status != http.StatusOK || replayed != "true" || string(again) != string(first) {
+		t.Fatalf("repeated submission: %d %q %s, expected %s", status, replayed, again, first)
+	}
+
+	// the same key with another body is refused, another key is a new submission
+	other, _ := json.Marshal(reports[1:])
+	if status, _, result := submit("submission-1", other); status != http.StatusUnprocessableEntity {
+		t.Fatalf("reused key: %d %s", status, result)
+	}
+	if status, replayed, result := submit("submission-2", other); status != http.StatusOK || replayed != "" {
+		t.Fatalf("second submission: %d %q %s", status, replayed, result)
+	}
+	if status, _, _ := submit(strings.Repeat("k", backend.MaxIdempotencyKeyLength+1), other); status != http.StatusBadRequest {
+		t.Fatalf("long key: %d", status)
+	}
+}
+
+func TestCTSubscribe(t *testing.T) {
+	ts := newTestServer(t)
+	reports, _ := GenerateRandomReport(4)
+	subscribeURL := fmt.Sprintf("%s/%s?prefixes=%x,%x", ts.URL, api.EndpointCTSubscribe, reports[0].HashedPK[:3], reports[1].HashedPK[:3])
+
+	// Server-Sent Events
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, subscribeURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("subscribe: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewScanner(resp.Body)
+	events.Scan() // ": subscribed", the subscription is in place
+
+	// WebSocket
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(subscribeURL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the upgrade is answered once the subscription is in place
+	postReports(t, ts.URL, reports)
+
+	var pushed []backend.CTReport
+	var lastID string
+	for len(pushed) < 2 && events.Scan() {
+		line := events.Text()
+		if strings.HasPrefix(line, "id: ") {
+			lastID = strings.TrimPrefix(line, "id: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			var report backend.CTReport
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &report); err != nil {
+				t.Fatal(err)
 			}
+			pushed = append(pushed, report)
 		}
 	}
-	fmt.Printf("query total%v\n", time.Since(queryTimeTotalStart))
+	checkReports(t, "events", pushed, reports[:2])
+	if lastID == "" || lastID != fmt.Sprint(pushed[1].Timestamp) {
+		t.Fatalf("event id %q, report received at %d", lastID, pushed[1].Timestamp)
+	}
+	cancel()
+
+	pushed = nil
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(pushed) < 2 {
+		var report backend.CTReport
+		if err := conn.ReadJSON(&report); err != nil {
+			t.Fatal(err)
+		}
+		pushed = append(pushed, report)
+	}
+	checkReports(t, "websocket", pushed, reports[:2])
+
+	// resuming from the last event
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s?prefix=", ts.URL, api.EndpointCTSubscribe), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(api.LastEventIDHeader, fmt.Sprint(pushed[0].Timestamp))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	resumed := 0
+	for events = bufio.NewScanner(resp.Body); resumed < len(reports) && events.Scan(); {
+		if strings.HasPrefix(events.Text(), "data: ") {
+			resumed++
+		}
+	}
+	if resumed != len(reports) {
+		t.Fatalf("resumed with %d reports, expected %d", resumed, len(reports))
+	}
+	cancel()
+
+	for _, bad := range []string{"prefixes=abc", "prefixes=0102030405", "prefix=xyz", "prefixes=010203&prefix=a", "since=-1"} {
+		status, res, err := httpdo(http.MethodGet, fmt.Sprintf("%s/%s?%s", ts.URL, api.EndpointCTSubscribe, bad), nil)
+		if err != nil || status != http.StatusBadRequest {
+			t.Fatalf("%s: %d %s %v", bad, status, res, err)
+		}
+	}
+}
+
+// grpcReports converts the reports of a gRPC response
+func grpcReports(res []*server.Report) (reports []backend.CTReport) {
+	for _, report := range res {
+		reports = append(reports, backend.CTReport{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg, ID: report.Id, Timestamp: report.Timestamp})
+	}
+	return reports
+}
+
+func grpcRequest(reports []backend.CTReport) (req *server.ReportRequest) {
+	req = &server.ReportRequest{}
+	for _, report := range reports {
+		req.Reports = append(req.Reports, &server.Report{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg})
+	}
+	return req
+}
+
+func TestGRPCReportQuery(t *testing.T) {
+	ctx := context.Background()
+	ts, client, _ := newTestAPI(t)
+	since := time.Now()
+	reports, _ := GenerateRandomReport(4)
+
+	req := grpcRequest(append(reports[:2:2], backend.CTReport{HashedPK: []byte{1}}))
+	req.IdempotencyKey = "submission-1"
+	var header metadata.MD
+	resp, err := client.Report(metadata.AppendToOutgoingContext(ctx, "x-request-id", "grpc-1"), req, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 3 || resp.Results[0].Status != backend.ReportAccepted || resp.Results[2].Status != backend.ReportRejected || resp.Replayed {
+		t.Fatalf("Report: %v", resp)
+	}
+	if id := header.Get("x-request-id"); len(id) != 1 || id[0] != "grpc-1" {
+		t.Fatalf("request ID %v", id)
+	}
+	if resp, err = client.Report(ctx, req); err != nil || !resp.Replayed || len(resp.Results) != 3 {
+		t.Fatalf("repeated Report: %v %v", resp, err)
+	}
+	other := grpcRequest(reports[2:])
+	other.IdempotencyKey = req.IdempotencyKey
+	if _, err := client.Report(ctx, other); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("reused key: %v", err)
+	}
+	// HTTP and gRPC share the backend
+	postReports(t, ts.URL, reports[2:])
+
+	var prefixes []byte
+	for _, report := range reports {
+		prefixes = append(prefixes, report.HashedPK[:3]...)
+	}
+	res, err := client.Query(ctx, &server.QueryRequest{Prefixes: prefixes, Since: since.UnixNano() / int64(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := grpcReports(res.Reports)
+	checkReports(t, "Query", got, reports)
+	for _, report := range got {
+		if report.ID == "" || report.Timestamp < since.UnixNano()/int64(time.Millisecond) {
+			t.Fatalf("report without ID or timestamp: %+v", report)
+		}
+	}
+
+	for _, bad := range []*server.QueryRequest{
+		{Prefixes: prefixes[:4]},
+		{Prefixes: prefixes, Since: -1},
+		{Prefixes: prefixes, Since: 2000, Until: 1000},
+		{Prefixes: bytes.Repeat(prefixes[:3], 1001)},
+	} {
+		if _, err := client.Query(ctx, bad); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%v: %v", bad, err)
+		}
+	}
+	if _, err := client.Report(ctx, &server.ReportRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("no reports: %v", err)
+	}
+	// maxBodyBytes bounds the messages as the HTTP bodies
+	large := grpcRequest([]backend.CTReport{{HashedPK: reports[0].HashedPK, EncodedMsg: make([]byte, 2<<20)}})
+	if _, err := client.Report(ctx, large); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("message over maxBodyBytes: %v", err)
+	}
+}
+
+func TestGRPCSync(t *testing.T) {
+	ctx := context.Background()
+	_, client, _ := newTestAPI(t)
+	since := time.Now().UnixNano() / int64(time.Millisecond)
+	reports, _ := GenerateRandomReport(10)
+	for i := range reports {
+		reports[i].HashedPK[0] = byte(i * 0x10)
+	}
+	if _, err := client.Report(ctx, grpcRequest(reports)); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(req *server.SyncRequest) (reports []backend.CTReport, pages int, err error) {
+		stream, err := client.Sync(ctx, req)
+		if err != nil {
+			return nil, 0, err
+		}
+		for {
+			page, err := stream.Recv()
+			if err == io.EOF {
+				return reports, pages, nil
+			} else if err != nil {
+				return nil, 0, err
+			}
+			reports = append(reports, grpcReports(page.Reports)...)
+			pages++
+		}
+	}
+	got, pages, err := sync(&server.SyncRequest{Since: since, PageSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "Sync", got, reports)
+	if pages < 4 {
+		t.Fatalf("%d reports in %d pages of 3", len(got), pages)
+	}
+	got, _, err = sync(&server.SyncRequest{Since: since, Shard: "8/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReports(t, "Sync shard", got, reports[8:])
+
+	for _, bad := range []*server.SyncRequest{
+		{Since: since, Shard: "xyz"},
+		{Since: since, PageSize: -1},
+		{Since: since + int64(time.Hour/time.Millisecond)},
+	} {
+		if _, _, err := sync(bad); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%v: %v", bad, err)
+		}
+	}
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts, client, s := newTestAPI(t)
+	reports, _ := GenerateRandomReport(4)
+
+	stream, err := client.Subscribe(ctx, &server.SubscribeRequest{Prefixes: append(append([]byte{}, reports[0].HashedPK[:3]...), reports[1].HashedPK[:3]...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the headers are sent once the subscription is in place
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	postReports(t, ts.URL, reports)
+	var pushed []backend.CTReport
+	for len(pushed) < 2 {
+		res, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushed = append(pushed, grpcReports(res.Reports)...)
+	}
+	checkReports(t, "Subscribe", pushed, reports[:2])
+
+	// resuming from the first report
+	resumed, err := client.Subscribe(ctx, &server.SubscribeRequest{Since: pushed[0].Timestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed = nil
+	for len(pushed) < len(reports) {
+		res, err := resumed.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushed = append(pushed, grpcReports(res.Reports)...)
+	}
+	checkReports(t, "resumed", pushed, reports)
+
+	bad, err := client.Subscribe(ctx, &server.SubscribeRequest{Prefixes: reports[0].HashedPK[:3], Shard: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("prefixes and shard: %v", err)
+	}
+
+	// shutting down ends the subscriptions
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("after Shutdown: %v", err)
+	}
 }
@@ -0,0 +1,81 @@
+package federation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// PeerHeader names the requesting peer (our region, as the peer knows us)
+	PeerHeader = "X-CT-Peer"
+
+	// TimestampHeader is the unix time the request was signed at
+	TimestampHeader = "X-CT-Timestamp"
+
+	// SignatureHeader is the hex HMAC-SHA256, keyed by the peer secret, of the
+	// method, request URI and timestamp, one per line
+	SignatureHeader = "X-CT-Signature"
+
+	// maxClockSkew bounds the age of a signed request
+	maxClockSkew = 5 * time.Minute
+)
+
+func signature(secret string, method string, requestURI string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s", method, requestURI, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign adds the signature headers of region to req
+func sign(req *http.Request, region string, secret string, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(PeerHeader, region)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, signature(secret, req.Method, req.URL.RequestURI(), timestamp))
+}
+
+// authenticate returns the peer making r: the peer whose ClientCertCN is the common
+// name of the verified client certificate, or the peer named in PeerHeader whose
+// secret signed the request
+func (conf *Config) authenticate(r *http.Request, now time.Time) (*Peer, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range conf.Peers {
+			if conf.Peers[i].ClientCertCN != "" && conf.Peers[i].ClientCertCN == cn {
+				return &conf.Peers[i], nil
+			}
+		}
+	}
+
+	name := r.Header.Get(PeerHeader)
+	if name == "" {
+		return nil, fmt.Errorf("not a federation peer")
+	}
+	var peer *Peer
+	for i := range conf.Peers {
+		if conf.Peers[i].Name == name {
+			peer = &conf.Peers[i]
+		}
+	}
+	if peer == nil || peer.Secret == "" {
+		return nil, fmt.Errorf("unknown peer %q", name)
+	}
+	timestamp := r.Header.Get(TimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, fmt.Errorf("request signed %v from now", skew)
+	}
+	expected := signature(peer.Secret, r.Method, r.URL.RequestURI(), timestamp)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(SignatureHeader))) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return peer, nil
+}
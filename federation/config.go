@@ -0,0 +1,148 @@
+// Package federation exchanges reports between contact tracing servers of different
+// regions.  Every server serves the reports it received since a watermark to its
+// authenticated peers (GET /federation/reports) and pulls the new reports of the
+// peers it is configured to pull, storing them tagged with their origin region.
+package federation
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultPullIntervalSeconds = 60
+	defaultSettleSeconds       = 5
+	defaultPageSize            = 1000
+)
+
+// Config holds the federation settings; federation is off unless Region and Peers are set
+type Config struct {
+	// Region is the origin tag of the reports received by this server
+	Region string `json:"region,omitempty"`
+
+	Peers []Peer `json:"peers,omitempty"`
+
+	// PullIntervalSeconds is the time between pulls of a peer
+	PullIntervalSeconds int64 `json:"pullIntervalSeconds,omitempty"`
+
+	// SettleSeconds keeps the newest reports out of a pull, so writes in flight
+	// land before the watermark passes them
+	SettleSeconds int64 `json:"settleSeconds,omitempty"`
+
+	// PageSize is the number of reports requested per page of a pull
+	PageSize int `json:"pageSize,omitempty"`
+
+	// ClientCertFile and ClientKeyFile are presented to peers that authenticate by mTLS
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+
+	// PeerCAFile verifies the server certificates of the peers pulled, instead of the system roots
+	PeerCAFile string `json:"peerCAFile,omitempty"`
+}
+
+// Peer is another federated server
+type Peer struct {
+	// Name is the region of the peer, the origin tag of its reports
+	Name string `json:"name"`
+
+	// URL is the base URL of the peer; it is pulled only if set
+	URL string `json:"url,omitempty"`
+
+	// Secret signs our requests to the peer and verifies its requests to us
+	Secret string `json:"secret,omitempty"`
+
+	// ClientCertCN authenticates the peer by the common name of a verified client
+	// certificate (see the server clientCAFile setting) as an alternative to Secret
+	ClientCertCN string `json:"clientCertCN,omitempty"`
+
+	// AllowRegions are the origins of the reports the peer may pull from us;
+	// by default only our own region, so reports are not passed on
+	AllowRegions []string `json:"allowRegions,omitempty"`
+
+	// AcceptRegions are the origins of the reports we store when pulling the
+	// peer; by default only the peer's own region
+	AcceptRegions []string `json:"acceptRegions,omitempty"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		PullIntervalSeconds: defaultPullIntervalSeconds,
+		SettleSeconds:       defaultSettleSeconds,
+		PageSize:            defaultPageSize,
+	}
+}
+
+// Enabled reports whether this server takes part in a federation
+func (conf *Config) Enabled() bool {
+	return conf.Region != "" && len(conf.Peers) > 0
+}
+
+// Validate checks the federation settings
+func (conf *Config) Validate() error {
+	if len(conf.Peers) > 0 && conf.Region == "" {
+		return fmt.Errorf("federation peers need a region")
+	}
+	if conf.PullIntervalSeconds <= 0 || conf.SettleSeconds < 0 || conf.PageSize <= 0 {
+		return fmt.Errorf("federation pullIntervalSeconds and pageSize must be positive, settleSeconds not negative")
+	}
+	if (conf.ClientCertFile == "") != (conf.ClientKeyFile == "") {
+		return fmt.Errorf("federation clientCertFile and clientKeyFile must be set together")
+	}
+	names := make(map[string]bool)
+	for _, peer := range conf.Peers {
+		if peer.Name == "" || peer.Name == conf.Region || names[peer.Name] {
+			return fmt.Errorf("federation peer names must be set, unique and differ from the region: %q", peer.Name)
+		}
+		names[peer.Name] = true
+		if peer.Secret == "" && peer.ClientCertCN == "" {
+			return fmt.Errorf("federation peer %s: secret or clientCertCN must be set", peer.Name)
+		}
+		if peer.URL != "" && peer.Secret == "" && conf.ClientCertFile == "" {
+			return fmt.Errorf("federation peer %s: pulling needs a secret or a client certificate", peer.Name)
+		}
+	}
+	return nil
+}
+
+// Masked returns a copy of the settings with the peer secrets replaced
+func (conf Config) Masked(masked string) Config {
+	conf.Peers = append([]Peer(nil), conf.Peers...)
+	for i := range conf.Peers {
+		if conf.Peers[i].Secret != "" {
+			conf.Peers[i].Secret = masked
+		}
+	}
+	return conf
+}
+
+func (conf *Config) pullInterval() time.Duration {
+	return time.Duration(conf.PullIntervalSeconds) * time.Second
+}
+
+func (conf *Config) settle() time.Duration {
+	return time.Duration(conf.SettleSeconds) * time.Second
+}
+
+// allowRegions returns the origins peer may pull from us
+func (conf *Config) allowRegions(peer *Peer) map[string]bool {
+	return regionSet(peer.AllowRegions, conf.Region)
+}
+
+// acceptRegions returns the origins we store when pulling peer; never our own
+func (conf *Config) acceptRegions(peer *Peer) map[string]bool {
+	regions := regionSet(peer.AcceptRegions, peer.Name)
+	delete(regions, conf.Region)
+	return regions
+}
+
+func regionSet(regions []string, def string) map[string]bool {
+	set := make(map[string]bool)
+	for _, region := range regions {
+		set[region] = true
+	}
+	if len(set) == 0 {
+		set[def] = true
+	}
+	return set
+}
@@ -0,0 +1,243 @@
+package federation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/server/servertest"
+)
+
+// region is a federated server on an in-memory backend
+type region struct {
+	conf    *Config
+	backend *backend.Backend
+	url     string
+}
+
+func newRegion(t *testing.T, name string) *region {
+	conf := DefaultConfig()
+	conf.Region = name
+	conf.SettleSeconds = 0
+	conf.PageSize = 3
+	ts := servertest.New(t, nil)
+	ts.API.Handle("/"+EndpointReports, NewHandler(&conf, ts.Backend))
+	return &region{conf: &conf, backend: ts.Backend, url: ts.URL}
+}
+
+// peer makes r and other peers sharing secret; r pulls other
+func (r *region) peer(other *region, secret string) {
+	r.conf.Peers = append(r.conf.Peers, Peer{Name: other.conf.Region, URL: other.url, Secret: secret})
+}
+
+func (r *region) pull(t *testing.T, from *region) int {
+	t.Helper()
+	p, err := NewPuller(r.conf, r.backend, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := p.Pull(context.Background(), from.conf.Region)
+	if err != nil {
+		t.Fatalf("%s pulling %s: %v", r.conf.Region, from.conf.Region, err)
+	}
+	return n
+}
+
+func randomReports(n int) (reports []backend.CTReport) {
+	for i := 0; i < n; i++ {
+		key := make([]byte, 16)
+		rand.Read(key)
+		reports = append(reports, backend.CTReport{HashedPK: api.Computehash(key), EncodedMsg: []byte("symptom " + strconv.Itoa(i))})
+	}
+	return reports
+}
+
+// origins returns the origin of every report r serves, by EncodedMsg
+func (r *region) origins(t *testing.T) map[string]string {
+	t.Helper()
+	time.Sleep(2 * time.Millisecond)
+	reports, _, _, err := r.backend.FederationPage(context.Background(), 0, "", 1000000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := make(map[string]string)
+	for _, report := range reports {
+		origins[string(report.HashedPK)+string(report.EncodedMsg)] = report.Origin
+	}
+	return origins
+}
+
+func key(report backend.CTReport) string {
+	return string(report.HashedPK) + string(report.EncodedMsg)
+}
+
+func TestFederationPull(t *testing.T) {
+	ctx := context.Background()
+	us, eu, ca := newRegion(t, "us"), newRegion(t, "eu"), newRegion(t, "ca")
+	us.peer(eu, "us-eu")
+	eu.peer(us, "us-eu")
+	us.peer(ca, "us-ca")
+	ca.peer(us, "us-ca")
+
+	usReports, caReports := randomReports(7), randomReports(4)
+	if err := us.backend.ProcessReport(ctx, usReports); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.backend.ProcessReport(ctx, caReports); err != nil {
+		t.Fatal(err)
+	}
+	// a pull window ends before the current millisecond
+	time.Sleep(2 * time.Millisecond)
+
+	if n := us.pull(t, ca); n != len(caReports) {
+		t.Fatalf("us stored %d reports from ca, expected %d", n, len(caReports))
+	}
+	// by default us only passes on its own reports
+	if n := eu.pull(t, us); n != len(usReports) {
+		t.Fatalf("eu stored %d reports from us, expected %d", n, len(usReports))
+	}
+	origins := eu.origins(t)
+	for _, report := range usReports {
+		if origins[key(report)] != "us" {
+			t.Fatalf("report from us stored with origin %q", origins[key(report)])
+		}
+	}
+	if len(origins) != len(usReports) {
+		t.Fatalf("eu has %d reports, expected %d", len(origins), len(usReports))
+	}
+
+	// devices in eu find the reports from us
+	since := time.Now().Add(-time.Minute).Unix()
+	got, err := eu.backend.ProcessQuery(ctx, usReports[0].HashedPK[:3], since)
+	if err != nil || len(got) == 0 {
+		t.Fatalf("query in eu: %d reports, err %v", len(got), err)
+	}
+
+	// the watermark moved on: nothing new
+	if n := eu.pull(t, us); n != 0 {
+		t.Fatalf("second pull stored %d reports", n)
+	}
+	watermark, err := eu.backend.FederationWatermark(ctx, "us")
+	if err != nil || watermark <= 0 {
+		t.Fatalf("watermark %d, err %v", watermark, err)
+	}
+	// us never gets its own reports back
+	if n := us.pull(t, eu); n != 0 {
+		t.Fatalf("us stored %d of its own reports", n)
+	}
+
+	// us allows eu the reports from ca, eu accepts them: the ca reports arrive once,
+	// the us reports are not stored again
+	us.conf.Peers[0].AllowRegions = []string{"us", "ca"}
+	eu.conf.Peers[0].AcceptRegions = []string{"us", "ca"}
+	if err = eu.backend.SetFederationWatermark(ctx, "us", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if n := eu.pull(t, us); n != len(caReports) {
+		t.Fatalf("eu stored %d reports from ca via us, expected %d", n, len(caReports))
+	}
+	origins = eu.origins(t)
+	for _, report := range caReports {
+		if origins[key(report)] != "ca" {
+			t.Fatalf("report from ca stored with origin %q", origins[key(report)])
+		}
+	}
+
+	// new reports after the watermark
+	more := randomReports(2)
+	if err := us.backend.ProcessReport(ctx, more); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if n := eu.pull(t, us); n != len(more) {
+		t.Fatalf("eu stored %d new reports, expected %d", n, len(more))
+	}
+}
+
+func TestFederationAuth(t *testing.T) {
+	us, eu := newRegion(t, "us"), newRegion(t, "eu")
+	us.peer(eu, "secret")
+	url := us.url + "/" + EndpointReports + "?since=0"
+
+	get := func(modify func(req *http.Request)) int {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modify(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for name, tc := range map[string]struct {
+		modify func(req *http.Request)
+		status int
+	}{
+		"signed":       {func(req *http.Request) { sign(req, "eu", "secret", time.Now()) }, http.StatusOK},
+		"unsigned":     {func(req *http.Request) {}, http.StatusUnauthorized},
+		"wrong secret": {func(req *http.Request) { sign(req, "eu", "guess", time.Now()) }, http.StatusUnauthorized},
+		"unknown peer": {func(req *http.Request) { sign(req, "mars", "secret", time.Now()) }, http.StatusUnauthorized},
+		"stale":        {func(req *http.Request) { sign(req, "eu", "secret", time.Now().Add(-time.Hour)) }, http.StatusUnauthorized},
+		"tampered": {func(req *http.Request) {
+			sign(req, "eu", "secret", time.Now())
+			req.URL.RawQuery = "since=1"
+		}, http.StatusUnauthorized},
+	} {
+		if status := get(tc.modify); status != tc.status {
+			t.Fatalf("%s: status %d, expected %d", name, status, tc.status)
+		}
+	}
+
+	// mTLS: a verified client certificate with the peer's common name
+	conf := &Config{Region: "us", Peers: []Peer{{Name: "eu", ClientCertCN: "ct.eu.example"}}}
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ct.eu.example"}}}}}
+	if peer, err := conf.authenticate(req, time.Now()); err != nil || peer.Name != "eu" {
+		t.Fatalf("mTLS: %v %v", peer, err)
+	}
+	req.TLS.VerifiedChains[0][0].Subject.CommonName = "ct.mars.example"
+	if _, err := conf.authenticate(req, time.Now()); err == nil {
+		t.Fatalf("expected error for an unknown certificate")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.Region = "us"
+	valid.Peers = []Peer{{Name: "eu", URL: "https://eu.example", Secret: "s"}}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, modify := range map[string]func(c *Config){
+		"no region":      func(c *Config) { c.Region = "" },
+		"self peer":      func(c *Config) { c.Peers[0].Name = "us" },
+		"duplicate peer": func(c *Config) { c.Peers = append(c.Peers, c.Peers[0]) },
+		"no credentials": func(c *Config) { c.Peers[0].Secret = "" },
+		"pull by cert":   func(c *Config) { c.Peers[0].Secret, c.Peers[0].ClientCertCN = "", "eu" },
+		"half cert":      func(c *Config) { c.ClientCertFile = "cert.pem" },
+		"no interval":    func(c *Config) { c.PullIntervalSeconds = 0 },
+	} {
+		c := valid
+		c.Peers = append([]Peer(nil), valid.Peers...)
+		modify(&c)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	if masked := valid.Masked("***"); masked.Peers[0].Secret != "***" || valid.Peers[0].Secret != "s" {
+		t.Fatalf("Masked must replace the secret of a copy")
+	}
+}
@@ -0,0 +1,103 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+// EndpointReports is the path of the reports served to peers
+const EndpointReports = "federation/reports"
+
+// Store is the part of the backend used by federation
+type Store interface {
+	FederationPage(ctx context.Context, since int64, cursor string, limit int, settle time.Duration) (reports []backend.FederatedReport, next string, windowEnd int64, err error)
+	StoreFederated(ctx context.Context, reports []backend.FederatedReport) (stored int, err error)
+	FederationWatermark(ctx context.Context, peer string) (watermark int64, err error)
+	SetFederationWatermark(ctx context.Context, peer string, watermark int64) error
+}
+
+// Page is the response of GET /federation/reports
+type Page struct {
+	Reports []backend.FederatedReport `json:"reports"`
+
+	// Next is the cursor of the following page, "" on the last page
+	Next string `json:"next,omitempty"`
+
+	// WindowEnd (microseconds) is the since of the next pull once the last page is read
+	WindowEnd int64 `json:"windowEnd"`
+}
+
+type handler struct {
+	conf  *Config
+	store Store
+}
+
+// NewHandler serves GET /federation/reports?since=<microseconds>[&cursor=c][&limit=n]
+// to authenticated peers
+func NewHandler(conf *Config, store Store) http.Handler {
+	return &handler{conf: conf, store: store}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	peer, err := h.conf.authenticate(r, time.Now())
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("federation: unauthorized", "remote", r.RemoteAddr, "err", err)
+		peerRequests.WithLabelValues("unauthorized").Inc()
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	peerRequests.WithLabelValues(peer.Name).Inc()
+
+	q := r.URL.Query()
+	since, err := strconv.ParseInt(q.Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	limit := h.conf.PageSize
+	if str := q.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	reports, next, windowEnd, err := h.store.FederationPage(r.Context(), since, q.Get("cursor"), limit, h.conf.settle())
+	if errors.Is(err, backend.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	allowed := h.conf.allowRegions(peer)
+	page := Page{Reports: []backend.FederatedReport{}, Next: next, WindowEnd: windowEnd}
+	for _, report := range reports {
+		if report.Origin == "" {
+			report.Origin = h.conf.Region
+		}
+		// never send a peer its own reports back
+		if allowed[report.Origin] && report.Origin != peer.Name {
+			page.Reports = append(page.Reports, report)
+		}
+	}
+	reportsServed.WithLabelValues(peer.Name).Add(float64(len(page.Reports)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,33 @@
+package federation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	peerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_federation_requests_total",
+		Help: "Number of federation requests served, by peer (or unauthorized).",
+	}, []string{"peer"})
+
+	reportsServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_federation_reports_served_total",
+		Help: "Number of reports served to federation peers.",
+	}, []string{"peer"})
+
+	reportsPulled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_federation_reports_pulled_total",
+		Help: "Number of new reports stored from federation peers.",
+	}, []string{"peer"})
+
+	pullErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_federation_pull_errors_total",
+		Help: "Number of failed pulls of federation peers.",
+	}, []string{"peer"})
+
+	watermarkSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "contact_tracing_federation_watermark_seconds",
+		Help: "Unix time up to which the reports of a federation peer have been pulled.",
+	}, []string{"peer"})
+)
@@ -0,0 +1,166 @@
+package federation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+// Puller pulls the new reports of the peers with a URL into the store
+type Puller struct {
+	conf   *Config
+	store  Store
+	client *http.Client
+}
+
+// NewPuller returns a Puller; client may be nil to use one built from the
+// ClientCertFile, ClientKeyFile and PeerCAFile settings
+func NewPuller(conf *Config, store Store, client *http.Client) (p *Puller, err error) {
+	if client == nil {
+		tlsConfig := &tls.Config{}
+		if conf.ClientCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(conf.ClientCertFile, conf.ClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("federation client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if conf.PeerCAFile != "" {
+			pem, err := ioutil.ReadFile(conf.PeerCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", conf.PeerCAFile)
+			}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: transport, Timeout: 2 * time.Minute}
+	}
+	return &Puller{conf: conf, store: store, client: client}, nil
+}
+
+// Start pulls every peer with a URL every PullIntervalSeconds until ctx is done
+func (p *Puller) Start(ctx context.Context) {
+	for i := range p.conf.Peers {
+		if p.conf.Peers[i].URL == "" {
+			continue
+		}
+		go p.loop(ctx, &p.conf.Peers[i])
+	}
+}
+
+func (p *Puller) loop(ctx context.Context, peer *Peer) {
+	ticker := time.NewTicker(p.conf.pullInterval())
+	defer ticker.Stop()
+	logger := logging.FromContext(ctx).With("peer", peer.Name)
+	for {
+		n, err := p.Pull(ctx, peer.Name)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("federation pull", "stored", n, "err", err)
+		} else if n > 0 {
+			logger.Info("federation pull", "stored", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pull reads the reports the named peer received since its watermark, stores the
+// ones from accepted regions and advances the watermark.  It returns the number of
+// new reports stored; the watermark only moves once every page was stored, so a
+// failed pull is repeated in full.
+func (p *Puller) Pull(ctx context.Context, name string) (stored int, err error) {
+	var peer *Peer
+	for i := range p.conf.Peers {
+		if p.conf.Peers[i].Name == name {
+			peer = &p.conf.Peers[i]
+		}
+	}
+	if peer == nil || peer.URL == "" {
+		return 0, fmt.Errorf("no peer %q to pull", name)
+	}
+	defer func() {
+		if err != nil {
+			pullErrors.WithLabelValues(peer.Name).Inc()
+		}
+	}()
+	watermark, err := p.store.FederationWatermark(ctx, peer.Name)
+	if err != nil {
+		return 0, err
+	}
+	accepted := p.conf.acceptRegions(peer)
+	cursor := ""
+	for {
+		page, err := p.fetch(ctx, peer, watermark, cursor)
+		if err != nil {
+			return stored, err
+		}
+		var reports []backend.FederatedReport
+		for _, report := range page.Reports {
+			if accepted[report.Origin] && len(report.HashedPK) >= backend.PrefixSize {
+				reports = append(reports, report)
+			}
+		}
+		n, err := p.store.StoreFederated(ctx, reports)
+		stored += n
+		reportsPulled.WithLabelValues(peer.Name).Add(float64(n))
+		if err != nil {
+			return stored, err
+		}
+		if page.Next == "" {
+			if page.WindowEnd > watermark {
+				if err = p.store.SetFederationWatermark(ctx, peer.Name, page.WindowEnd); err != nil {
+					return stored, err
+				}
+				watermarkSeconds.WithLabelValues(peer.Name).Set(float64(page.WindowEnd) / 1e6)
+			}
+			return stored, nil
+		}
+		cursor = page.Next
+	}
+}
+
+func (p *Puller) fetch(ctx context.Context, peer *Peer, since int64, cursor string) (page *Page, err error) {
+	params := url.Values{"since": {strconv.FormatInt(since, 10)}, "limit": {strconv.Itoa(p.conf.PageSize)}}
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(peer.URL, "/")+"/"+EndpointReports+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if peer.Secret != "" {
+		sign(req, p.conf.Region, peer.Secret, time.Now())
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %d %s", peer.Name, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	page = new(Page)
+	if err = json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, fmt.Errorf("%s: decode page: %v", peer.Name, err)
+	}
+	return page, nil
+}
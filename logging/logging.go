@@ -0,0 +1,84 @@
+// Package logging sets up the structured JSON logger used by the server and backend.
+//
+// Redaction policy: report contents (EncodedMsg), hashed public keys and prefixes
+// are never logged.  Any []byte attribute is replaced by its length, so passing
+// raw report data to a logger cannot leak it.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type ctxKey struct{}
+
+// RequestIDHeader is the HTTP header carrying the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// ParseLevel maps debug, info, warn or error to a slog level
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+}
+
+// New returns a JSON logger writing to w at level with the redaction policy applied
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}))
+}
+
+// Init installs the JSON logger on stderr as the default logger (also used by the log package)
+func Init(level string) error {
+	lvl, err := ParseLevel(level)
+	slog.SetDefault(New(os.Stderr, lvl))
+	return err
+}
+
+// redact replaces raw bytes with their length
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindAny {
+		return a
+	}
+	if b, ok := a.Value.Any().([]byte); ok {
+		return slog.String(a.Key, fmt.Sprintf("[redacted %d bytes]", len(b)))
+	}
+	return a
+}
+
+// NewRequestID returns a random request ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// WithLogger returns a context carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// FromContext returns the logger of ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
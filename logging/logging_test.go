@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+	hashedPK := []byte("0123456789abcdef0123456789abcdef")
+	logger.Info("report", "hashedPK", hashedPK, "reports", 3)
+	logger.Debug("hidden at info level")
+
+	out := buf.String()
+	if strings.Contains(out, "0123456789abcdef") || strings.Contains(out, "MDEyMzQ1") {
+		t.Fatalf("raw bytes leaked into log: %s", out)
+	}
+	if !strings.Contains(out, `"hashedPK":"[redacted 32 bytes]"`) || !strings.Contains(out, `"reports":3`) {
+		t.Fatalf("unexpected log output: %s", out)
+	}
+	if strings.Contains(out, "hidden") {
+		t.Fatalf("debug message logged at info level: %s", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if lvl, err := ParseLevel("DEBUG"); err != nil || lvl != slog.LevelDebug {
+		t.Fatalf("ParseLevel(DEBUG) = %v, %v", lvl, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatalf("expected error for unknown level")
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := NewStatusRecorder(w)
+	if rec.Status != http.StatusOK {
+		t.Fatalf("expected 200 before WriteHeader, got %d", rec.Status)
+	}
+	rec.WriteHeader(http.StatusNotFound)
+	if rec.Status != http.StatusNotFound || w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d and %d", rec.Status, w.Code)
+	}
+	if http.NewResponseController(rec).Flush() != nil || !w.Flushed {
+		t.Fatalf("expected Flush to reach the writer")
+	}
+	if NewStatusRecorder(rec) != rec {
+		t.Fatalf("expected a recorder to be reused, not wrapped again")
+	}
+}
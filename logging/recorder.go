@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// StatusRecorder remembers the status code written by a handler, for the middlewares
+// that log, count or trace requests
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+// NewStatusRecorder wraps w; the status is 200 until the handler writes another.
+// A w that already is a StatusRecorder (of an outer middleware) is returned as is,
+// so a request is only wrapped once.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	if rec, ok := w.(*StatusRecorder); ok {
+		return rec
+	}
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the flushing and deadlines of the writer
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades through
+func (r *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
@@ -1,7 +1,7 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // source: contactTracingMemo.proto
 
-package backend
+package memopb
 
 import (
 	fmt "fmt"
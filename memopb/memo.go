@@ -0,0 +1,26 @@
+// Package memopb holds the ContactTracingMemo carried, encrypted, in the EncodedMsg of reports.
+package memopb
+
+import (
+	"log"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func (m *ContactTracingMemo) Bytes() (mbyte []byte) {
+	mByte, err := proto.Marshal(m)
+	if err != nil {
+		log.Fatal("marshaling error: ", err)
+		return nil
+	}
+	return mByte
+}
+
+func ByteToContactTracingMemo(mbyte []byte) (m *ContactTracingMemo) {
+	m = &ContactTracingMemo{}
+	err := proto.Unmarshal(mbyte, m)
+	if err != nil {
+		log.Fatal("unmarshaling error: ", err)
+	}
+	return m
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"path"
+	"time"
+)
+
+// Config holds the HTTP server settings; see the config package for how it is loaded
+type Config struct {
+	Port string `json:"port,omitempty"`
+
+	// GRPCPort serves the gRPC API on a port of its own, with the TLS settings of Port;
+	// empty disables it
+	GRPCPort string `json:"grpcPort,omitempty"`
+
+	// SSLDir holds SSLKeyFile and CAFile (the certificate bundle) unless they are absolute paths
+	SSLDir     string `json:"sslDir,omitempty"`
+	SSLKeyFile string `json:"sslKeyFile,omitempty"`
+	CAFile     string `json:"caFile,omitempty"`
+
+	// ClientCAFile enables verification of the client certificates presented (e.g. by
+	// federation peers) against these CAs; clients without a certificate are still served
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+
+	ReadTimeoutSeconds  int64 `json:"readTimeoutSeconds,omitempty"`
+	WriteTimeoutSeconds int64 `json:"writeTimeoutSeconds,omitempty"`
+
+	// MaxBodyBytes limits the size of request bodies
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+
+	// MaxQueryPrefixes limits the number of HashedPK prefixes in a single query
+	MaxQueryPrefixes int `json:"maxQueryPrefixes,omitempty"`
+
+	// HeartbeatSeconds is the interval of the heartbeats of subscriptions
+	// (DefaultHeartbeatSeconds if not set)
+	HeartbeatSeconds int `json:"heartbeatSeconds,omitempty"`
+
+	// MaxConcurrentPSI limits the PSI queries served at once, further ones are
+	// answered 429 (DefaultMaxConcurrentPSI if not set)
+	MaxConcurrentPSI int `json:"maxConcurrentPSI,omitempty"`
+
+	// MaxPSIPerClient limits the PSI queries of a client (by IP address) per PSI
+	// epoch, further ones are answered 429 (DefaultMaxPSIPerClient if not set)
+	MaxPSIPerClient int `json:"maxPSIPerClient,omitempty"`
+}
+
+// DefaultConfig returns the settings used when nothing else is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:                DefaultPort,
+		SSLDir:              sslBaseDir,
+		SSLKeyFile:          sslKeyFileName,
+		CAFile:              caFileName,
+		ReadTimeoutSeconds:  600,
+		WriteTimeoutSeconds: 600,
+		MaxBodyBytes:        32 << 20,
+		MaxQueryPrefixes:    100000,
+	}
+}
+
+// KeyFilePath returns the path of the TLS private key
+func (conf *Config) KeyFilePath() string {
+	return conf.sslPath(conf.SSLKeyFile)
+}
+
+// CAFilePath returns the path of the TLS certificate bundle
+func (conf *Config) CAFilePath() string {
+	return conf.sslPath(conf.CAFile)
+}
+
+func (conf *Config) sslPath(file string) string {
+	if path.IsAbs(file) {
+		return file
+	}
+	return path.Join(conf.SSLDir, file)
+}
+
+func (conf *Config) maxConcurrentPSI() int {
+	if conf.MaxConcurrentPSI > 0 {
+		return conf.MaxConcurrentPSI
+	}
+	return DefaultMaxConcurrentPSI
+}
+
+func (conf *Config) maxPSIPerClient() int {
+	if conf.MaxPSIPerClient > 0 {
+		return conf.MaxPSIPerClient
+	}
+	return DefaultMaxPSIPerClient
+}
+
+func (conf *Config) readTimeout() time.Duration {
+	return time.Duration(conf.ReadTimeoutSeconds) * time.Second
+}
+
+func (conf *Config) writeTimeout() time.Duration {
+	return time.Duration(conf.WriteTimeoutSeconds) * time.Second
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"path"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/logging"
+	"github.com/wolkdb/contact-tracing-server/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCServer returns the gRPC server of the API, with the limits, request IDs,
+// metrics and tracing of the HTTP server: MaxBodyBytes bounds the messages received
+// and the timeouts bound the handshake and the unary calls.  PIR and PSI, with their
+// query limits, are only served over HTTP.
+func (s *Server) newGRPCServer() *grpc.Server {
+	heartbeat := s.conf.heartbeat()
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+		// pings play the part of the heartbeats of the HTTP subscriptions: a client not
+		// answering them is disconnected
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: heartbeat, Timeout: heartbeat}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: heartbeat, PermitWithoutStream: true}),
+	}
+	if s.conf.MaxBodyBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(s.conf.MaxBodyBytes)))
+	}
+	if timeout := s.conf.readTimeout(); timeout > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(timeout))
+	}
+	srv := grpc.NewServer(opts...)
+	RegisterContactTracingServer(srv, &grpcAPI{s})
+	return srv
+}
+
+// ServeGRPC serves the gRPC API on lis until Shutdown; Start calls it on GRPCPort
+func (s *Server) ServeGRPC(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// stopGRPC lets the calls in progress finish, or ends them when ctx is done
+func (s *Server) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpc.Stop()
+	}
+}
+
+// metadataCarrier reads the trace context of a client from the gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// startCall does for a gRPC call what the HTTP middleware does for a request: it starts
+// a span, tags the call with an ID (taken from the x-request-id metadata if the client
+// sent one) and puts a logger carrying it into the context.  end records the outcome.
+func startCall(ctx context.Context, fullMethod string) (_ context.Context, end func(err error)) {
+	start := time.Now()
+	method := path.Base(fullMethod)
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx, span := tracing.StartServer(ctx, "gRPC "+method, metadataCarrier(md),
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.method", method))
+
+	requestID := metadataCarrier(md).Get(logging.RequestIDHeader)
+	if len(requestID) == 0 || len(requestID) > 64 {
+		requestID = logging.NewRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDHeader, requestID))
+	logger := slog.Default().With("requestID", requestID)
+	if span.SpanContext().IsValid() {
+		span.SetAttributes(attribute.String("request.id", requestID))
+		logger = logger.With("traceID", span.SpanContext().TraceID().String())
+	}
+	logger.Debug("call", "method", method)
+	ctx = logging.WithLogger(ctx, logger)
+
+	return ctx, func(err error) {
+		code := status.Code(err)
+		grpcRequests.WithLabelValues(method, code.String()).Inc()
+		grpcDuration.WithLabelValues(method, code.String()).Observe(time.Since(start).Seconds())
+		span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+		switch code {
+		case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss:
+			tracing.End(span, err)
+		default:
+			span.End()
+		}
+	}
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	// as WriteTimeout bounds an HTTP request; streams are bounded by their heartbeats
+	if timeout := s.conf.writeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx, end := startCall(ctx, info.FullMethod)
+	resp, err = handler(ctx, req)
+	end(err)
+	return resp, err
+}
+
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, end := startCall(ss.Context(), info.FullMethod)
+	err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	end(err)
+	return err
+}
+
+// serverStream hands the context of startCall to stream handlers
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+// grpcAPI serves the ContactTracing service with the backend operations of the HTTP API
+type grpcAPI struct {
+	s *Server
+}
+
+// fromMillis returns the time of a request field in unix milliseconds; zero is the zero time
+func fromMillis(name string, ms int64) (t time.Time, err error) {
+	if ms < 0 {
+		return t, status.Errorf(codes.InvalidArgument, "invalid %s", name)
+	}
+	if ms == 0 {
+		return t, nil
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+// window returns the since and until of a request, see parseWindow
+func window(sinceMs int64, untilMs int64) (since time.Time, until time.Time, err error) {
+	if since, err = fromMillis("since", sinceMs); err != nil {
+		return since, until, err
+	}
+	if until, err = fromMillis("until", untilMs); err != nil {
+		return since, until, err
+	}
+	if !until.IsZero() && !until.After(since) {
+		return since, until, status.Error(codes.InvalidArgument, "until must be after since")
+	}
+	return since, until, nil
+}
+
+// checkPrefixes checks a concatenation of 3 byte prefixes against MaxQueryPrefixes
+func (s *Server) checkPrefixes(prefixes []byte) error {
+	if len(prefixes)%backend.PrefixSize != 0 {
+		return status.Error(codes.InvalidArgument, "prefixes must be a concatenation of 3 byte prefixes")
+	}
+	if s.conf.MaxQueryPrefixes > 0 && len(prefixes)/backend.PrefixSize > s.conf.MaxQueryPrefixes {
+		return status.Errorf(codes.InvalidArgument, "too many prefixes, max %d", s.conf.MaxQueryPrefixes)
+	}
+	return nil
+}
+
+func toReports(reports []backend.CTReport) *Reports {
+	res := &Reports{Reports: make([]*Report, len(reports))}
+	for i, report := range reports {
+		res.Reports[i] = &Report{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg, Id: report.ID, Timestamp: report.Timestamp}
+	}
+	return res
+}
+
+// Report submits reports as POST /report does.  The status of every report is in the
+// results, so the call only fails if the request is invalid; the idempotency key is
+// matched against the JSON encoding of the reports, as a body POSTed by the Go client.
+func (g *grpcAPI) Report(ctx context.Context, req *ReportRequest) (*ReportResponse, error) {
+	if len(req.Reports) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no reports")
+	}
+	if len(req.IdempotencyKey) > backend.MaxIdempotencyKeyLength {
+		return nil, status.Errorf(codes.InvalidArgument, "idempotencyKey longer than %d bytes", backend.MaxIdempotencyKeyLength)
+	}
+	reports := make([]backend.CTReport, len(req.Reports))
+	for i, report := range req.Reports {
+		reports[i] = backend.CTReport{HashedPK: report.HashedPK, EncodedMsg: report.EncodedMsg}
+	}
+	body, err := json.Marshal(reports)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	results, replayed, err := g.s.submit(ctx, req.IdempotencyKey, sha256.Sum256(body), reports)
+	if err != nil {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	}
+	resp := &ReportResponse{Results: make([]*ReportResult, len(results)), Replayed: replayed}
+	for i, result := range results {
+		resp.Results[i] = &ReportResult{Status: result.Status, Reason: result.Reason}
+	}
+	return resp, nil
+}
+
+// Query returns the reports under the prefixes as POST /query does
+func (g *grpcAPI) Query(ctx context.Context, req *QueryRequest) (*Reports, error) {
+	since, until, err := window(req.Since, req.Until)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.s.checkPrefixes(req.Prefixes); err != nil {
+		return nil, err
+	}
+	queryPrefixes.Observe(float64(len(req.Prefixes) / backend.PrefixSize))
+	reports, err := g.s.backend.ProcessQueryRange(ctx, req.Prefixes, since, until)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return toReports(reports), nil
+}
+
+// Sync streams the reports of the window in pages of at most pageSize reports, as
+// GET /sync pages them
+func (g *grpcAPI) Sync(req *SyncRequest, stream ContactTracing_SyncServer) error {
+	ctx := stream.Context()
+	since, until, err := window(req.Since, req.Until)
+	if err != nil {
+		return err
+	}
+	if since.After(time.Now()) {
+		return status.Error(codes.InvalidArgument, "since is in the future")
+	}
+	shard, err := api.ParseShard(req.Shard)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.PageSize < 0 {
+		return status.Error(codes.InvalidArgument, "invalid pageSize")
+	}
+	limit := MaxSyncLimit
+	if req.PageSize > 0 && int(req.PageSize) < limit {
+		limit = int(req.PageSize)
+	}
+
+	total := 0
+	cursor := ""
+	for {
+		reports, next, err := g.s.backend.ProcessSyncRangePage(ctx, shard, since, until, cursor, limit)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if len(reports) > 0 {
+			if err := stream.Send(toReports(reports)); err != nil {
+				return err
+			}
+			total += len(reports)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	syncReports.Observe(float64(total))
+	return nil
+}
+
+// Subscribe streams the reports under the prefixes, or in the shard, as they are stored,
+// as GET /subscribe does; with since the reports stored from then on are sent first
+func (g *grpcAPI) Subscribe(req *SubscribeRequest, stream ContactTracing_SubscribeServer) error {
+	ctx := stream.Context()
+	if err := g.s.checkPrefixes(req.Prefixes); err != nil {
+		return err
+	}
+	shard, err := api.ParseShard(req.Shard)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(req.Prefixes) > 0 && shard.Bits > 0 {
+		return status.Error(codes.InvalidArgument, "prefixes and shard are exclusive")
+	}
+	since, err := fromMillis("since", req.Since)
+	if err != nil {
+		return err
+	}
+	sub, err := g.s.backend.Subscribe(ctx, req.Prefixes, shard, since)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer sub.Close()
+	// the headers tell the client it is subscribed
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-g.s.closing:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case reports, ok := <-sub.Reports():
+			if !ok {
+				err := sub.Err()
+				if err == nil || errors.Is(err, ctx.Err()) {
+					return status.FromContextError(ctx.Err()).Err()
+				}
+				logging.FromContext(ctx).Info("subscription ended", "err", err)
+				if errors.Is(err, backend.ErrSubscriberTooSlow) {
+					return status.Error(codes.ResourceExhausted, err.Error())
+				}
+				return status.Error(codes.Internal, err.Error())
+			}
+			if err := stream.Send(toReports(reports)); err != nil {
+				return err
+			}
+		}
+	}
+}
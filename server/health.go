@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// EndpointHealthz is the name of the HTTP endpoint for the liveness probe
+	EndpointHealthz = "healthz"
+
+	// EndpointReadyz is the name of the HTTP endpoint for the readiness probe
+	EndpointReadyz = "readyz"
+
+	readinessTimeout = 5 * time.Second
+)
+
+// CheckStatus is the result of a single health check
+type CheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthStatus is the JSON body returned by /healthz and /readyz
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckStatus `json:"checks,omitempty"`
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// AddReadinessCheck registers a check that must pass for /readyz to report ready
+func (s *Server) AddReadinessCheck(name string, check func(ctx context.Context) error) {
+	s.readinessChecks = append(s.readinessChecks, readinessCheck{name: name, check: check})
+}
+
+// checkCertificate fails if the serving certificate is not loaded or has expired
+func (s *Server) checkCertificate(ctx context.Context) error {
+	leaf, ok := s.certificate.Load().(*certificateInfo)
+	if !ok || leaf == nil {
+		return fmt.Errorf("certificate not loaded")
+	}
+	now := time.Now()
+	if now.Before(leaf.notBefore) {
+		return fmt.Errorf("certificate not valid before %v", leaf.notBefore)
+	}
+	if now.After(leaf.notAfter) {
+		return fmt.Errorf("certificate expired at %v", leaf.notAfter)
+	}
+	return nil
+}
+
+// checkShutdown fails once the server has started shutting down
+func (s *Server) checkShutdown(ctx context.Context) error {
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		return fmt.Errorf("shutting down")
+	}
+	return nil
+}
+
+// GET /healthz
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// GET /readyz
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	resCh := make(chan result, len(s.readinessChecks))
+	for _, c := range s.readinessChecks {
+		go func(c readinessCheck) {
+			resCh <- result{c.name, c.check(ctx)}
+		}(c)
+	}
+
+	status := HealthStatus{Status: "ok", Checks: make(map[string]CheckStatus)}
+	code := http.StatusOK
+	for range s.readinessChecks {
+		res := <-resCh
+		if res.err != nil {
+			status.Checks[res.name] = CheckStatus{Status: "fail", Error: res.err.Error()}
+			status.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		} else {
+			status.Checks[res.name] = CheckStatus{Status: "ok"}
+		}
+	}
+	writeHealth(w, code, status)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status HealthStatus) {
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(body)
+}
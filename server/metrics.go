@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+// EndpointMetrics is the name of the HTTP endpoint serving Prometheus metrics
+const EndpointMetrics = "metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_http_requests_total",
+		Help: "Number of HTTP requests by endpoint, method and status code.",
+	}, []string{"endpoint", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "contact_tracing_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by endpoint and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contact_tracing_http_requests_in_flight",
+		Help: "Number of HTTP requests currently being served.",
+	})
+
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contact_tracing_grpc_requests_total",
+		Help: "Number of gRPC calls by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "contact_tracing_grpc_request_duration_seconds",
+		Help:    "Latency of gRPC calls by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	queryPrefixes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "contact_tracing_query_prefixes",
+		Help:    "Number of HashedPK prefixes per query.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+
+	syncReports = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "contact_tracing_sync_result_reports",
+		Help:    "Number of reports returned per sync.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 12),
+	})
+)
+
+// endpointName maps a request path to the endpoint label, the same way getConnection routes it
+func endpointName(path string) string {
+	for _, endpoint := range []string{EndpointFederation, api.EndpointCTReport, api.EndpointCTQuery, api.EndpointCTSync, api.EndpointCTPIR, api.EndpointCTPSI, api.EndpointCTSubscribe, EndpointMetrics, EndpointHealthz, EndpointReadyz} {
+		if strings.Contains(path, endpoint) {
+			return endpoint
+		}
+	}
+	return "home"
+}
+
+// instrument records request counts, latencies and in-flight requests of h
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+
+		rec := logging.NewStatusRecorder(w)
+		h.ServeHTTP(rec, r)
+
+		endpoint := endpointName(r.URL.Path)
+		code := strconv.Itoa(rec.Status)
+		httpRequests.WithLabelValues(endpoint, r.Method, code).Inc()
+		httpDuration.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+	})
+}
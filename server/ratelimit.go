@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/backend"
+)
+
+// clientLimiter counts the requests of every client in fixed windows and refuses
+// the ones beyond limit in a window
+type clientLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newClientLimiter(limit int, window time.Duration) *clientLimiter {
+	return &clientLimiter{limit: limit, window: window, counts: make(map[string]int)}
+}
+
+// newPSILimiter limits the PSI queries of a client to MaxPSIPerClient per PSI epoch
+func newPSILimiter(conf *Config) *clientLimiter {
+	return newClientLimiter(conf.maxPSIPerClient(), backend.PSIEpoch)
+}
+
+// allow counts a request of client, and returns whether it is within the limit
+// along with the time left in the window
+func (l *clientLimiter) allow(client string) (ok bool, retryAfter time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if start := now.Truncate(l.window); !start.Equal(l.start) {
+		l.start = start
+		l.counts = make(map[string]int)
+	}
+	if l.counts[client] >= l.limit {
+		return false, l.start.Add(l.window).Sub(now)
+	}
+	l.counts[client]++
+	return true, 0
+}
+
+// clientAddr returns the IP address a request comes from
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,20 +1,31 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/wolkdb/contact-tracing-server/api"
 	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/logging"
+	"github.com/wolkdb/contact-tracing-server/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -26,13 +37,17 @@ const (
 	// DefaultPort is the port which the Contact Tracing  HTTP server is listening in on
 	DefaultPort = "8080"
 
-	// EndpointCTReport is the name of the HTTP endpoint for POST of CTReport
-	EndpointCTReport = "report"
+	// MaxSyncLimit is the largest page of a paged sync
+	MaxSyncLimit = 10000
 
-	// EndpointCTQuery is the name of the HTTP endpoint for POST of query to get reports
-	EndpointCTQuery = "query"
+	// DefaultMaxConcurrentPSI is the number of PSI queries served at once when not configured
+	DefaultMaxConcurrentPSI = 4
 
-	EndpointCTSync = "sync"
+	// DefaultMaxPSIPerClient is the number of PSI queries of a client per epoch when not configured
+	DefaultMaxPSIPerClient = 4
+
+	// EndpointFederation prefixes the endpoints served to federated servers (see Handle)
+	EndpointFederation = "federation"
 )
 
 // Server manages HTTP connections
@@ -40,184 +55,574 @@ type Server struct {
 	backend  *backend.Backend
 	Handler  http.Handler
 	HTTPPort string
+	conf     Config
+
+	mux             *http.ServeMux
+	srv             *http.Server
+	grpc            *grpc.Server
+	certificate     atomic.Value // *certificateInfo
+	shuttingDown    int32
+	readinessChecks []readinessCheck
+
+	// closing ends the subscriptions on shutdown, which would otherwise hold it up
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// psiSlots limits the PSI queries served at once: each costs a scalar
+	// multiplication per point and tests its points against the same epoch scalar
+	psiSlots chan struct{}
+
+	// psiClients limits the PSI queries of a client per epoch, and so the candidates
+	// it can test against one epoch scalar
+	psiClients *clientLimiter
+}
+
+type certificateInfo struct {
+	notBefore time.Time
+	notAfter  time.Time
 }
 
 // NewServer returns an HTTP Server
-func NewServer(httpPort string, backend *backend.Backend) (s *Server, err error) {
+func NewServer(conf *Config, backend *backend.Backend) (s *Server, err error) {
 	s = &Server{
-		HTTPPort: httpPort,
+		HTTPPort: conf.Port,
+		conf:     *conf,
+		closing:  make(chan struct{}),
+		psiSlots: make(chan struct{}, conf.maxConcurrentPSI()),
+
+		psiClients: newPSILimiter(conf),
 	}
 	s.backend = backend
+	s.AddReadinessCheck("backend", backend.Ping)
+	s.AddReadinessCheck("certs", s.checkCertificate)
+	s.AddReadinessCheck("shutdown", s.checkShutdown)
 
 	mux := http.NewServeMux()
+	s.mux = mux
 	// will change it later
 	mux.HandleFunc("/", s.getConnection)
-	s.Handler = mux
+	mux.Handle("/"+EndpointMetrics, promhttp.Handler())
+	mux.HandleFunc("/"+EndpointHealthz, s.healthzHandler)
+	mux.HandleFunc("/"+EndpointReadyz, s.readyzHandler)
+	s.Handler = tracing.Middleware(instrument(withRequestID(mux)), func(r *http.Request) string {
+		return "HTTP " + r.Method + " /" + endpointName(r.URL.Path)
+	})
+	s.grpc = s.newGRPCServer()
 	return s, nil
 }
 
 func (s *Server) getConnection(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	log.Println("getConnection")
-	if strings.Contains(r.URL.Path, EndpointCTReport) {
+	if s.conf.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.conf.MaxBodyBytes)
+	}
+	if strings.Contains(r.URL.Path, api.EndpointCTReport) {
 		if r.Method == http.MethodPost {
 			s.postReportHander(w, r)
 		} else {
 			s.homeHandler(w, r)
 		}
-	} else if strings.Contains(r.URL.Path, EndpointCTQuery) {
+	} else if strings.Contains(r.URL.Path, api.EndpointCTQuery) {
 		if r.Method == http.MethodPost {
 			s.postQueryHander(w, r)
 		} else {
 			s.homeHandler(w, r)
 		}
-	} else if strings.Contains(r.URL.Path, EndpointCTSync) {
+	} else if strings.Contains(r.URL.Path, api.EndpointCTSync) {
 		if r.Method == http.MethodGet {
 			s.getSyncHander(w, r)
 		} else {
 			s.homeHandler(w, r)
 		}
+	} else if strings.Contains(r.URL.Path, api.EndpointCTPIR) {
+		if r.Method == http.MethodPost {
+			s.postPIRHandler(w, r)
+		} else {
+			s.homeHandler(w, r)
+		}
+	} else if strings.Contains(r.URL.Path, api.EndpointCTPSI) {
+		if r.Method == http.MethodPost {
+			s.postPSIHandler(w, r)
+		} else {
+			s.homeHandler(w, r)
+		}
+	} else if strings.Contains(r.URL.Path, api.EndpointCTSubscribe) {
+		if r.Method == http.MethodGet {
+			s.getSubscribeHandler(w, r)
+		} else {
+			s.homeHandler(w, r)
+		}
 	} else {
 		s.homeHandler(w, r)
 	}
 }
 
-// Start kicks off the HTTP Server
+// Handle serves pattern with handler, ahead of the catch-all routing of getConnection;
+// it must be called before the server starts
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start kicks off the HTTP Server, and the gRPC server if GRPCPort is set.  It returns
+// when either fails, with its error, or once the servers are shut down.
 func (s *Server) Start() (err error) {
 	srv := &http.Server{
 		Addr:         ":" + s.HTTPPort,
 		Handler:      s.Handler,
-		ReadTimeout:  600 * time.Second,
-		WriteTimeout: 600 * time.Second,
-	}
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+		ReadTimeout:  s.conf.readTimeout(),
+		WriteTimeout: s.conf.writeTimeout(),
 	}
 
-	ssldir := os.Getenv("SSLDIR")
-	if ssldir == "" {
-		ssldir = sslBaseDir
-	}
-	SSLKeyFile := path.Join(ssldir, sslKeyFileName)
-	CAFile := path.Join(ssldir, caFileName)
-	log.Printf("SSLKeyFile = %s CAFile = %s", SSLKeyFile, CAFile)
+	SSLKeyFile := s.conf.KeyFilePath()
+	CAFile := s.conf.CAFilePath()
+	slog.Info("tls files", "sslKeyFile", SSLKeyFile, "caFile", CAFile)
 
 	// Note: bringing the intermediate certs with CAFile into a cert pool and the tls.Config is *necessary*
 	certpool := x509.NewCertPool() // https://stackoverflow.com/questions/26719970/issues-with-tls-connection-in-golang -- instead of x509.NewCertPool()
-	log.Printf("certpool %v\n", certpool)
 	pem, err := ioutil.ReadFile(CAFile)
 	if err != nil {
-		log.Printf("Failed to read client certificate authority: %v", err)
+		slog.Error("Failed to read client certificate authority", "err", err)
 		return fmt.Errorf("Failed to read client certificate authority: %v", err)
 	}
 	if !certpool.AppendCertsFromPEM(pem) {
-		log.Printf("Can't parse client certificate authority")
+		slog.Error("Can't parse client certificate authority")
 		return fmt.Errorf("Can't parse client certificate authority")
 	}
 
+	cert, err := tls.LoadX509KeyPair(CAFile, SSLKeyFile)
+	if err != nil {
+		slog.Error("Failed to load certificate", "err", err)
+		return fmt.Errorf("Failed to load certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Failed to parse certificate: %v", err)
+	}
+	s.certificate.Store(&certificateInfo{notBefore: leaf.NotBefore, notAfter: leaf.NotAfter})
+
 	config := tls.Config{
-		ClientCAs:  certpool,
-		ClientAuth: tls.NoClientCert, // tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    certpool,
+		ClientAuth:   tls.NoClientCert, // tls.RequireAndVerifyClientCert,
 	}
-	config.BuildNameToCertificate()
-	log.Printf("tls config ok %v\n", config)
+	// client certificates are verified if given, e.g. by federation peers; devices need none
+	if s.conf.ClientCAFile != "" {
+		clientCAs := x509.NewCertPool()
+		pem, err := ioutil.ReadFile(s.conf.sslPath(s.conf.ClientCAFile))
+		if err != nil {
+			return fmt.Errorf("Failed to read client CA file: %v", err)
+		}
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("Can't parse client CA file")
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	slog.Info("tls config ok", "notAfter", leaf.NotAfter)
 
 	srv.TLSConfig = &config
+	s.srv = srv
 
-	err = srv.ListenAndServeTLS(CAFile, SSLKeyFile)
-	log.Printf("Server listening on port %s %v", s.HTTPPort, err)
-	if err != nil {
-		log.Printf("ListenAndServeTLS err %v", err)
+	grpcErr := make(chan error, 1)
+	if s.conf.GRPCPort != "" {
+		grpcConfig := config.Clone()
+		grpcConfig.NextProtos = []string{"h2"}
+		lis, err := tls.Listen("tcp", ":"+s.conf.GRPCPort, grpcConfig)
+		if err != nil {
+			return fmt.Errorf("gRPC listen: %v", err)
+		}
+		slog.Info("gRPC server listening", "port", s.conf.GRPCPort)
+		go func() {
+			if err := s.ServeGRPC(lis); err != nil {
+				grpcErr <- fmt.Errorf("ServeGRPC: %v", err)
+				// stop the HTTP server too, so that Start returns the error
+				srv.Close()
+			}
+		}()
+	}
+
+	slog.Info("Server listening", "port", s.HTTPPort)
+	err = srv.ListenAndServeTLS("", "")
+	if err != nil && err != http.ErrServerClosed {
+		slog.Error("ListenAndServeTLS", "err", err)
+		return err
+	}
+	select {
+	case err = <-grpcErr:
+		slog.Error("ServeGRPC", "err", err)
 		return err
+	default:
 	}
-	log.Printf("Server listening on port %s", s.HTTPPort)
 	return nil
 }
 
+// Shutdown marks the server as not ready and gracefully stops the HTTP and gRPC Servers
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	s.closingOnce.Do(func() { close(s.closing) })
+	s.stopGRPC(ctx)
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
 func (s *Server) homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("FindMyKey API Server v0.1"))
 }
 
-//POST /report
+// POST /report
+// body is a JSON array of CTReports, the response a JSON array with the ReportResult of
+// each: 200 if any report was accepted, 503 if none was but some may be resubmitted,
+// 400 if all were rejected.  Resubmitting the reports not accepted is safe.  With an
+// Idempotency-Key, the results of a submission without retryable reports are recorded
+// and returned again for the same key and body.
 func (s *Server) postReportHander(w http.ResponseWriter, r *http.Request) {
-	log.Println("postReportHander")
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	key := r.Header.Get(api.IdempotencyKeyHeader)
+	if len(key) > backend.MaxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("%s longer than %d bytes", api.IdempotencyKeyHeader, backend.MaxIdempotencyKeyLength), http.StatusBadRequest)
 		return
 	}
-	r.Body.Close()
 
 	// Parse body as CTReport
 	var payload []backend.CTReport
-	err = json.Unmarshal(body, &payload)
+	err := json.Unmarshal(body, &payload)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload) == 0 {
+		http.Error(w, "no reports", http.StatusBadRequest)
 		return
 	}
 
-	err = s.backend.ProcessReport(payload)
+	results, replayed, err := s.submit(r.Context(), key, sha256.Sum256(body), payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if replayed {
+		w.Header().Set(api.IdempotentReplayedHeader, "true")
+	}
+	writeReportResults(w, results)
+}
+
+// errKeyReused refuses a submission repeating the idempotency key of a different one
+var errKeyReused = errors.New("idempotency key reused for a different request")
+
+// submit processes reports, or with an idempotency key returns the results recorded for
+// an earlier submission with the same key (replayed), or errKeyReused if that one had
+// another requestHash.  The results of a submission without retryable reports are recorded.
+func (s *Server) submit(ctx context.Context, key string, requestHash [sha256.Size]byte, reports []backend.CTReport) (results []backend.ReportResult, replayed bool, err error) {
+	logger := logging.FromContext(ctx)
+	if key != "" {
+		submission, err := s.backend.LookupSubmission(ctx, key)
+		if err != nil {
+			// submitting twice stores each report once, so carry on without the record
+			logger.Error("LookupSubmission", "err", err)
+		} else if submission != nil {
+			if !bytes.Equal(submission.RequestHash, requestHash[:]) {
+				return nil, false, errKeyReused
+			}
+			return submission.Results, true, nil
+		}
+	}
+
+	results, _ = s.backend.ProcessReportResults(ctx, reports)
+	if key != "" && !anyRetryable(results) {
+		if err = s.backend.RecordSubmission(ctx, key, &backend.Submission{RequestHash: requestHash[:], Results: results}); err != nil {
+			logger.Error("RecordSubmission", "err", err)
+		}
+	}
+	return results, false, nil
+}
+
+func anyRetryable(results []backend.ReportResult) bool {
+	for _, result := range results {
+		if result.Status == backend.ReportRetryable {
+			return true
+		}
+	}
+	return false
+}
+
+// writeReportResults answers a report submission, see postReportHander
+func writeReportResults(w http.ResponseWriter, results []backend.ReportResult) {
+	status := http.StatusBadRequest
+	for _, result := range results {
+		if result.Status == backend.ReportAccepted {
+			status = http.StatusOK
+			break
+		}
+		if result.Status == backend.ReportRetryable {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	jsonResults, err := json.Marshal(results)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
 	}
-	w.Write([]byte("OK"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResults)
 }
 
-//POST /query/timestamp
+// POST /query?since=timestamp[&until=timestamp]
+// body is a concatenation of 3 byte HashedPK prefixes
 func (s *Server) postQueryHander(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	since, until, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	if len(body)%3 != 0 {
+		http.Error(w, "query must be a concatenation of 3 byte prefixes", http.StatusBadRequest)
+		return
+	}
+	if s.conf.MaxQueryPrefixes > 0 && len(body)/3 > s.conf.MaxQueryPrefixes {
+		http.Error(w, fmt.Sprintf("too many prefixes, max %d", s.conf.MaxQueryPrefixes), http.StatusBadRequest)
+		return
+	}
+	queryPrefixes.Observe(float64(len(body) / 3))
+	reports, err := s.backend.ProcessQueryRange(r.Context(), body, since, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeReports(w, reports)
+}
+
+// GET /sync?since=timestamp[&until=timestamp][&prefix=shard][&limit=n&cursor=c]
+func (s *Server) getSyncHander(w http.ResponseWriter, r *http.Request) {
+	since, until, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	shard, err := api.ParseShard(r.URL.Query().Get("prefix"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	r.Body.Close()
+	if since.After(time.Now()) {
+		http.Error(w, "since is in the future", http.StatusBadRequest)
+		return
+	}
 
-	str := r.URL.Query().Get("since")
-	if len(str) == 0 {
-		http.Error(w, "no start time", http.StatusBadRequest)
+	// paged sync: limit and cursor, the next cursor is returned in X-Next-Cursor
+	q := r.URL.Query()
+	if q.Get("limit") != "" || q.Get("cursor") != "" {
+		limit := MaxSyncLimit
+		if str := q.Get("limit"); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			if n < limit {
+				limit = n
+			}
+		}
+		reports, next, err := s.backend.ProcessSyncRangePage(r.Context(), shard, since, until, q.Get("cursor"), limit)
+		if errors.Is(err, backend.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		syncReports.Observe(float64(len(reports)))
+		w.Header().Set(api.NextCursorHeader, next)
+		writeReports(w, reports)
+		return
+	}
+
+	reports, err := s.backend.ProcessSyncRange(r.Context(), shard, since, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	syncReports.Observe(float64(len(reports)))
+	writeReports(w, reports)
+}
 
-	timestamp, err := strconv.ParseInt(str, 10, 64)
+// readBody reads the request body, answering 413 or 400 if that fails
+func readBody(w http.ResponseWriter, r *http.Request) (body []byte, ok bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
 	if err != nil {
-		////
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return nil, false
 	}
-	reports, err := s.backend.ProcessQuery(body, timestamp)
+	return body, true
+}
+
+// millisThreshold separates the two units of time parameters: smaller values are unix
+// seconds, larger ones unix milliseconds (1e11 seconds is in the year 5138)
+const millisThreshold = 1e11
+
+// parseTime returns the named time parameter, in unix seconds or milliseconds
+func parseTime(r *http.Request, name string) (t time.Time, err error) {
+	n, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	if err != nil || n < 0 {
+		return t, fmt.Errorf("invalid %s", name)
+	}
+	if n >= millisThreshold {
+		return time.Unix(0, n*int64(time.Millisecond)), nil
+	}
+	return time.Unix(n, 0), nil
+}
+
+// parseSince returns the since parameter, answering 400 if it is missing or invalid
+func parseSince(w http.ResponseWriter, r *http.Request) (since time.Time, ok bool) {
+	if len(r.URL.Query().Get("since")) == 0 {
+		http.Error(w, "no start time", http.StatusBadRequest)
+		return since, false
+	}
+	since, err := parseTime(r, "since")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return since, false
+	}
+	return since, true
+}
+
+// parseWindow returns the since and until parameters, answering 400 if since is missing,
+// either is invalid or until is not after since; until is zero if not given
+func parseWindow(w http.ResponseWriter, r *http.Request) (since time.Time, until time.Time, ok bool) {
+	if since, ok = parseSince(w, r); !ok {
+		return since, until, false
+	}
+	if len(r.URL.Query().Get("until")) == 0 {
+		return since, until, true
+	}
+	until, err := parseTime(r, "until")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return since, until, false
+	}
+	if !until.After(since) {
+		http.Error(w, "until must be after since", http.StatusBadRequest)
+		return since, until, false
+	}
+	return since, until, true
+}
+
+func writeReports(w http.ResponseWriter, reports []backend.CTReport) {
+	if reports == nil {
+		reports = []backend.CTReport{}
 	}
 	jsonReports, err := json.Marshal(reports)
 	if err != nil {
-		/////
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(jsonReports)
 }
 
-//POST /sync?since=timestamp
-func (s *Server) getSyncHander(w http.ResponseWriter, r *http.Request) {
-	str := r.URL.Query().Get("since")
-	if len(str) == 0 {
-		http.Error(w, "no start time", http.StatusBadRequest)
+// POST /pir?since=timestamp
+// body is a PIRQuerySize byte bit vector, response is the XOR of the selected buckets
+func (s *Server) postPIRHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
 		return
 	}
-	timestamp, err := strconv.ParseInt(str, 10, 64)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	since, ok := parseSince(w, r)
+	if !ok {
 		return
 	}
-	if timestamp > time.Now().Unix() {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if len(body) != backend.PIRQuerySize {
+		http.Error(w, fmt.Sprintf("query must be %d bytes", backend.PIRQuerySize), http.StatusBadRequest)
 		return
 	}
-	reports, err := s.backend.ProcessSync(timestamp)
+
+	answer, epoch, err := s.backend.ProcessPIR(r.Context(), body, since.Unix())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	jsonReports, err := json.Marshal(reports)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-PIR-Epoch", strconv.FormatInt(epoch, 10))
+	w.Write(answer)
+}
+
+// POST /psi?since=timestamp
+// body is a concatenation of blinded P256 points, see backend.PSIClient
+func (s *Server) postPSIHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	since, ok := parseSince(w, r)
+	if !ok {
+		return
+	}
+	if len(body) == 0 || len(body)%backend.PSIPointSize != 0 || len(body)/backend.PSIPointSize > backend.PSIMaxQuery {
+		http.Error(w, "invalid PSI query", http.StatusBadRequest)
+		return
+	}
+	if ok, retryAfter := s.psiClients.allow(clientAddr(r)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "too many PSI queries this epoch", http.StatusTooManyRequests)
+		return
+	}
+	select {
+	case s.psiSlots <- struct{}{}:
+		defer func() { <-s.psiSlots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many PSI queries", http.StatusTooManyRequests)
+		return
+	}
+
+	resp, err := s.backend.ProcessPSI(r.Context(), body, since.Unix())
+	if errors.Is(err, backend.ErrInvalidPSIQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonResp, err := json.Marshal(resp)
 	if err != nil {
-		/////
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	w.Write(jsonReports)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResp)
+}
+
+// withRequestID tags every request with an ID (taken from X-Request-ID if the client sent one)
+// and puts a logger carrying it into the request context
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(logging.RequestIDHeader)
+		if len(requestID) == 0 || len(requestID) > 64 {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, requestID)
+		logger := slog.Default().With("requestID", requestID)
+		if span := trace.SpanFromContext(r.Context()); span.SpanContext().IsValid() {
+			span.SetAttributes(attribute.String("request.id", requestID))
+			logger = logger.With("traceID", span.SpanContext().TraceID().String())
+		}
+		logger.Debug("request", "method", r.Method, "path", r.URL.Path, "contentLength", r.ContentLength)
+		h.ServeHTTP(w, r.WithContext(logging.WithLogger(r.Context(), logger)))
+	})
 }
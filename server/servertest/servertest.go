@@ -0,0 +1,45 @@
+// Package servertest starts the contact tracing API on an in-memory backend for tests
+package servertest
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/backend/backendtest"
+	"github.com/wolkdb/contact-tracing-server/server"
+)
+
+// Server is the HTTP API on an in-memory backend
+type Server struct {
+	*httptest.Server
+	API     *server.Server
+	Backend *backend.Backend
+}
+
+// New starts the HTTP API with conf (the default config if nil); the server and the
+// backend are closed when the test ends
+func New(t testing.TB, conf *server.Config) *Server {
+	t.Helper()
+	if conf == nil {
+		c := server.DefaultConfig()
+		conf = &c
+	}
+	b, closeBackend, err := backendtest.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewServer(conf, b)
+	if err != nil {
+		closeBackend()
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler)
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		ts.Close()
+		closeBackend()
+	})
+	return &Server{Server: ts, API: s, Backend: b}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wolkdb/contact-tracing-server/api"
+	"github.com/wolkdb/contact-tracing-server/backend"
+	"github.com/wolkdb/contact-tracing-server/logging"
+)
+
+const (
+	// DefaultHeartbeatSeconds is the interval of subscription heartbeats when
+	// HeartbeatSeconds is not set
+	DefaultHeartbeatSeconds = 15
+)
+
+var upgrader = websocket.Upgrader{
+	// the API is open to every origin, see the Access-Control-Allow-Origin of getConnection
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// GET /subscribe?prefixes=hex,hex...|prefix=shard[&since=timestamp]
+// pushes the reports stored under the prefixes (3 bytes each) or in the shard as they
+// are stored: as Server-Sent Events, or as WebSocket text messages if the request is a
+// WebSocket upgrade.  Every report is a JSON CTReport.  With since, or the Last-Event-ID
+// of a reconnecting EventSource, the reports stored from then on are sent first.
+func (s *Server) getSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var query []byte
+	if str := q.Get("prefixes"); str != "" {
+		for _, prefix := range strings.Split(str, ",") {
+			b, err := hex.DecodeString(prefix)
+			if err != nil || len(b) != backend.PrefixSize {
+				http.Error(w, fmt.Sprintf("invalid prefix %q", prefix), http.StatusBadRequest)
+				return
+			}
+			query = append(query, b...)
+		}
+		if s.conf.MaxQueryPrefixes > 0 && len(query)/backend.PrefixSize > s.conf.MaxQueryPrefixes {
+			http.Error(w, fmt.Sprintf("too many prefixes, max %d", s.conf.MaxQueryPrefixes), http.StatusBadRequest)
+			return
+		}
+	}
+	shard, err := api.ParseShard(q.Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(query) > 0 && shard.Bits > 0 {
+		http.Error(w, "prefixes and prefix are exclusive", http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if q.Get("since") != "" {
+		if since, err = parseTime(r, "since"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if id := r.Header.Get(api.LastEventIDHeader); id != "" {
+		ms, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || ms < 0 {
+			http.Error(w, "invalid "+api.LastEventIDHeader, http.StatusBadRequest)
+			return
+		}
+		// from the millisecond of the last report, which may not have been sent in full;
+		// the client drops the reports it already has by ID
+		since = time.Unix(0, ms*int64(time.Millisecond))
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWebSocket(w, r, query, shard, since)
+		return
+	}
+	s.serveEvents(w, r, query, shard, since)
+}
+
+// heartbeat returns the interval of subscription heartbeats
+func (conf *Config) heartbeat() time.Duration {
+	if conf.HeartbeatSeconds > 0 {
+		return time.Duration(conf.HeartbeatSeconds) * time.Second
+	}
+	return DefaultHeartbeatSeconds * time.Second
+}
+
+// serveEvents streams the subscription as Server-Sent Events: an event "report" per
+// report with its receipt time as id, a comment every heartbeat and, if the
+// subscription fails, an event "error" before the stream ends
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, query []byte, shard backend.Shard, since time.Time) {
+	ctx := r.Context()
+	sub, err := s.backend.Subscribe(ctx, query, shard, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer sub.Close()
+
+	rc := http.NewResponseController(w)
+	// a write stuck for longer than the write timeout ends the stream, which may
+	// otherwise last longer than the server allows a request
+	write := func(b []byte) error {
+		if timeout := s.conf.writeTimeout(); timeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := write([]byte(": subscribed\n\n")); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.conf.heartbeat())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			if err := write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+		case reports, ok := <-sub.Reports():
+			if !ok {
+				if err := sub.Err(); err != nil && !errors.Is(err, ctx.Err()) {
+					logging.FromContext(ctx).Info("subscription ended", "err", err)
+					write([]byte("event: error\ndata: " + err.Error() + "\n\n"))
+				}
+				return
+			}
+			var buf []byte
+			for _, report := range reports {
+				data, err := json.Marshal(report)
+				if err != nil {
+					return
+				}
+				buf = append(buf, fmt.Sprintf("id: %d\nevent: report\ndata: %s\n\n", report.Timestamp, data)...)
+			}
+			if err := write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveWebSocket streams the subscription over a WebSocket: a text message per
+// report and a ping every heartbeat; a client not answering pings is disconnected
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, query []byte, shard backend.Shard, since time.Time) {
+	ctx := r.Context()
+	sub, err := s.backend.Subscribe(ctx, query, shard, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer sub.Close()
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade answered the request
+		return
+	}
+	defer conn.Close()
+
+	heartbeat := s.conf.heartbeat()
+	writeTimeout := s.conf.writeTimeout()
+	if writeTimeout <= 0 {
+		writeTimeout = heartbeat
+	}
+	// the client only sends control messages; reading processes them and notices
+	// when it goes away
+	conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+	})
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(writeTimeout))
+			return
+		case <-gone:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+		case reports, ok := <-sub.Reports():
+			if !ok {
+				if err := sub.Err(); err != nil && !errors.Is(err, ctx.Err()) {
+					logging.FromContext(ctx).Info("subscription ended", "err", err)
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(writeTimeout))
+				}
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			for _, report := range reports {
+				if err := conn.WriteJSON(report); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/wolkdb/contact-tracing-server/backend"
+)
+
+// transferFlags are the flags of the export and import commands
+type transferFlags struct {
+	file     string
+	keyFile  string
+	since    int64
+	compress bool
+}
+
+func (f *transferFlags) register(fs *flag.FlagSet, command string) {
+	fs.StringVar(&f.file, "file", "-", "export file, - for standard output or input")
+	fs.StringVar(&f.keyFile, "key-file", "", "AES-256 key (32 bytes, raw or hex) to encrypt or decrypt the export file")
+	if command == "export" {
+		fs.Int64Var(&f.since, "since", 0, "export only the reports received since this unix time")
+		fs.BoolVar(&f.compress, "compress", false, "gzip the export file")
+	}
+}
+
+func (f *transferFlags) key() ([]byte, error) {
+	if f.keyFile == "" {
+		return nil, nil
+	}
+	return backend.ReadExportKey(f.keyFile)
+}
+
+// exportReports writes the reports of the configured table to an export file
+func exportReports(ctx context.Context, conf *backend.Config, f *transferFlags) (err error) {
+	key, err := f.key()
+	if err != nil {
+		return err
+	}
+	store, err := backend.NewBackend(conf)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = os.Stdout
+	if f.file != "-" {
+		var file *os.File
+		if file, err = os.OpenFile(f.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(f.file)
+			}
+		}()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+	var since time.Time
+	if f.since > 0 {
+		since = time.Unix(f.since, 0)
+	}
+	start := time.Now()
+	n, err := backend.Export(ctx, store, w, since, backend.ExportOptions{
+		Compress: f.compress,
+		Key:      key,
+		Source:   conf.BigtableProject + "/" + conf.BigtableInstance + "/" + conf.TableName,
+	})
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	slog.Info("export done", "reports", n, "file", f.file, "compressed", f.compress, "encrypted", key != nil, "elapsed", time.Since(start))
+	return nil
+}
+
+// importReports writes the reports of an export file to the configured table
+func importReports(ctx context.Context, conf *backend.Config, f *transferFlags) error {
+	key, err := f.key()
+	if err != nil {
+		return err
+	}
+	store, err := backend.NewBackend(conf)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if f.file != "-" {
+		file, err := os.Open(f.file)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	start := time.Now()
+	header, n, err := backend.Import(ctx, store, bufio.NewReader(in), key)
+	if err != nil {
+		slog.Error("import failed", "reportsImported", n, "err", err)
+		return err
+	}
+	slog.Info("import done", "reports", n, "source", header.Source, "exported", time.Unix(0, header.CreatedMicros*int64(time.Microsecond)), "elapsed", time.Since(start))
+	return nil
+}